@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -12,12 +14,27 @@ var (
 	ErrNotFound  = errors.New("key not found")
 	ErrValueSize = errors.New("value size exceeded")
 	ErrValueCrc  = errors.New("value checksum err")
+	ErrNotStored = errors.New("item not stored")
+
+	ErrCasConflict  = errors.New("cas conflict")
+	ErrInvalidRange = errors.New("invalid range")
+	ErrNotNumber    = errors.New("cannot increment or decrement non-numeric value")
+	ErrOverwritten  = errors.New("reserved space overwritten before commit")
+	ErrShortValue   = errors.New("value shorter than reserved")
+	ErrBadManifest  = errors.New("bad manifest")
+	ErrInvalidPart  = errors.New("invalid part number")
+	ErrMissingPart  = errors.New("part missing")
+	ErrPinned       = errors.New("space in use by readers")
+	ErrInvalidKey   = errors.New("invalid key")
 )
 
 const (
 	MaxShards    = 128
 	MaxValueSize = int64(128 << 20) // 128MB
 	MinShardSize = MaxValueSize + 4096
+
+	ChunkSize           = int64(64 << 20) // values larger than MaxValueSize are stored in chunks across shards
+	MaxChunkedValueSize = int64(8 << 30)  // 8GB
 )
 
 type CacheMetrics struct {
@@ -62,6 +79,46 @@ func (st *CacheStats) Add(o CacheStats) {
 	}
 }
 
+// SizeClasses is the number of classes in ShardStatus.Sizes,
+// value sizes in [2^(i-1), 2^i) are counted in class i, and 0 in class 0.
+const SizeClasses = 29 // 2^28 > MaxValueSize
+
+// ShardStatus is the internal status of a shard
+type ShardStatus struct {
+	Term     int64 // term of the datafile
+	Head     int64 // offset of the datafile for the next write
+	DataSize int64 // size of the datafile
+	Cas      uint64
+
+	GCScanned    uint64              // number of items scanned by the running gc round
+	GCPurged     uint64              // number of items purged by the running gc round
+	GCLastFinish int64               // finish time of the last gc round
+	Sizes        [SizeClasses]uint64 // histogram of value sizes collected by the last gc round
+}
+
+// KeyInfo is the metadata of an item returned by Scan
+type KeyInfo struct {
+	Key       string
+	Size      int64 // size of value
+	Timestamp int64
+	TTL       uint32
+	Flags     uint32
+	Cas       uint64
+	MD5       []byte
+
+	manifest bool // Size is the size of manifest before Cache.Scan
+}
+
+// StoreMode is the condition of storing an item
+type StoreMode int
+
+const (
+	StoreSet     StoreMode = iota // always
+	StoreAdd                      // only if the key does not exist
+	StoreReplace                  // only if the key exists
+	StoreCAS                      // only if the cas unique of the key equals to Item.Cas
+)
+
 type Cache struct {
 	hash   ConsistentHash
 	shards []*Shard
@@ -75,8 +132,12 @@ type Item struct {
 	Timestamp int64
 	TTL       uint32
 	Flags     uint32
+	Cas       uint64 // cas unique, updated after the item stored
+	Stale     bool   // the item is invalidated but not removed, see Shard.CompareAndSwap for setting it
+	MD5       []byte // the md5 of value given by the caller, it's stored as is and cleared by Append, Prepend, Incr and Decr
 
-	free func(*Item)
+	manifest bool // the value is a Manifest of parts, only for items of shards
+	free     func(*Item)
 }
 
 func (i *Item) Free() {
@@ -99,6 +160,10 @@ type CacheOptions struct {
 	Allocator Allocator
 
 	DisableGC bool
+
+	// keys longer than HashKeyLen are stored in index under their SHA-256 digests if > 0,
+	// the full keys are kept in index for detecting collisions and scans.
+	HashKeyLen int
 }
 
 var DefualtCacheOptions = CacheOptions{
@@ -142,6 +207,8 @@ func NewCache(path string, options *CacheOptions) (*Cache, error) {
 			TTL:       options.TTL,
 			Allocator: options.Allocator,
 			DisableGC: options.DisableGC,
+
+			HashKeyLen: options.HashKeyLen,
 		}
 		cache.shards[i], err = LoadCacheShard(fn, sopts)
 		if err != nil {
@@ -167,22 +234,332 @@ func (c *Cache) getshard(key string) *Shard {
 	return c.shards[c.hash.Get(key)]
 }
 
+// Set stores the item, values larger than MaxValueSize are stored in chunks, see NewWriter
 func (c *Cache) Set(item *Item) error {
+	if isInternalKey(item.Key) {
+		return ErrInvalidKey
+	}
 	if int64(len(item.Value)) > MaxValueSize {
-		return ErrValueSize
+		return c.storeChunked(item, StoreSet)
 	}
 	s := c.getshard(item.Key)
 	return s.Set(item)
 }
 
+// Add stores the item only if the key does not exist, returns ErrNotStored if it does
+func (c *Cache) Add(item *Item) error {
+	if isInternalKey(item.Key) {
+		return ErrInvalidKey
+	}
+	if int64(len(item.Value)) > MaxValueSize {
+		return c.storeChunked(item, StoreAdd)
+	}
+	s := c.getshard(item.Key)
+	return s.Add(item)
+}
+
+// Replace stores the item only if the key already exists, returns ErrNotStored if not
+func (c *Cache) Replace(item *Item) error {
+	if isInternalKey(item.Key) {
+		return ErrInvalidKey
+	}
+	if int64(len(item.Value)) > MaxValueSize {
+		return c.storeChunked(item, StoreReplace)
+	}
+	s := c.getshard(item.Key)
+	return s.Replace(item)
+}
+
+// CompareAndSwap stores the item only if the cas unique of the key equals to item.Cas,
+// returns ErrCasConflict if it was modified since, or ErrNotFound if the key not exists
+func (c *Cache) CompareAndSwap(item *Item) error {
+	if isInternalKey(item.Key) {
+		return ErrInvalidKey
+	}
+	if int64(len(item.Value)) > MaxValueSize {
+		return c.storeChunked(item, StoreCAS)
+	}
+	s := c.getshard(item.Key)
+	return s.CompareAndSwap(item)
+}
+
+// CanStore returns nil if item can be stored with mode now, it's checked again when storing.
+// it avoids writing a large value which is not stored, item is not changed
+func (c *Cache) CanStore(item *Item, mode StoreMode) error {
+	if isInternalKey(item.Key) {
+		return ErrInvalidKey
+	}
+	return c.getshard(item.Key).canStore(item, mode)
+}
+
+// NewWriter reserves n bytes for the value of item, and returns the writer for streaming the value.
+// the item is stored by ValueWriter.Commit, see ItemWriter.
+// if n > MaxValueSize, the value is written in chunks of ChunkSize placed across shards by their keys,
+// and the item is stored as a manifest of the chunks like multipart uploads.
+func (c *Cache) NewWriter(item *Item, n int64) (ValueWriter, error) {
+	if isInternalKey(item.Key) {
+		return nil, ErrInvalidKey
+	}
+	if n > MaxChunkedValueSize {
+		return nil, ErrValueSize
+	}
+	if n > MaxValueSize {
+		return c.newChunkedWriter(item, n)
+	}
+	w, err := c.getshard(item.Key).NewWriter(item, n)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Append appends item.Value to the existing value of item.Key, returns ErrNotStored if the key not exists
+func (c *Cache) Append(item *Item) error {
+	if isInternalKey(item.Key) {
+		return ErrInvalidKey
+	}
+	if int64(len(item.Value)) > MaxValueSize {
+		return ErrValueSize
+	}
+	s := c.getshard(item.Key)
+	return s.Append(item)
+}
+
+// Prepend prepends item.Value to the existing value of item.Key, returns ErrNotStored if the key not exists
+func (c *Cache) Prepend(item *Item) error {
+	if isInternalKey(item.Key) {
+		return ErrInvalidKey
+	}
+	if int64(len(item.Value)) > MaxValueSize {
+		return ErrValueSize
+	}
+	s := c.getshard(item.Key)
+	return s.Prepend(item)
+}
+
+// Incr increases the decimal value of key by delta and returns the new value, it wraps around on overflow
+func (c *Cache) Incr(key string, delta uint64) (uint64, error) {
+	if isInternalKey(key) {
+		return 0, ErrNotFound
+	}
+	s := c.getshard(key)
+	return s.Incr(key, delta)
+}
+
+// Decr decreases the decimal value of key by delta and returns the new value, it stops at 0
+func (c *Cache) Decr(key string, delta uint64) (uint64, error) {
+	if isInternalKey(key) {
+		return 0, ErrNotFound
+	}
+	s := c.getshard(key)
+	return s.Decr(key, delta)
+}
+
+// Get returns the item of key, the value of multipart items is reassembled if not larger than MaxValueSize
 func (c *Cache) Get(key string) (*Item, error) {
+	if isInternalKey(key) {
+		return nil, ErrNotFound
+	}
 	s := c.getshard(key)
-	return s.Get(key)
+	item, err := s.Get(key)
+	if err != nil || !item.manifest {
+		return item, err
+	}
+	return c.getManifestValue(item, MaxValueSize)
 }
 
+// getManifestValue returns the item with the value reassembled from the parts of the multipart item,
+// or ErrValueSize if the value is larger than maxSize
+func (c *Cache) getManifestValue(item *Item, maxSize int64) (*Item, error) {
+	m, err := decodeManifestItem(item)
+	if err != nil {
+		return nil, err
+	}
+	if m.Size > maxSize {
+		item.Free()
+		return nil, ErrValueSize
+	}
+	ci, _, err := c.getManifestRange(item, m, 0, m.Size)
+	return ci, err
+}
+
+// GetReader returns the item of key for streaming its value, see Shard.GetReader.
+// the value of multipart items is always streamed by the reader, which reads the parts in order.
+func (c *Cache) GetReader(key string, minSize int64, verifyCrc bool) (*Item, ValueReader, error) {
+	if isInternalKey(key) {
+		return nil, nil, ErrNotFound
+	}
+	item, r, err := c.getshard(key).GetReader(key, minSize, verifyCrc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if item.manifest {
+		return c.newManifestReader(item, r, verifyCrc)
+	}
+	if r == nil {
+		return item, nil, nil
+	}
+	return item, r, nil
+}
+
+// GetRange returns the item of key with at most n bytes of the value at off, and the size of the whole value,
+// off < 0 is relative to the end of the value. it returns ErrInvalidRange if off exceeds the size.
+func (c *Cache) GetRange(key string, off, n int64) (*Item, int64, error) {
+	if isInternalKey(key) {
+		return nil, 0, ErrNotFound
+	}
+	s := c.getshard(key)
+	item, size, err := s.GetRange(key, off, n)
+	switch {
+	case err == ErrInvalidRange:
+		// the range of multipart items is checked against the size of parts
+		if ii, er := s.stat(key); er != nil || !ii.Manifest {
+			return nil, size, err
+		}
+	case err != nil:
+		return nil, size, err
+	case !item.manifest:
+		return item, size, nil
+	default:
+		item.Free() // a range of the manifest
+	}
+	item, err = s.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !item.manifest { // replaced
+		item.Free()
+		return nil, 0, ErrNotFound
+	}
+	m, err := decodeManifestItem(item)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c.getManifestRange(item, m, off, n)
+}
+
+// Scan returns at most max items with prefix and key >= start in order of keys across shards,
+// internal keys are not returned.
+func (c *Cache) Scan(prefix, start string, max int) ([]KeyInfo, error) {
+	if isInternalKey(prefix) {
+		return nil, nil
+	}
+	return c.scan(prefix, start, max)
+}
+
+// scan is like Scan, internal keys are only scanned with the internal prefix
+func (c *Cache) scan(prefix, start string, max int) ([]KeyInfo, error) {
+	var ret []KeyInfo
+	for _, s := range c.shards {
+		infos, err := s.Scan(prefix, start, max)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			// internal keys are only scanned with the internal prefix
+			if strings.HasPrefix(info.Key, internalKeyPrefix) && !strings.HasPrefix(prefix, internalKeyPrefix) {
+				continue
+			}
+			ret = append(ret, info)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	if len(ret) > max {
+		ret = ret[:max]
+	}
+	for i := range ret {
+		if !ret[i].manifest {
+			continue
+		}
+		m, err := c.getManifest(ret[i].Key)
+		if err == nil {
+			ret[i].Size = m.Size
+		}
+		ret[i].manifest = false
+	}
+	return ret, nil
+}
+
+// Touch updates the ttl of the key without rewriting the value, the parts of multipart items are also updated
+func (c *Cache) Touch(key string, ttl uint32) error {
+	if isInternalKey(key) {
+		return ErrNotFound
+	}
+	s := c.getshard(key)
+	m, err := c.getManifest(key)
+	if err != nil && err != errNotManifest {
+		return err
+	}
+	if m != nil {
+		// the parts live no shorter than the manifest
+		for _, p := range m.Parts {
+			c.getshard(p.Key).Touch(p.Key, ttl)
+		}
+	}
+	return s.Touch(key, ttl)
+}
+
+// Invalidate marks the item of key as stale and bumps its cas unique instead of removing it
+func (c *Cache) Invalidate(key string) error {
+	if isInternalKey(key) {
+		return ErrNotFound
+	}
+	s := c.getshard(key)
+	return s.Invalidate(key)
+}
+
+// ClaimToken returns true to the first caller who claims the token to recache the stale item of key
+func (c *Cache) ClaimToken(key string, cas uint64) (bool, error) {
+	if isInternalKey(key) {
+		return false, ErrNotFound
+	}
+	s := c.getshard(key)
+	return s.ClaimToken(key, cas)
+}
+
+// Del removes the key, returns ErrNotFound if the key not exists. the parts of multipart items are also removed.
 func (c *Cache) Del(key string) error {
+	if isInternalKey(key) {
+		return ErrNotFound
+	}
 	s := c.getshard(key)
-	return s.Del(key)
+	m, _ := c.getManifest(key)
+	if err := s.Del(key); err != nil {
+		return err
+	}
+	if m != nil {
+		for _, p := range m.Parts {
+			c.getshard(p.Key).Del(p.Key)
+		}
+	}
+	return nil
+}
+
+// DelIfCas removes the key only if its cas unique equals to cas, or returns ErrCasConflict
+func (c *Cache) DelIfCas(key string, cas uint64) error {
+	if isInternalKey(key) {
+		return ErrNotFound
+	}
+	m, _ := c.getManifest(key)
+	if err := c.getshard(key).delIfCas(key, cas); err != nil {
+		return err
+	}
+	if m != nil {
+		for _, p := range m.Parts {
+			c.getshard(p.Key).Del(p.Key)
+		}
+	}
+	return nil
+}
+
+// Flush invalidates all items of the cache
+func (c *Cache) Flush() error {
+	for _, s := range c.shards {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (c *Cache) GetMetrics() CacheMetrics {
@@ -217,6 +594,21 @@ func (c *Cache) GetStatsByShards() []CacheStats {
 	return ret
 }
 
+func (c *Cache) GetStatusByShards() []ShardStatus {
+	var ret = make([]ShardStatus, len(c.shards), len(c.shards))
+	for i, s := range c.shards {
+		ret[i] = s.GetStatus()
+	}
+	return ret
+}
+
+// ResetMetrics resets the metrics of all shards to zero
+func (c *Cache) ResetMetrics() {
+	for _, s := range c.shards {
+		s.ResetMetrics()
+	}
+}
+
 func (c *Cache) GetOptions() CacheOptions {
 	return c.options
 }
@@ -2,10 +2,13 @@ package cache
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -38,6 +41,9 @@ func TestCache(t *testing.T) {
 		if err := c.Del(key); err != nil {
 			t.Fatal(err)
 		}
+		if err := c.Del(key); err != ErrNotFound {
+			t.Fatal("del should not found")
+		}
 		if _, err := c.Get(key); err != ErrNotFound {
 			t.Fatal("should not found")
 		}
@@ -45,9 +51,39 @@ func TestCache(t *testing.T) {
 	m := c.GetMetrics()
 
 	k := int64(n)
-	if m.GetTotal != 2*k || m.DelTotal != k || m.SetTotal != k || m.GetMisses != k || m.GetHits != k {
+	if m.GetTotal != 2*k || m.DelTotal != 2*k || m.SetTotal != k || m.GetMisses != k || m.GetHits != k {
 		t.Fatal("metrics err", m)
 	}
+
+	item := &Item{Key: "k1", Value: b}
+	if err := c.Set(item); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		item *Item
+		mode StoreMode
+		err  error
+	}{
+		{&Item{Key: "k1"}, StoreAdd, ErrNotStored},
+		{&Item{Key: "k2"}, StoreAdd, nil},
+		{&Item{Key: "k2"}, StoreReplace, ErrNotStored},
+		{&Item{Key: "k1", Cas: item.Cas + 1}, StoreCAS, ErrCasConflict},
+		{&Item{Key: "k1", Cas: item.Cas}, StoreCAS, nil},
+		{&Item{Key: "\x00k1"}, StoreSet, ErrInvalidKey},
+	} {
+		if err := c.CanStore(tc.item, tc.mode); err != tc.err {
+			t.Fatal("can store err", tc.item.Key, tc.mode, err)
+		}
+	}
+	if err := c.DelIfCas("k1", item.Cas+1); err != ErrCasConflict {
+		t.Fatal("del with another cas should conflict", err)
+	}
+	if err := c.DelIfCas("k1", item.Cas); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DelIfCas("k1", item.Cas); err != ErrNotFound {
+		t.Fatal("del should not found", err)
+	}
 	if err := c.Close(); err != nil {
 		t.Fatal(err)
 	}
@@ -80,3 +116,113 @@ func benchmarkCacheSet(b *testing.B, n int) {
 func BenchmarkCacheSet4K(b *testing.B) {
 	benchmarkCacheSet(b, 4096)
 }
+
+func TestCacheScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := NewCache(dir, &CacheOptions{ShardNum: 4, Size: 4 * MinShardSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("a/%02d", i)
+		if err := c.Set(&Item{Key: key, Value: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Set(&Item{Key: "a", Value: []byte("a")})
+	c.Set(&Item{Key: "b/00", Value: []byte("b")})
+	c.Del("a/50")
+
+	var keys []string
+	start := ""
+	for {
+		infos, err := c.Scan("a/", start, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			keys = append(keys, info.Key)
+			start = info.Key + "\x00"
+		}
+		if len(infos) < 10 {
+			break
+		}
+	}
+	if len(keys) != 99 || keys[0] != "a/00" || keys[50] != "a/51" || keys[98] != "a/99" {
+		t.Fatal("scan keys err", keys)
+	}
+
+	infos, err := c.Scan("", "a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Key != "a" || infos[1].Key != "a/00" || infos[1].Size != 4 {
+		t.Fatal("scan err", infos)
+	}
+}
+
+func TestCacheLongKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := NewCache(dir, &CacheOptions{ShardNum: 4, Size: 4 * MinShardSize, HashKeyLen: 250})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	prefix := "http://example.com/" + strings.Repeat("p", 250) + "/"
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("%s%02d", prefix, i)
+		if err := c.Set(&Item{Key: key, Value: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Set(&Item{Key: "http://example.com/a", Value: []byte("a")})
+	key := prefix + "05"
+	item, err := c.Get(key)
+	if err != nil || item.Key != key || string(item.Value) != key {
+		t.Fatal("get err", err)
+	}
+	item.Free()
+
+	// the digest of a long key can not be used as a key
+	sum := sha256.Sum256([]byte(key))
+	digest := hashedKeyPrefix + string(sum[:])
+	if err := c.Set(&Item{Key: digest, Value: []byte("x")}); err != ErrInvalidKey {
+		t.Fatal("set digest should fail", err)
+	}
+	if err := c.Del(digest); err != ErrNotFound {
+		t.Fatal("del digest should not found", err)
+	}
+	if item, err := c.Get(key); err != nil || string(item.Value) != key {
+		t.Fatal("long key overwritten", err)
+	}
+
+	if err := c.Del(prefix + "10"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(prefix + "10"); err != ErrNotFound {
+		t.Fatal("should be deleted", err)
+	}
+
+	infos, err := c.Scan("http://example.com/", prefix+"08", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 4 || infos[0].Key != prefix+"08" || infos[2].Key != prefix+"11" || infos[0].Size != int64(len(prefix)+2) {
+		t.Fatal("scan err", infos)
+	}
+	infos, _ = c.Scan("http://example.com/", "", 100)
+	if len(infos) != 20 || infos[0].Key != "http://example.com/a" || infos[19].Key != prefix+"19" {
+		t.Fatal("scan err", len(infos))
+	}
+}
@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strconv"
+)
+
+// chunkedWriter writes a value larger than MaxValueSize in chunks of ChunkSize,
+// each chunk is an item placed by its key, and the item is stored as a manifest of chunks by Commit.
+type chunkedWriter struct {
+	c    *Cache
+	ci   *Item
+	id   string // chunks of the value are keyed by the id, so writers of the same key never share chunks
+	size int64
+	n    int64 // bytes written
+
+	cur *ItemWriter // writer of the current chunk
+	m   Manifest
+}
+
+func (c *Cache) newChunkedWriter(ci *Item, n int64) (*chunkedWriter, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	w := &chunkedWriter{c: c, ci: ci, id: hex.EncodeToString(b[:]), size: n}
+	w.m.Parts = make([]ManifestPart, 0, (n+ChunkSize-1)/ChunkSize)
+	return w, nil
+}
+
+// chunk returns the writer of the current chunk, the next chunk is reserved if needed
+func (w *chunkedWriter) chunk() (*ItemWriter, error) {
+	if w.cur != nil {
+		return w.cur, nil
+	}
+	size := w.size - w.n
+	if size > ChunkSize {
+		size = ChunkSize
+	}
+	key := internalKeyPrefix + "chunk/" + w.id + "/" + strconv.Itoa(len(w.m.Parts))
+	// the chunks not committed expire like parts of uploads, their ttl is updated by Commit
+	cw, err := w.c.getshard(key).NewWriter(&Item{Key: key, TTL: UploadTTL}, size)
+	if err != nil {
+		return nil, err
+	}
+	w.cur = cw
+	return cw, nil
+}
+
+// commitChunk stores the current chunk if it's full
+func (w *chunkedWriter) commitChunk() error {
+	cw := w.cur
+	if cw.n != int64(cw.ii.ValueSize) {
+		return nil
+	}
+	if err := cw.Commit(StoreSet); err != nil {
+		return err
+	}
+	w.m.Parts = append(w.m.Parts, ManifestPart{Key: cw.ci.Key, Size: cw.n, Cas: cw.ci.Cas})
+	w.m.Size += cw.n
+	w.cur = nil
+	return nil
+}
+
+func (w *chunkedWriter) Write(p []byte) (int, error) {
+	if w.n+int64(len(p)) > w.size {
+		return 0, ErrValueSize
+	}
+	var written int
+	for len(p) > 0 {
+		cw, err := w.chunk()
+		if err != nil {
+			return written, err
+		}
+		b := p
+		if left := int64(cw.ii.ValueSize) - cw.n; int64(len(b)) > left {
+			b = b[:left]
+		}
+		n, err := cw.Write(b)
+		written += n
+		w.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if err := w.commitChunk(); err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// ReadFrom copies the rest of value from r chunk by chunk
+func (w *chunkedWriter) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for w.n < w.size {
+		cw, err := w.chunk()
+		if err != nil {
+			return total, err
+		}
+		n, err := cw.ReadFrom(r)
+		total += n
+		w.n += n
+		if err != nil {
+			return total, err
+		}
+		if cw.n != int64(cw.ii.ValueSize) { // EOF
+			return total, nil
+		}
+		if err := w.commitChunk(); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Commit stores the manifest of chunks as the item with mode, the chunks are removed if not stored
+func (w *chunkedWriter) Commit(mode StoreMode) error {
+	if w.n != w.size {
+		return ErrShortValue
+	}
+	err := w.c.storeManifest(w.ci, &w.m, mode)
+	if err != nil {
+		for _, p := range w.m.Parts {
+			w.c.getshard(p.Key).Del(p.Key)
+		}
+	}
+	return err
+}
+
+// storeChunked stores the item larger than MaxValueSize by chunkedWriter
+func (c *Cache) storeChunked(item *Item, mode StoreMode) error {
+	if int64(len(item.Value)) > MaxChunkedValueSize {
+		return ErrValueSize
+	}
+	// avoid writing chunks if not stored, it's checked again by Commit
+	if err := c.getshard(item.Key).canStore(item, mode); err != nil {
+		return err
+	}
+	w, err := c.newChunkedWriter(item, int64(len(item.Value)))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(item.Value); err != nil {
+		return err
+	}
+	return w.Commit(mode)
+}
@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// patternReader reads the bytes of i%251 at offset i
+type patternReader struct {
+	off int64
+}
+
+func (r *patternReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte((r.off + int64(i)) % 251)
+	}
+	r.off += int64(len(b))
+	return len(b), nil
+}
+
+func TestCacheChunkedValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := NewCache(dir, &CacheOptions{ShardNum: 4, Size: 4 * MinShardSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	size := MaxValueSize + 100
+	if _, err := c.NewWriter(&Item{Key: "k1"}, MaxChunkedValueSize+1); err != ErrValueSize {
+		t.Fatal("should exceed", err)
+	}
+	item := &Item{Key: "k1", Flags: 3, TTL: 100}
+	w, err := c.NewWriter(item, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := w.ReadFrom(io.LimitReader(&patternReader{}, size)); err != nil || n != size {
+		t.Fatal("read from err", n, err)
+	}
+	if err := w.Commit(StoreAdd); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := c.scan(internalKeyPrefix+"chunk/", "", 10); len(infos) != 3 || infos[0].TTL != 100 {
+		t.Fatal("value should be stored in 3 chunks with the ttl of item", infos)
+	}
+	if infos, _ := c.Scan("", "", 10); len(infos) != 1 || infos[0].Size != size {
+		t.Fatal("scan err", infos)
+	}
+
+	if _, err := c.Get("k1"); err != ErrValueSize {
+		t.Fatal("get should exceed", err)
+	}
+	ci, rd, err := c.GetReader("k1", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Flags != 3 || ci.Cas != item.Cas || rd.Size() != size {
+		t.Fatal("get reader err", ci.Flags, ci.Cas, rd.Size())
+	}
+	h1, h2 := crc32.NewIEEE(), crc32.NewIEEE()
+	io.Copy(h1, io.LimitReader(&patternReader{}, size))
+	if n, err := io.Copy(h2, rd); err != nil || n != size || h1.Sum32() != h2.Sum32() {
+		t.Fatal("read err", n, err)
+	}
+	rd.Close()
+	off := 2*ChunkSize - 10
+	ci, _, err = c.GetRange("k1", off, 20)
+	expect := make([]byte, 20)
+	(&patternReader{off: off}).Read(expect)
+	if err != nil || !bytes.Equal(ci.Value, expect) {
+		t.Fatal("get range across chunks err", err)
+	}
+
+	// values larger than MaxValueSize are also chunked by Set
+	if err := c.Add(&Item{Key: "k1", Value: make([]byte, size)}); err != ErrNotStored {
+		t.Fatal("add should not stored", err)
+	}
+	if infos, _ := c.scan(internalKeyPrefix+"chunk/", "", 10); len(infos) != 3 {
+		t.Fatal("chunks should not be written", infos)
+	}
+
+	// a chunk evicted is a miss, and the item is dropped with other chunks
+	infos, _ := c.scan(internalKeyPrefix+"chunk/", "", 10)
+	c.getshard(infos[1].Key).Del(infos[1].Key)
+	if _, _, err := c.GetRange("k1", 0, 1); err != nil {
+		t.Fatal("the first chunk is not evicted", err)
+	}
+	if _, _, err := c.GetReader("k1", 0, true); err != ErrNotFound {
+		t.Fatal("should not found", err)
+	}
+	if _, err := c.Get("k1"); err != ErrNotFound {
+		t.Fatal("should not found", err)
+	}
+	if infos, _ := c.scan(internalKeyPrefix, "", 10); len(infos) != 0 {
+		t.Fatal("chunks should be removed", infos)
+	}
+}
@@ -1,6 +1,8 @@
 package cache
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"sync"
 	"time"
 
@@ -11,6 +13,10 @@ import (
 type CacheIndex struct {
 	db *bolt.DB
 
+	// keys longer than hashKeyLen are stored under their digests if > 0,
+	// and the full keys are stored in IndexItem.Key for detecting collisions.
+	hashKeyLen int
+
 	mu   sync.RWMutex
 	meta IndexMeta
 }
@@ -18,9 +24,37 @@ type CacheIndex struct {
 var (
 	indexMetaBucket = []byte("meta")
 	indexDataBucket = []byte("data")
-	indexMetaKey    = []byte("indexmeta")
+	// the full keys of hashed long keys to the digests, for scanning long keys in order
+	indexLongKeyBucket = []byte("longkeys")
+	indexMetaKey       = []byte("indexmeta")
 )
 
+// hashedKeyPrefix is the prefix of index keys which are the digests of long keys
+const hashedKeyPrefix = "\x01"
+
+// indexKey returns the key in db for key, long keys are hashed if enabled
+func (i *CacheIndex) indexKey(key string) (k []byte, hashed bool) {
+	if i.hashKeyLen <= 0 || len(key) <= i.hashKeyLen {
+		return []byte(key), false
+	}
+	sum := sha256.Sum256([]byte(key))
+	return append([]byte(hashedKeyPrefix), sum[:]...), true
+}
+
+// isHashedKey returns true if the index key k may be the digest of a long key
+func isHashedKey(k []byte) bool {
+	return len(k) == len(hashedKeyPrefix)+sha256.Size && string(k[:len(hashedKeyPrefix)]) == hashedKeyPrefix
+}
+
+// owns returns true if item stored under the index key of key is the item of key.
+// items of long keys have the full keys, the others have not.
+func owns(item *IndexItem, key string, hashed bool) bool {
+	if hashed {
+		return item.Key == key
+	}
+	return item.Key == ""
+}
+
 func LoadCacheIndex(fn string, datasize int64) (*CacheIndex, error) {
 	var err error
 	var index CacheIndex
@@ -62,12 +96,13 @@ func (i *CacheIndex) Close() error {
 
 func (i *CacheIndex) Get(key string) (*IndexItem, error) {
 	var item IndexItem
+	k, hashed := i.indexKey(key)
 	err := i.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(indexDataBucket)
 		if bucket == nil {
 			return ErrNotFound
 		}
-		v := bucket.Get([]byte(key))
+		v := bucket.Get(k)
 		if v == nil {
 			return ErrNotFound
 		}
@@ -77,15 +112,80 @@ func (i *CacheIndex) Get(key string) (*IndexItem, error) {
 		return nil, err
 	}
 	meta := i.GetIndexMeta()
-	if meta.IsValidate(item) {
+	if meta.IsValidate(item) && owns(&item, key, hashed) {
 		return &item, nil
 	}
 	return nil, ErrNotFound
 }
 
+// GetMulti is like Get for multiple keys in one transaction, errs[j] is nil if items[j] is found
+func (i *CacheIndex) GetMulti(keys []string) ([]*IndexItem, []error) {
+	items := make([]*IndexItem, len(keys))
+	errs := make([]error, len(keys))
+	meta := i.GetIndexMeta()
+	err := i.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(indexDataBucket)
+		for j, key := range keys {
+			k, hashed := i.indexKey(key)
+			var v []byte
+			if bucket != nil {
+				v = bucket.Get(k)
+			}
+			if v == nil {
+				errs[j] = ErrNotFound
+				continue
+			}
+			item := &IndexItem{}
+			if err := item.Unmarshal(v); err != nil {
+				errs[j] = err
+				continue
+			}
+			if !meta.IsValidate(*item) || !owns(item, key, hashed) {
+				errs[j] = ErrNotFound
+				continue
+			}
+			items[j] = item
+		}
+		return nil
+	})
+	if err != nil {
+		for j := range errs {
+			items[j], errs[j] = nil, err
+		}
+	}
+	return items, errs
+}
+
 func (i *CacheIndex) Reserve(size int32) (*IndexItem, error) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
+	idx, err := i.reserve(size)
+	if err != nil {
+		return nil, err
+	}
+	if err := i.saveMeta(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// ReserveLazy is like Reserve but the meta is not saved,
+// SaveMeta must be called before writing the data of reserved items
+func (i *CacheIndex) ReserveLazy(size int32) (*IndexItem, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.reserve(size)
+}
+
+// SaveMeta saves the meta changed by ReserveLazy
+func (i *CacheIndex) SaveMeta() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.saveMeta()
+}
+
+// reserve moves the head of meta for size bytes without saving, i.mu must be locked
+func (i *CacheIndex) reserve(size int32) (*IndexItem, error) {
 	meta := &i.meta
 	if int64(size) > meta.DataSize {
 		return nil, errors.New("not enough space")
@@ -94,10 +194,44 @@ func (i *CacheIndex) Reserve(size int32) (*IndexItem, error) {
 		meta.Head = 0
 		meta.Term += 1
 	}
-	idx := &IndexItem{Term: meta.Term, Offset: meta.Head, ValueSize: size, Timestamp: time.Now().Unix()}
+	meta.Cas += 1
+	idx := &IndexItem{Term: meta.Term, Offset: meta.Head, ValueSize: size, Timestamp: time.Now().Unix(), Cas: meta.Cas}
 	meta.Head += int64(size)
+	return idx, nil
+}
+
+// SkipTo moves the head to off without saving, the next term begins if wrap.
+// the items in the skipped space become invalid like overwritten.
+func (i *CacheIndex) SkipTo(off int64, wrap bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if wrap {
+		i.meta.Term += 1
+	}
+	i.meta.Head = off
+}
+
+// NextCas returns a new cas unique
+func (i *CacheIndex) NextCas() (uint64, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.meta.Cas += 1
+	return i.meta.Cas, i.saveMeta()
+}
+
+// Flush invalidates all items at once by moving to the term after next with head 0,
+// items of the last term are still validate if only the term increased, see IsValidate
+func (i *CacheIndex) Flush() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.meta.Term += 2
+	i.meta.Head = 0
+	return i.saveMeta()
+}
 
-	err := i.db.Update(func(tx *bolt.Tx) error {
+// saveMeta writes meta to db, i.mu must be locked
+func (i *CacheIndex) saveMeta() error {
+	return i.db.Update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists(indexMetaBucket)
 		if err != nil {
 			return err
@@ -108,10 +242,6 @@ func (i *CacheIndex) Reserve(size int32) (*IndexItem, error) {
 		}
 		return bucket.Put(indexMetaKey, b)
 	})
-	if err != nil {
-		return nil, err
-	}
-	return idx, nil
 }
 
 func (i *CacheIndex) Set(key string, item *IndexItem) error {
@@ -120,8 +250,66 @@ func (i *CacheIndex) Set(key string, item *IndexItem) error {
 		if err != nil {
 			return err
 		}
-		b, _ := item.Marshal()
-		return bucket.Put([]byte(key), b)
+		return i.put(bucket, key, item)
+	})
+}
+
+// put stores item of key to bucket, the full key is set to item if it's hashed
+func (i *CacheIndex) put(bucket *bolt.Bucket, key string, item *IndexItem) error {
+	k, hashed := i.indexKey(key)
+	if err := unlinkLongKey(bucket, k); err != nil { // the item replaced may be of another key
+		return err
+	}
+	item.Key = ""
+	if hashed {
+		item.Key = key
+		lb, err := bucket.Tx().CreateBucketIfNotExists(indexLongKeyBucket)
+		if err != nil {
+			return err
+		}
+		if err := lb.Put([]byte(key), k); err != nil {
+			return err
+		}
+	}
+	b, _ := item.Marshal()
+	return bucket.Put(k, b)
+}
+
+// unlinkLongKey removes the entry of the long key stored under the index key k from the bucket of long keys
+func unlinkLongKey(bucket *bolt.Bucket, k []byte) error {
+	if !isHashedKey(k) {
+		return nil
+	}
+	lb := bucket.Tx().Bucket(indexLongKeyBucket)
+	if lb == nil {
+		return nil
+	}
+	var item IndexItem
+	if v := bucket.Get(k); v == nil || item.Unmarshal(v) != nil || item.Key == "" {
+		return nil
+	}
+	if !bytes.Equal(lb.Get([]byte(item.Key)), k) {
+		return nil
+	}
+	return lb.Delete([]byte(item.Key))
+}
+
+// SetMulti sets items[j] of keys[j] in one transaction
+func (i *CacheIndex) SetMulti(keys []string, items []*IndexItem) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return i.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(indexDataBucket)
+		if err != nil {
+			return err
+		}
+		for j, key := range keys {
+			if err := i.put(bucket, key, items[j]); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 }
 
@@ -131,7 +319,7 @@ func (i *CacheIndex) Del(key string) error {
 		if err != nil {
 			return err
 		}
-		return bucket.Delete([]byte(key))
+		return i.del(bucket, key)
 	})
 }
 
@@ -145,6 +333,43 @@ func (i *CacheIndex) Dels(keys []string) error {
 			return err
 		}
 		for _, key := range keys {
+			if err := i.del(bucket, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// del removes key from bucket, the item under the index key is kept if it's owned by another key
+func (i *CacheIndex) del(bucket *bolt.Bucket, key string) error {
+	k, hashed := i.indexKey(key)
+	if hashed || isHashedKey(k) {
+		var item IndexItem
+		if v := bucket.Get(k); v != nil && item.Unmarshal(v) == nil && !owns(&item, key, hashed) {
+			return nil
+		}
+		if err := unlinkLongKey(bucket, k); err != nil {
+			return err
+		}
+	}
+	return bucket.Delete(k)
+}
+
+// delIndexKeys removes the keys in db returned by Iter
+func (i *CacheIndex) delIndexKeys(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return i.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(indexDataBucket)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := unlinkLongKey(bucket, []byte(key)); err != nil {
+				return err
+			}
 			if err := bucket.Delete([]byte(key)); err != nil {
 				return err
 			}
@@ -159,6 +384,8 @@ func (i *CacheIndex) GetIndexMeta() IndexMeta {
 	return i.meta
 }
 
+// Iter calls f for at most maxIter items after lastkey in order of the keys in db,
+// which are the digests for long keys, see IndexItem.Key for the full keys.
 func (i *CacheIndex) Iter(lastkey string, maxIter int, f func(key string, item IndexItem) error) error {
 	var item IndexItem
 	err := i.db.View(func(tx *bolt.Tx) error {
@@ -193,6 +420,75 @@ func (i *CacheIndex) Iter(lastkey string, maxIter int, f func(key string, item I
 	return err
 }
 
+// Scan calls f for each validate item with key >= start in order until f returns false.
+// the items of long keys are merged in order of their full keys by the bucket of long keys.
+func (i *CacheIndex) Scan(start string, f func(key string, item IndexItem) bool) error {
+	meta := i.GetIndexMeta()
+	return i.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(indexDataBucket)
+		if bucket == nil {
+			return nil
+		}
+		var item, long IndexItem
+		var lc *bolt.Cursor
+		var lk, lv []byte
+		if lb := tx.Bucket(indexLongKeyBucket); lb != nil {
+			lc = lb.Cursor()
+			lk, lv = lc.Seek([]byte(start))
+		}
+		// nextLong moves to the next validate item of long keys, the entries of replaced items are skipped
+		nextLong := func() (bool, error) {
+			for ; lk != nil; lk, lv = lc.Next() {
+				v := bucket.Get(lv)
+				if v == nil {
+					continue
+				}
+				if err := long.Unmarshal(v); err != nil {
+					return false, err
+				}
+				if long.Key == string(lk) && meta.IsValidate(long) {
+					lk, lv = lc.Next()
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		hasLong, err := nextLong()
+		if err != nil {
+			return err
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil; k, v = c.Next() {
+			if err := item.Unmarshal(v); err != nil {
+				return err
+			}
+			if item.Key != "" || !meta.IsValidate(item) { // long keys are merged from lc
+				continue
+			}
+			for hasLong && long.Key < string(k) {
+				if !f(long.Key, long) {
+					return nil
+				}
+				if hasLong, err = nextLong(); err != nil {
+					return err
+				}
+			}
+			if !f(string(k), item) {
+				return nil
+			}
+		}
+		for hasLong {
+			if !f(long.Key, long) {
+				return nil
+			}
+			if hasLong, err = nextLong(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (i *CacheIndex) GetKeys() (n uint64, err error) {
 	err = i.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(indexDataBucket)
@@ -34,9 +34,10 @@ var _ = math.Inf
 const _ = proto.GoGoProtoPackageIsVersion2 // please upgrade the proto package
 
 type IndexMeta struct {
-	Term     int64 `protobuf:"varint,1,req,name=Term" json:"Term"`
-	Head     int64 `protobuf:"varint,2,req,name=Head" json:"Head"`
-	DataSize int64 `protobuf:"varint,3,req,name=DataSize" json:"DataSize"`
+	Term     int64  `protobuf:"varint,1,req,name=Term" json:"Term"`
+	Head     int64  `protobuf:"varint,2,req,name=Head" json:"Head"`
+	DataSize int64  `protobuf:"varint,3,req,name=DataSize" json:"DataSize"`
+	Cas      uint64 `protobuf:"varint,4,opt,name=Cas" json:"Cas"`
 }
 
 func (m *IndexMeta) Reset()                    { *m = IndexMeta{} }
@@ -52,6 +53,12 @@ type IndexItem struct {
 	TTL       uint32 `protobuf:"varint,5,req,name=TTL" json:"TTL"`
 	Flags     uint32 `protobuf:"varint,6,req,name=Flags" json:"Flags"`
 	Crc32     uint32 `protobuf:"varint,7,opt,name=Crc32" json:"Crc32"`
+	Cas       uint64 `protobuf:"varint,8,opt,name=Cas" json:"Cas"`
+	Stale     bool   `protobuf:"varint,9,opt,name=Stale" json:"Stale"`
+	TokenSent bool   `protobuf:"varint,10,opt,name=TokenSent" json:"TokenSent"`
+	Manifest  bool   `protobuf:"varint,11,opt,name=Manifest" json:"Manifest"`
+	Key       string `protobuf:"bytes,12,opt,name=Key" json:"Key"`
+	MD5       []byte `protobuf:"bytes,13,opt,name=MD5" json:"MD5"`
 }
 
 func (m *IndexItem) Reset()                    { *m = IndexItem{} }
@@ -87,6 +94,9 @@ func (m *IndexMeta) MarshalTo(data []byte) (int, error) {
 	data[i] = 0x18
 	i++
 	i = encodeVarintIndex(data, i, uint64(m.DataSize))
+	data[i] = 0x20
+	i++
+	i = encodeVarintIndex(data, i, uint64(m.Cas))
 	return i, nil
 }
 
@@ -126,6 +136,43 @@ func (m *IndexItem) MarshalTo(data []byte) (int, error) {
 	data[i] = 0x38
 	i++
 	i = encodeVarintIndex(data, i, uint64(m.Crc32))
+	data[i] = 0x40
+	i++
+	i = encodeVarintIndex(data, i, uint64(m.Cas))
+	data[i] = 0x48
+	i++
+	if m.Stale {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x50
+	i++
+	if m.TokenSent {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x58
+	i++
+	if m.Manifest {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x62
+	i++
+	i = encodeVarintIndex(data, i, uint64(len(m.Key)))
+	i += copy(data[i:], m.Key)
+	if m.MD5 != nil {
+		data[i] = 0x6a
+		i++
+		i = encodeVarintIndex(data, i, uint64(len(m.MD5)))
+		i += copy(data[i:], m.MD5)
+	}
 	return i, nil
 }
 
@@ -162,6 +209,7 @@ func (m *IndexMeta) Size() (n int) {
 	n += 1 + sovIndex(uint64(m.Term))
 	n += 1 + sovIndex(uint64(m.Head))
 	n += 1 + sovIndex(uint64(m.DataSize))
+	n += 1 + sovIndex(uint64(m.Cas))
 	return n
 }
 
@@ -175,6 +223,16 @@ func (m *IndexItem) Size() (n int) {
 	n += 1 + sovIndex(uint64(m.TTL))
 	n += 1 + sovIndex(uint64(m.Flags))
 	n += 1 + sovIndex(uint64(m.Crc32))
+	n += 1 + sovIndex(uint64(m.Cas))
+	n += 2
+	n += 2
+	n += 2
+	l = len(m.Key)
+	n += 1 + l + sovIndex(uint64(l))
+	if m.MD5 != nil {
+		l = len(m.MD5)
+		n += 1 + l + sovIndex(uint64(l))
+	}
 	return n
 }
 
@@ -281,6 +339,25 @@ func (m *IndexMeta) Unmarshal(data []byte) error {
 				}
 			}
 			hasFields[0] |= uint64(0x00000004)
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cas", wireType)
+			}
+			m.Cas = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIndex
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.Cas |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipIndex(data[iNdEx:])
@@ -480,6 +557,145 @@ func (m *IndexItem) Unmarshal(data []byte) error {
 					break
 				}
 			}
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cas", wireType)
+			}
+			m.Cas = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIndex
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.Cas |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Stale", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIndex
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Stale = bool(v != 0)
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TokenSent", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIndex
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.TokenSent = bool(v != 0)
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Manifest", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIndex
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Manifest = bool(v != 0)
+		case 12:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Key", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIndex
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthIndex
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Key = string(data[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 13:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MD5", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIndex
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthIndex
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.MD5 = append(m.MD5[:0], data[iNdEx:postIndex]...)
+			if m.MD5 == nil {
+				m.MD5 = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipIndex(data[iNdEx:])
@@ -627,20 +843,24 @@ var (
 func init() { proto.RegisterFile("index.proto", fileDescriptorIndex) }
 
 var fileDescriptorIndex = []byte{
-	// 239 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0xe2, 0xce, 0xcc, 0x4b, 0x49,
-	0xad, 0xd0, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x4d, 0x4e, 0x4c, 0xce, 0x48, 0x95, 0xd2,
-	0x4d, 0xcf, 0x2c, 0xc9, 0x28, 0x4d, 0xd2, 0x4b, 0xce, 0xcf, 0xd5, 0x4f, 0xcf, 0x4f, 0xcf, 0xd7,
-	0x07, 0xcb, 0x26, 0x95, 0xa6, 0x81, 0x79, 0x60, 0x0e, 0x98, 0x05, 0xd1, 0xa5, 0xe4, 0xcd, 0xc5,
-	0xe9, 0x09, 0x32, 0xc4, 0x37, 0xb5, 0x24, 0x51, 0x48, 0x88, 0x8b, 0x25, 0x24, 0xb5, 0x28, 0x57,
-	0x82, 0x51, 0x81, 0x49, 0x83, 0xd9, 0x89, 0xe5, 0xc4, 0x3d, 0x79, 0x06, 0x90, 0x98, 0x47, 0x6a,
-	0x62, 0x8a, 0x04, 0x13, 0x92, 0x98, 0x18, 0x17, 0x87, 0x4b, 0x62, 0x49, 0x62, 0x70, 0x66, 0x55,
-	0xaa, 0x04, 0x33, 0x42, 0x5c, 0x69, 0x09, 0x23, 0xd4, 0x34, 0xcf, 0x92, 0xd4, 0x5c, 0xac, 0xa6,
-	0x89, 0x70, 0xb1, 0xf9, 0xa7, 0xa5, 0x15, 0xa7, 0x96, 0xa0, 0x98, 0x27, 0xce, 0xc5, 0x19, 0x96,
-	0x98, 0x53, 0x9a, 0x0a, 0x37, 0x90, 0x15, 0x21, 0x11, 0x92, 0x99, 0x9b, 0x5a, 0x5c, 0x92, 0x98,
-	0x5b, 0x20, 0xc1, 0x82, 0xa4, 0x43, 0x90, 0x8b, 0x39, 0x24, 0xc4, 0x47, 0x82, 0x55, 0x81, 0x49,
-	0x83, 0x17, 0x2a, 0x24, 0xcc, 0xc5, 0xea, 0x96, 0x93, 0x98, 0x5e, 0x2c, 0xc1, 0x86, 0x2a, 0xe8,
-	0x5c, 0x94, 0x6c, 0x6c, 0x24, 0xc1, 0xae, 0xc0, 0x08, 0x13, 0x74, 0x12, 0x39, 0xf1, 0x50, 0x8e,
-	0xe1, 0xc4, 0x23, 0x39, 0xc6, 0x0b, 0x8f, 0xe4, 0x18, 0x1f, 0x3c, 0x92, 0x63, 0x9c, 0xf0, 0x58,
-	0x8e, 0x01, 0x10, 0x00, 0x00, 0xff, 0xff, 0x95, 0x71, 0x56, 0xf5, 0x4d, 0x01, 0x00, 0x00,
+	// 302 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x6c, 0x8e, 0xcd, 0x4e, 0xf2, 0x40,
+	0x18, 0x85, 0x99, 0xfe, 0xf0, 0xb5, 0xc3, 0xc7, 0x02, 0x24, 0xf8, 0xc6, 0x45, 0x9d, 0xb0, 0x9a,
+	0x8d, 0x90, 0xe8, 0x1d, 0x80, 0x31, 0x12, 0x25, 0x2e, 0x68, 0x5c, 0x9a, 0x0c, 0xe5, 0x6d, 0x69,
+	0xa4, 0x1d, 0x42, 0x87, 0x44, 0xbd, 0x0a, 0x2e, 0xab, 0x4b, 0xaf, 0xc0, 0x68, 0xbd, 0x11, 0xd3,
+	0x96, 0x48, 0x9b, 0xb8, 0x9b, 0xf3, 0x9c, 0x99, 0x79, 0x0e, 0x6d, 0x85, 0xf1, 0x12, 0x5f, 0x86,
+	0x9b, 0xad, 0x54, 0xb2, 0x6b, 0x7a, 0xc2, 0x5b, 0xe1, 0xd9, 0x45, 0x10, 0xaa, 0xd5, 0x6e, 0x31,
+	0xf4, 0x64, 0x34, 0x0a, 0x64, 0x20, 0x47, 0x45, 0xbb, 0xd8, 0xf9, 0x45, 0x2a, 0x42, 0x71, 0x2a,
+	0x5f, 0x0d, 0x9e, 0xa8, 0x3d, 0xcd, 0x3f, 0x99, 0xa1, 0x12, 0xdd, 0x2e, 0x35, 0x5c, 0xdc, 0x46,
+	0x40, 0x98, 0xc6, 0xf5, 0xb1, 0x91, 0x7e, 0x9c, 0x37, 0x72, 0x76, 0x8b, 0x62, 0x09, 0x5a, 0x85,
+	0xf5, 0xa9, 0x75, 0x2d, 0x94, 0x98, 0x87, 0x6f, 0x08, 0x7a, 0x85, 0x77, 0xa8, 0x3e, 0x11, 0x09,
+	0x18, 0x8c, 0x70, 0xa3, 0x44, 0x83, 0xbd, 0x76, 0x10, 0x4c, 0x15, 0x46, 0x7f, 0x0a, 0x7a, 0xb4,
+	0xf9, 0xe0, 0xfb, 0x09, 0xaa, 0x9a, 0xe2, 0x94, 0xda, 0x8f, 0x62, 0xbd, 0xc3, 0x5f, 0x87, 0x79,
+	0x2c, 0xdc, 0x30, 0xc2, 0x44, 0x89, 0x68, 0x03, 0x46, 0x5d, 0xee, 0xba, 0xf7, 0x60, 0x32, 0x8d,
+	0xb7, 0x0f, 0xe8, 0x84, 0x9a, 0x37, 0x6b, 0x11, 0x24, 0xd0, 0xac, 0xc3, 0xc9, 0xd6, 0xbb, 0xba,
+	0x84, 0x7f, 0x8c, 0xf0, 0x76, 0x7d, 0xb9, 0x75, 0x5c, 0x9e, 0xdf, 0x9b, 0x2b, 0xb1, 0x46, 0xb0,
+	0x19, 0xe1, 0x56, 0xc5, 0x2e, 0x9f, 0x31, 0x9e, 0x63, 0xac, 0x80, 0x56, 0x8a, 0x3e, 0xb5, 0x66,
+	0x22, 0x0e, 0x7d, 0x4c, 0x14, 0xb4, 0x2a, 0xbc, 0x43, 0xf5, 0x3b, 0x7c, 0x85, 0xff, 0x8c, 0x70,
+	0xbb, 0x44, 0xe3, 0x5e, 0xfa, 0xe5, 0x34, 0xd2, 0xcc, 0x21, 0xef, 0x99, 0x43, 0x3e, 0x33, 0x87,
+	0xec, 0xbf, 0x9d, 0xc6, 0xcf, 0x00, 0xe1, 0x2a, 0xa4, 0x16, 0xcc, 0x01, 0x00, 0x00,
 }
@@ -4,7 +4,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/boltdb/bolt"
 )
 
 func TestCacheIndexReserve(t *testing.T) {
@@ -70,7 +74,7 @@ func TestCacheIndexGetSet(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if *t1 != *item1 && *t2 != *item2 {
+	if !reflect.DeepEqual(t1, item1) && !reflect.DeepEqual(t2, item2) {
 		t.Fatal("get err", *t1, *t2)
 	}
 	c.Reserve(400) // overwrite item1
@@ -179,10 +183,10 @@ func TestCacheIndexIter(t *testing.T) {
 
 	err = c.Iter("", 100, func(key string, item IndexItem) error {
 		iterkeys += 1
-		if key == "k1" && item != *item1 {
+		if key == "k1" && !reflect.DeepEqual(item, *item1) {
 			t.Fatal(key, "item err", item)
 		}
-		if key == "k2" && item != *item2 {
+		if key == "k2" && !reflect.DeepEqual(item, *item2) {
 			t.Fatal(key, "item err", item)
 		}
 		return nil
@@ -197,3 +201,113 @@ func TestCacheIndexIter(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCacheIndexHashedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cacheindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := LoadCacheIndex(filepath.Join(dir, "index"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.hashKeyLen = 10
+
+	long1 := "http://example.com/a/" + strings.Repeat("x", 300)
+	long2 := "http://example.com/b/" + strings.Repeat("y", 300)
+	for _, key := range []string{"k2", long1, long2, "i", "http://z"} {
+		item, _ := c.Reserve(10)
+		if err := c.Set(key, item); err != nil {
+			t.Fatal(err)
+		}
+		if k, hashed := c.indexKey(key); hashed != (len(key) > 10) || (hashed && len(k) != 33) {
+			t.Fatal("index key err", key, hashed)
+		}
+	}
+	item, err := c.Get(long1)
+	if err != nil || item.Key != long1 {
+		t.Fatal("get long key err", err)
+	}
+	items, errs := c.GetMulti([]string{long2, "k2"})
+	if errs[0] != nil || items[0].Key != long2 || errs[1] != nil || items[1].Key != "" {
+		t.Fatal("get multi err", errs)
+	}
+
+	// long keys are scanned in order of the full keys
+	var keys []string
+	c.Scan("", func(key string, item IndexItem) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if strings.Join(keys, ",") != strings.Join([]string{long1, long2, "http://z", "i", "k2"}, ",") {
+		t.Fatal("scan err", keys)
+	}
+	keys = keys[:0]
+	c.Scan(long2, func(key string, item IndexItem) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	})
+	if strings.Join(keys, ",") != long2+",http://z" {
+		t.Fatal("scan err", keys)
+	}
+
+	// the entries of long keys are removed with the items, by Del or by GC
+	longKeys := func() (n int) {
+		c.db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket(indexLongKeyBucket).Stats().KeyN
+			return nil
+		})
+		return n
+	}
+	long3 := long1 + "3"
+	item, _ = c.Reserve(10)
+	c.Set(long3, item)
+	if n := longKeys(); n != 3 {
+		t.Fatal("long keys err", n)
+	}
+	c.Del(long2)
+	k3, _ := c.indexKey(long3)
+	c.delIndexKeys([]string{string(k3)})
+	if n := longKeys(); n != 1 {
+		t.Fatal("long keys should be removed", n)
+	}
+	keys = keys[:0]
+	c.Scan("", func(key string, item IndexItem) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if strings.Join(keys, ",") != strings.Join([]string{long1, "http://z", "i", "k2"}, ",") {
+		t.Fatal("scan err", keys)
+	}
+	item, _ = c.Get(long1)
+
+	// a collision of digests is detected by the full key
+	k, _ := c.indexKey(long1)
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		item.Key = long2
+		b, _ := item.Marshal()
+		return tx.Bucket(indexDataBucket).Put(k, b)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(long1); err != ErrNotFound {
+		t.Fatal("collided key should not found", err)
+	}
+	if err := c.Del(long1); err != nil {
+		t.Fatal(err)
+	}
+	c.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(indexDataBucket).Get(k) == nil {
+			t.Fatal("the item of another key should not be removed")
+		}
+		return nil
+	})
+	// short keys like digests are not mixed up with long keys
+	c.hashKeyLen = 100
+	if _, err := c.Get(string(k)); err != ErrNotFound {
+		t.Fatal("raw index key should not found", err)
+	}
+}
@@ -0,0 +1,362 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// internalKeyPrefix is the prefix of keys used by the cache itself, like the parts of multipart uploads.
+// keys of clients may contain it by binary-safe protocols, so the public methods of Cache reject them, see isInternalKey.
+const internalKeyPrefix = "\x00"
+
+// isInternalKey returns true if key has internalKeyPrefix, or hashedKeyPrefix which may overwrite the digests of long keys.
+// the public methods of Cache return ErrInvalidKey for storing them, and ErrNotFound for others.
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, internalKeyPrefix) || strings.HasPrefix(key, hashedKeyPrefix)
+}
+
+const manifestMagic = "BCM1"
+
+var errNotManifest = errors.New("not a manifest")
+
+// Manifest is the value of a multipart item, the value is the concatenation of its parts
+type Manifest struct {
+	Size  int64 // size of the whole value
+	Parts []ManifestPart
+}
+
+// ManifestPart is an item storing a part of the value
+type ManifestPart struct {
+	Key  string
+	Size int64
+	Cas  uint64 // the part is missing if its cas unique changed
+}
+
+// Marshal encodes m as:
+// magic | uvarint size | uvarint len(parts) | (uvarint len(key) | key | uvarint size | uvarint cas)*
+func (m *Manifest) Marshal() []byte {
+	b := make([]byte, 0, len(manifestMagic)+2*binary.MaxVarintLen64+len(m.Parts)*32)
+	b = append(b, manifestMagic...)
+	b = appendUvarint(b, uint64(m.Size))
+	b = appendUvarint(b, uint64(len(m.Parts)))
+	for _, p := range m.Parts {
+		b = appendUvarint(b, uint64(len(p.Key)))
+		b = append(b, p.Key...)
+		b = appendUvarint(b, uint64(p.Size))
+		b = appendUvarint(b, p.Cas)
+	}
+	return b
+}
+
+// Unmarshal decodes b encoded by Marshal, it returns ErrBadManifest if the sizes of parts mismatch
+func (m *Manifest) Unmarshal(b []byte) error {
+	if len(b) < len(manifestMagic) || string(b[:len(manifestMagic)]) != manifestMagic {
+		return ErrBadManifest
+	}
+	b = b[len(manifestMagic):]
+	var bad bool
+	next := func() uint64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			bad = true
+			return 0
+		}
+		b = b[n:]
+		return v
+	}
+	m.Size = int64(next())
+	cnt := next()
+	if bad || cnt > uint64(len(b)) { // at least one byte per part
+		return ErrBadManifest
+	}
+	m.Parts = make([]ManifestPart, 0, cnt)
+	var total int64
+	for i := uint64(0); i < cnt; i++ {
+		var p ManifestPart
+		keylen := next()
+		if bad || keylen > uint64(len(b)) {
+			return ErrBadManifest
+		}
+		p.Key = string(b[:keylen])
+		b = b[keylen:]
+		p.Size = int64(next())
+		p.Cas = next()
+		if bad || p.Size < 0 {
+			return ErrBadManifest
+		}
+		total += p.Size
+		m.Parts = append(m.Parts, p)
+	}
+	if len(b) != 0 || total != m.Size {
+		return ErrBadManifest
+	}
+	return nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// decodeManifestItem decodes the manifest of item read from shards, the value of item is cleared
+func decodeManifestItem(item *Item) (*Manifest, error) {
+	m := &Manifest{}
+	err := m.Unmarshal(item.Value)
+	item.Value = item.Value[:0]
+	item.manifest = false
+	if err != nil {
+		item.Free()
+		return nil, err
+	}
+	return m, nil
+}
+
+// storeManifest stores m as the value of item.Key with mode, and sets item.Cas after stored.
+// the parts are touched before, so they expire with the item.
+func (c *Cache) storeManifest(item *Item, m *Manifest, mode StoreMode) error {
+	for _, p := range m.Parts {
+		err := c.getshard(p.Key).Touch(p.Key, item.TTL)
+		if err == ErrNotFound {
+			return ErrMissingPart
+		}
+		if err != nil {
+			return err
+		}
+	}
+	ci := &Item{Key: item.Key, Value: m.Marshal(), Flags: item.Flags, TTL: item.TTL,
+		Cas: item.Cas, Stale: item.Stale, MD5: item.MD5, manifest: true}
+	if err := c.getshard(item.Key).store(ci, mode); err != nil {
+		return err
+	}
+	item.Cas = ci.Cas
+	return nil
+}
+
+// dropManifest removes the item of key and its parts if a part is missing,
+// the item is kept if it's changed since the cas unique
+func (c *Cache) dropManifest(key string, cas uint64, m *Manifest) {
+	if err := c.getshard(key).delIfCas(key, cas); err != nil {
+		return
+	}
+	for _, p := range m.Parts {
+		c.getshard(p.Key).Del(p.Key)
+	}
+}
+
+// getManifest returns the manifest of key, or errNotManifest if the item of key is not a multipart item
+func (c *Cache) getManifest(key string) (*Manifest, error) {
+	s := c.getshard(key)
+	ii, err := s.stat(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ii.Manifest {
+		return nil, errNotManifest
+	}
+	item, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !item.manifest { // replaced
+		item.Free()
+		return nil, errNotManifest
+	}
+	m, err := decodeManifestItem(item)
+	if err != nil {
+		return nil, err
+	}
+	item.Free()
+	return m, nil
+}
+
+// getManifestRange reads at most n bytes at off of the value of m like Shard.GetRange,
+// the metadata is from item which is returned with the value.
+// missing parts are ErrNotFound and the item is dropped, the checksums of parts are verified if read wholly.
+func (c *Cache) getManifestRange(item *Item, m *Manifest, off, n int64) (*Item, int64, error) {
+	size := m.Size
+	if off < 0 {
+		off += size
+		if off < 0 {
+			off = 0
+		}
+	}
+	if n < 0 || off > size {
+		item.Free()
+		return nil, size, ErrInvalidRange
+	}
+	if n > size-off {
+		n = size - off
+	}
+	if n > MaxValueSize {
+		item.Free()
+		return nil, size, ErrValueSize
+	}
+	key, cas := item.Key, item.Cas
+	ci := c.options.Allocator.Alloc(int(n))
+	ci.Key = item.Key
+	ci.Timestamp = item.Timestamp
+	ci.TTL = item.TTL
+	ci.Flags = item.Flags
+	ci.Cas = item.Cas
+	ci.Stale = item.Stale
+	ci.MD5 = item.MD5
+	item.Free()
+
+	b := ci.Value
+	var pos int64 // offset of the current part
+	for _, p := range m.Parts {
+		if len(b) == 0 {
+			break
+		}
+		if off >= pos+p.Size {
+			pos += p.Size
+			continue
+		}
+		pi, _, err := c.getshard(p.Key).GetRange(p.Key, off-pos, int64(len(b)))
+		if err == nil && pi.Cas != p.Cas {
+			pi.Free()
+			err = ErrNotFound
+		}
+		if err == ErrInvalidRange { // size of the part changed
+			err = ErrNotFound
+		}
+		if err == ErrNotFound {
+			c.dropManifest(key, cas, m)
+		}
+		if err != nil {
+			ci.Free()
+			return nil, size, err
+		}
+		copy(b, pi.Value)
+		b = b[len(pi.Value):]
+		off += int64(len(pi.Value))
+		pos += p.Size
+		pi.Free()
+	}
+	if len(b) != 0 {
+		ci.Free()
+		return nil, size, ErrNotFound
+	}
+	return ci, size, nil
+}
+
+// manifestReader reads the value of a multipart item by reading its parts in order
+type manifestReader struct {
+	c         *Cache
+	m         *Manifest
+	verifyCrc bool
+
+	next int         // index of the next part
+	cur  ValueReader // reader of the current part
+}
+
+// newManifestReader returns the reader of the manifest item, which is read from shards with r.
+// the parts are checked before returning the reader, so a part missing is ErrNotFound unless evicted during reading.
+func (c *Cache) newManifestReader(item *Item, r *ItemReader, verifyCrc bool) (*Item, ValueReader, error) {
+	if r != nil { // large manifest
+		item.Value = item.Value[:0]
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			item.Free()
+			return nil, nil, err
+		}
+		item.Value = b
+	}
+	m, err := decodeManifestItem(item)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range m.Parts {
+		ii, err := c.getshard(p.Key).stat(p.Key)
+		if err == nil && (ii.Cas != p.Cas || int64(ii.ValueSize) != p.Size) {
+			err = ErrNotFound
+		}
+		if err == ErrNotFound {
+			c.dropManifest(item.Key, item.Cas, m)
+		}
+		if err != nil {
+			item.Free()
+			return nil, nil, err
+		}
+	}
+	return item, &manifestReader{c: c, m: m, verifyCrc: verifyCrc}, nil
+}
+
+// openPart opens the reader of the next part
+func (r *manifestReader) openPart() error {
+	p := r.m.Parts[r.next]
+	item, rd, err := r.c.getshard(p.Key).GetReader(p.Key, 0, r.verifyCrc)
+	if err != nil {
+		return err
+	}
+	cas := item.Cas
+	item.Free()
+	if cas != p.Cas || rd.Size() != p.Size {
+		rd.Close()
+		return ErrNotFound
+	}
+	r.cur = rd
+	r.next++
+	return nil
+}
+
+func (r *manifestReader) Read(b []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if r.next >= len(r.m.Parts) {
+				return 0, io.EOF
+			}
+			if err := r.openPart(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.cur.Read(b)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// WriteTo writes the rest of value to w, the parts are sent by sendfile if possible, see ItemReader.WriteTo
+func (r *manifestReader) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for {
+		if r.cur == nil {
+			if r.next >= len(r.m.Parts) {
+				return written, nil
+			}
+			if err := r.openPart(); err != nil {
+				return written, err
+			}
+		}
+		n, err := r.cur.WriteTo(w)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		r.cur.Close()
+		r.cur = nil
+	}
+}
+
+func (r *manifestReader) Size() int64 {
+	return r.m.Size
+}
+
+func (r *manifestReader) Close() error {
+	if r.cur != nil {
+		r.cur.Close()
+		r.cur = nil
+	}
+	return nil
+}
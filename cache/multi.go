@@ -0,0 +1,289 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GetMulti is like Get for multiple keys, the index of keys is looked up in one transaction,
+// and the values are read in order of their offsets in the data file.
+// items[i] is the item of keys[i] if errs[i] is nil, values larger than maxSize are not read and errs[i] is ErrValueSize.
+func (s *Shard) GetMulti(keys []string, maxSize int64) ([]*Item, []error) {
+	atomic.AddInt64(&s.metrics.GetTotal, int64(len(keys)))
+	items := make([]*Item, len(keys))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	iis, errs := s.index.GetMulti(keys)
+	order := make([]int, 0, len(keys))
+	for i, key := range keys {
+		iis[i], errs[i] = s.checkLookup(key, iis[i], errs[i])
+		if errs[i] == nil && int64(iis[i].ValueSize) > maxSize {
+			atomic.AddInt64(&s.metrics.GetTotal, -1) // the caller gets it in other ways
+			errs[i] = ErrValueSize
+		}
+		if errs[i] == nil {
+			order = append(order, i)
+		}
+	}
+	sort.Slice(order, func(a, b int) bool { return iis[order[a]].Offset < iis[order[b]].Offset })
+	for _, i := range order {
+		ii := iis[i]
+		ci := s.allocItem(keys[i], ii, int(ii.ValueSize))
+		if err := s.readValue(ii, ci.Value); err != nil {
+			if err == ErrNotFound {
+				atomic.AddInt64(&s.metrics.GetMisses, 1)
+			}
+			ci.Free()
+			errs[i] = err
+			continue
+		}
+		atomic.AddInt64(&s.metrics.GetHits, 1)
+		items[i] = ci
+	}
+	return items, errs
+}
+
+// SetMulti is like Set for multiple items, the index of them is updated in one transaction.
+// errs[i] is ErrOverwritten if the space of items[i] is reused by the later items of the batch.
+func (s *Shard) SetMulti(items []*Item) []error {
+	atomic.AddInt64(&s.metrics.SetTotal, int64(len(items)))
+	errs := make([]error, len(items))
+	iis := make([]*IndexItem, len(items))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, ci := range items {
+		size := int32(len(ci.Value))
+		if err := s.skipPinned(size); err != nil {
+			errs[i] = err
+			continue
+		}
+		ii, err := s.index.ReserveLazy(size)
+		if err != nil {
+			errs[i] = errors.Wrap(err, "reserve index")
+			continue
+		}
+		iis[i] = ii
+	}
+	// the meta is saved before writing data like Reserve, the reserved space is not validate after restarts
+	if err := s.index.SaveMeta(); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = errors.Wrap(err, "reserve index")
+			}
+		}
+		return errs
+	}
+	meta := s.index.GetIndexMeta()
+	keys := make([]string, 0, len(items))
+	stored := make([]*IndexItem, 0, len(items))
+	for i, ci := range items {
+		ii := iis[i]
+		if ii == nil {
+			continue
+		}
+		if !meta.IsValidate(*ii) {
+			errs[i] = ErrOverwritten
+			iis[i] = nil
+			continue
+		}
+		if err := s.writeItem(ci, ii); err != nil {
+			errs[i] = errors.Wrap(err, "write data")
+			iis[i] = nil
+			continue
+		}
+		keys = append(keys, ci.Key)
+		stored = append(stored, ii)
+	}
+	if err := s.index.SetMulti(keys, stored); err != nil {
+		for i := range errs {
+			if iis[i] != nil {
+				errs[i] = errors.Wrap(err, "update index")
+			}
+		}
+		return errs
+	}
+	for i, ci := range items {
+		if iis[i] != nil {
+			ci.Cas = iis[i].Cas
+		}
+	}
+	return errs
+}
+
+// DelMulti is like Del for multiple keys, the keys are removed in one transaction
+func (s *Shard) DelMulti(keys []string) []error {
+	manifests, errs := s.delMulti(keys)
+	for _, item := range manifests {
+		item.Free()
+	}
+	return errs
+}
+
+// delMulti removes keys like DelMulti, and returns the removed multipart items with their manifests
+func (s *Shard) delMulti(keys []string) ([]*Item, []error) {
+	atomic.AddInt64(&s.metrics.DelTotal, int64(len(keys)))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	iis, errs := s.index.GetMulti(keys)
+	now := time.Now().Unix()
+	var manifests []*Item
+	dels := make([]string, 0, len(keys))
+	for i, key := range keys {
+		if errs[i] == nil && s.isExpired(iis[i], now) {
+			errs[i] = ErrNotFound
+		}
+		if errs[i] != nil && errs[i] != ErrNotFound {
+			continue
+		}
+		if errs[i] == nil && iis[i].Manifest {
+			ci := s.allocItem(key, iis[i], int(iis[i].ValueSize))
+			if err := s.readValue(iis[i], ci.Value); err != nil {
+				ci.Free()
+			} else {
+				manifests = append(manifests, ci)
+			}
+		}
+		// expired or invalid items are also removed from index
+		dels = append(dels, key)
+	}
+	if err := s.index.Dels(dels); err != nil {
+		for _, item := range manifests {
+			item.Free()
+		}
+		for i := range errs {
+			if errs[i] == nil || errs[i] == ErrNotFound {
+				errs[i] = err
+			}
+		}
+		return nil, errs
+	}
+	return manifests, errs
+}
+
+// groupByShard calls f concurrently for each shard with the indexes of keys in the shard, internal keys are skipped
+func (c *Cache) groupByShard(keys []string, f func(s *Shard, idx []int)) {
+	groups := make(map[int][]int)
+	for i, key := range keys {
+		if isInternalKey(key) {
+			continue
+		}
+		n := c.hash.Get(key)
+		groups[n] = append(groups[n], i)
+	}
+	if len(groups) == 1 {
+		for n, idx := range groups {
+			f(c.shards[n], idx)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for n, idx := range groups {
+		wg.Add(1)
+		go func(s *Shard, idx []int) {
+			defer wg.Done()
+			f(s, idx)
+		}(c.shards[n], idx)
+	}
+	wg.Wait()
+}
+
+// GetMulti returns the items of keys like Get, items[i] is the item of keys[i] if errs[i] is nil.
+// errs[i] is ErrValueSize if the value is larger than maxSize, which is at most MaxValueSize.
+// the keys are grouped by shards, each group is served in one index transaction and shards are read concurrently.
+func (c *Cache) GetMulti(keys []string, maxSize int64) ([]*Item, []error) {
+	if maxSize > MaxValueSize {
+		maxSize = MaxValueSize
+	}
+	items := make([]*Item, len(keys))
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		if isInternalKey(key) {
+			errs[i] = ErrNotFound
+		}
+	}
+	c.groupByShard(keys, func(s *Shard, idx []int) {
+		ks := make([]string, len(idx))
+		for j, i := range idx {
+			ks[j] = keys[i]
+		}
+		its, ers := s.GetMulti(ks, maxSize)
+		for j, i := range idx {
+			items[i], errs[i] = its[j], ers[j]
+			if errs[i] == nil && items[i].manifest {
+				items[i], errs[i] = c.getManifestValue(items[i], maxSize)
+			}
+		}
+	})
+	return items, errs
+}
+
+// SetMulti stores items like Set, errs[i] is the result of items[i].
+// values larger than MaxValueSize are stored in chunks one by one, and others are grouped by shards like GetMulti.
+func (c *Cache) SetMulti(items []*Item) []error {
+	errs := make([]error, len(items))
+	keys := make([]string, 0, len(items))
+	idx := make([]int, 0, len(items))
+	for i, item := range items {
+		if isInternalKey(item.Key) {
+			errs[i] = ErrInvalidKey
+			continue
+		}
+		if int64(len(item.Value)) > MaxValueSize {
+			errs[i] = c.storeChunked(item, StoreSet)
+			continue
+		}
+		keys = append(keys, item.Key)
+		idx = append(idx, i)
+	}
+	c.groupByShard(keys, func(s *Shard, group []int) {
+		its := make([]*Item, len(group))
+		for j, k := range group {
+			its[j] = items[idx[k]]
+		}
+		for j, err := range s.SetMulti(its) {
+			errs[idx[group[j]]] = err
+		}
+	})
+	return errs
+}
+
+// DelMulti removes keys like Del, errs[i] is ErrNotFound if keys[i] not exists.
+// the parts of multipart items are also removed.
+func (c *Cache) DelMulti(keys []string) []error {
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		if isInternalKey(key) {
+			errs[i] = ErrNotFound
+		}
+	}
+	var mu sync.Mutex
+	var manifests []*Item
+	c.groupByShard(keys, func(s *Shard, idx []int) {
+		ks := make([]string, len(idx))
+		for j, i := range idx {
+			ks[j] = keys[i]
+		}
+		ms, ers := s.delMulti(ks)
+		for j, i := range idx {
+			errs[i] = ers[j]
+		}
+		mu.Lock()
+		manifests = append(manifests, ms...)
+		mu.Unlock()
+	})
+	for _, item := range manifests {
+		m, err := decodeManifestItem(item)
+		if err != nil {
+			continue
+		}
+		item.Free()
+		for _, p := range m.Parts {
+			c.getshard(p.Key).Del(p.Key)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheMulti(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := NewCache(dir, &CacheOptions{ShardNum: 4, Size: 4 * MinShardSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var items []*Item
+	var keys []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("k%d", i)
+		keys = append(keys, key)
+		items = append(items, &Item{Key: key, Value: bytes.Repeat([]byte{byte(i)}, i*100), Flags: uint32(i)})
+	}
+	for i, err := range c.SetMulti(items) {
+		if err != nil || items[i].Cas == 0 {
+			t.Fatal("set multi err", i, err)
+		}
+	}
+	keys = append(keys, "nosuchkey", "k1")
+	got, errs := c.GetMulti(keys, 5000)
+	for i, key := range keys {
+		switch {
+		case key == "nosuchkey":
+			if errs[i] != ErrNotFound {
+				t.Fatal("should not found", errs[i])
+			}
+		case i >= 51 && i < 100:
+			if errs[i] != ErrValueSize {
+				t.Fatal("value should exceed max size", key, errs[i])
+			}
+		default:
+			ci, err := c.Get(key)
+			if err != nil || errs[i] != nil {
+				t.Fatal(key, err, errs[i])
+			}
+			if got[i].Key != key || !bytes.Equal(got[i].Value, ci.Value) || got[i].Cas != ci.Cas || got[i].Flags != ci.Flags {
+				t.Fatal("item err", key)
+			}
+			ci.Free()
+			got[i].Free()
+		}
+	}
+
+	// multipart items are reassembled by GetMulti and the parts are removed by DelMulti
+	v := bytes.Repeat([]byte("x"), 300<<10)
+	id, _ := c.BeginUpload("m1")
+	c.UploadPart(id, 1, v[:100<<10])
+	c.UploadPart(id, 2, v[100<<10:])
+	if err := c.CommitUpload(id, 2, &Item{}); err != nil {
+		t.Fatal(err)
+	}
+	got, errs = c.GetMulti([]string{"m1", "k2"}, MaxValueSize)
+	if errs[0] != nil || !bytes.Equal(got[0].Value, v) || errs[1] != nil {
+		t.Fatal("get multi manifest err", errs)
+	}
+	m, _ := c.getManifest("m1")
+	errs = c.DelMulti([]string{"m1", "k2", "nosuchkey", "k3"})
+	if errs[0] != nil || errs[1] != nil || errs[2] != ErrNotFound || errs[3] != nil {
+		t.Fatal("del multi err", errs)
+	}
+	for _, p := range m.Parts {
+		if _, err := c.getshard(p.Key).stat(p.Key); err != ErrNotFound {
+			t.Fatal("part should be removed", p.Key, err)
+		}
+	}
+	if _, errs = c.GetMulti([]string{"m1", "k2", "k3", "k4"}, MaxValueSize); errs[0] != ErrNotFound ||
+		errs[1] != ErrNotFound || errs[2] != ErrNotFound || errs[3] != nil {
+		t.Fatal("get after del err", errs)
+	}
+}
+
+func TestShardSetMultiOverwritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cachedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := LoadCacheShard(filepath.Join(dir, "shard"), &ShardOptions{Size: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the space of k1 is reused by k3 of the same batch
+	errs := s.SetMulti([]*Item{
+		{Key: "k1", Value: make([]byte, 600<<10)},
+		{Key: "k2", Value: make([]byte, 300<<10)},
+		{Key: "k3", Value: make([]byte, 600<<10)},
+	})
+	if errs[0] != ErrOverwritten || errs[1] != nil || errs[2] != nil {
+		t.Fatal("set multi err", errs)
+	}
+	items, errs := s.GetMulti([]string{"k1", "k2", "k3"}, MaxValueSize)
+	if errs[0] != ErrNotFound || errs[1] != nil || errs[2] != nil {
+		t.Fatal("get multi err", errs)
+	}
+	items[1].Free()
+	items[2].Free()
+}
@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+const (
+	MaxUploadParts = 10000
+	UploadTTL      = 24 * 3600 // the ttl of uploads and parts not committed
+)
+
+// uploadKey returns the key of the upload record, the value of it is the key of the upload
+func uploadKey(id string) string {
+	return internalKeyPrefix + "upload/" + id
+}
+
+func partKey(id string, n int) string {
+	return uploadKey(id) + "/" + strconv.Itoa(n)
+}
+
+// BeginUpload starts a multipart upload of key and returns the upload id.
+// the parts are placed across shards by their keys, so the value can be larger than a shard.
+func (c *Cache) BeginUpload(key string) (string, error) {
+	if isInternalKey(key) {
+		return "", ErrInvalidKey
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b[:])
+	k := uploadKey(id)
+	return id, c.getshard(k).Set(&Item{Key: k, Value: []byte(key), TTL: UploadTTL})
+}
+
+// NewPartWriter returns the writer for streaming part n of the upload, n is in [1, MaxUploadParts].
+// a part uploaded again replaces the old one. it returns ErrNotFound if the upload not exists.
+func (c *Cache) NewPartWriter(id string, n int, size int64) (ValueWriter, error) {
+	if n < 1 || n > MaxUploadParts {
+		return nil, ErrInvalidPart
+	}
+	if size > MaxValueSize {
+		return nil, ErrValueSize
+	}
+	k := uploadKey(id)
+	if _, err := c.getshard(k).stat(k); err != nil {
+		return nil, err
+	}
+	k = partKey(id, n)
+	w, err := c.getshard(k).NewWriter(&Item{Key: k, TTL: UploadTTL}, size)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// UploadPart stores value as part n of the upload, see NewPartWriter
+func (c *Cache) UploadPart(id string, n int, value []byte) error {
+	w, err := c.NewPartWriter(id, n, int64(len(value)))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(value); err != nil {
+		return err
+	}
+	return w.Commit(StoreSet)
+}
+
+// CommitUpload stores parts 1 to n of the upload as the value of the key at once,
+// the Flags and TTL of item are used, and the Key and Cas of item are set after stored.
+// it returns ErrMissingPart if any part not uploaded, and the upload is not changed.
+func (c *Cache) CommitUpload(id string, n int, item *Item) error {
+	if n < 1 || n > MaxUploadParts {
+		return ErrInvalidPart
+	}
+	k := uploadKey(id)
+	rec, err := c.getshard(k).Get(k)
+	if err != nil {
+		return err
+	}
+	key := string(rec.Value)
+	rec.Free()
+
+	m := &Manifest{Parts: make([]ManifestPart, 0, n)}
+	for i := 1; i <= n; i++ {
+		p := ManifestPart{Key: partKey(id, i)}
+		ii, err := c.getshard(p.Key).stat(p.Key)
+		if err == ErrNotFound {
+			return ErrMissingPart
+		}
+		if err != nil {
+			return err
+		}
+		p.Size = int64(ii.ValueSize)
+		p.Cas = ii.Cas
+		m.Size += p.Size
+		m.Parts = append(m.Parts, p)
+	}
+	item.Key = key
+	if err := c.storeManifest(item, m, StoreSet); err != nil {
+		return err
+	}
+	c.delUpload(id, n)
+	return nil
+}
+
+// AbortUpload removes the upload and its parts, it returns ErrNotFound if the upload not exists
+func (c *Cache) AbortUpload(id string) error {
+	k := uploadKey(id)
+	if _, err := c.getshard(k).stat(k); err != nil {
+		return err
+	}
+	return c.delUpload(id, 0)
+}
+
+// delUpload removes the upload record and the parts after part n
+func (c *Cache) delUpload(id string, n int) error {
+	k := uploadKey(id)
+	if err := c.getshard(k).Del(k); err != nil && err != ErrNotFound {
+		return err
+	}
+	prefix := k + "/"
+	start := prefix
+	for {
+		infos, err := c.scan(prefix, start, 1000)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if i, _ := strconv.Atoi(strings.TrimPrefix(info.Key, prefix)); i > n {
+				c.getshard(info.Key).Del(info.Key)
+			}
+		}
+		if len(infos) < 1000 {
+			return nil
+		}
+		start = infos[len(infos)-1].Key + "\x00"
+	}
+}
@@ -0,0 +1,227 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCacheMultipartUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := NewCache(dir, &CacheOptions{ShardNum: 4, Size: 4 * MinShardSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	v := make([]byte, 700<<10)
+	rand.Read(v)
+	id, err := c.BeginUpload("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UploadPart(id, 0, v); err != ErrInvalidPart {
+		t.Fatal("part 0 should be invalid", err)
+	}
+	if err := c.UploadPart("nosuchid", 1, v); err != ErrNotFound {
+		t.Fatal("upload should not found", err)
+	}
+	c.UploadPart(id, 1, v[:100])
+	c.UploadPart(id, 3, v[300<<10:])
+	c.UploadPart(id, 4, []byte("discarded by commit"))
+	if err := c.CommitUpload(id, 3, &Item{}); err != ErrMissingPart {
+		t.Fatal("part 2 should be missing", err)
+	}
+	c.UploadPart(id, 1, v[:100<<10]) // replaced
+	w, err := c.NewPartWriter(id, 2, 200<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.ReadFrom(bytes.NewReader(v[100<<10 : 300<<10])); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(StoreSet); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("k1"); err != ErrNotFound {
+		t.Fatal("should not found before commit", err)
+	}
+	item := &Item{Flags: 5, TTL: 100}
+	if err := c.CommitUpload(id, 3, item); err != nil {
+		t.Fatal(err)
+	}
+	if item.Key != "k1" || item.Cas == 0 {
+		t.Fatal("committed item err", item.Key, item.Cas)
+	}
+	if err := c.CommitUpload(id, 3, item); err != ErrNotFound {
+		t.Fatal("upload should be removed after commit", err)
+	}
+	if infos, _ := c.scan(uploadKey(id), "", 10); len(infos) != 3 {
+		t.Fatal("parts not in the manifest should be removed", infos)
+	}
+	if infos, _ := c.Scan("", "", 10); len(infos) != 1 || infos[0].Key != "k1" || infos[0].Size != int64(len(v)) {
+		t.Fatal("scan err", infos)
+	}
+
+	ci, err := c.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ci.Value, v) || ci.Flags != 5 || ci.TTL != 100 || ci.Cas != item.Cas {
+		t.Fatal("get err", ci.Flags, ci.TTL, ci.Cas)
+	}
+	ci, size, err := c.GetRange("k1", 100<<10-2, 4)
+	if err != nil || size != int64(len(v)) || !bytes.Equal(ci.Value, v[100<<10-2:100<<10+2]) {
+		t.Fatal("get range across parts err", err, size)
+	}
+	if _, _, err := c.GetRange("k1", 800<<10, 1); err != ErrInvalidRange {
+		t.Fatal("range should be invalid", err)
+	}
+	ci, r, err := c.GetReader("k1", 1<<30, true)
+	if err != nil || len(ci.Value) != 0 || r.Size() != int64(len(v)) {
+		t.Fatal("get reader err", err)
+	}
+	if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, v) {
+		t.Fatal("read err", err)
+	}
+	r.Close()
+	if err := c.Append(&Item{Key: "k1", Value: []byte("x")}); err != ErrNotStored {
+		t.Fatal("append should not stored", err)
+	}
+
+	if err := c.UploadPart(id, 1, v[:100<<10]); err != ErrNotFound {
+		t.Fatal("upload should be removed", err)
+	}
+
+	// a part changed is missing, and the item is dropped with its parts
+	c.getshard(partKey(id, 2)).Set(&Item{Key: partKey(id, 2), Value: v[100<<10 : 300<<10]})
+	if _, _, err := c.GetReader("k1", 0, true); err != ErrNotFound {
+		t.Fatal("should not found", err)
+	}
+	if _, err := c.Get("k1"); err != ErrNotFound {
+		t.Fatal("should not found", err)
+	}
+	if infos, _ := c.scan(uploadKey(id), "", 10); len(infos) != 0 {
+		t.Fatal("parts should be removed", infos)
+	}
+
+	// parts are removed with the item or the upload
+	id, _ = c.BeginUpload("k1")
+	c.UploadPart(id, 1, v)
+	if err := c.CommitUpload(id, 1, &Item{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Del("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := c.scan(uploadKey(id), "", 10); len(infos) != 0 {
+		t.Fatal("parts should be removed", infos)
+	}
+	id, _ = c.BeginUpload("k2")
+	c.UploadPart(id, 1, v)
+	if err := c.AbortUpload(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AbortUpload(id); err != ErrNotFound {
+		t.Fatal("upload should be removed", err)
+	}
+	if infos, _ := c.scan(internalKeyPrefix, "", 10); len(infos) != 0 {
+		t.Fatal("parts should be removed", infos)
+	}
+}
+
+func TestManifestMarshal(t *testing.T) {
+	m := &Manifest{Size: 300, Parts: []ManifestPart{{"p1", 100, 1}, {"p2", 200, 1 << 40}}}
+	b := m.Marshal()
+	var m2 Manifest
+	if err := m2.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if m2.Size != 300 || len(m2.Parts) != 2 || m2.Parts[1] != m.Parts[1] {
+		t.Fatal("unmarshal err", m2)
+	}
+	for i := 0; i < len(b); i++ {
+		if err := m2.Unmarshal(b[:i]); err != ErrBadManifest {
+			t.Fatal("truncated manifest should be bad", i, err)
+		}
+	}
+}
+
+func TestCacheInternalKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := NewCache(dir, &CacheOptions{ShardNum: 4, Size: 4 * MinShardSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	v := []byte("part1")
+	id, _ := c.BeginUpload("k1")
+	if err := c.UploadPart(id, 1, v); err != nil {
+		t.Fatal(err)
+	}
+	// the upload record and parts can not be accessed by the keys of clients
+	for _, k := range []string{uploadKey(id), partKey(id, 1)} {
+		if _, err := c.Get(k); err != ErrNotFound {
+			t.Fatal("get should not found", k, err)
+		}
+		if _, _, err := c.GetReader(k, 0, false); err != ErrNotFound {
+			t.Fatal("get reader should not found", k, err)
+		}
+		if _, _, err := c.GetRange(k, 0, 1); err != ErrNotFound {
+			t.Fatal("get range should not found", k, err)
+		}
+		if _, errs := c.GetMulti([]string{k}, MaxValueSize); errs[0] != ErrNotFound {
+			t.Fatal("get multi should not found", k, errs)
+		}
+		if err := c.Touch(k, 1); err != ErrNotFound {
+			t.Fatal("touch should not found", k, err)
+		}
+		if err := c.Del(k); err != ErrNotFound {
+			t.Fatal("del should not found", k, err)
+		}
+		if errs := c.DelMulti([]string{k}); errs[0] != ErrNotFound {
+			t.Fatal("del multi should not found", k, errs)
+		}
+		if err := c.Set(&Item{Key: k, Value: []byte("x")}); err != ErrInvalidKey {
+			t.Fatal("set should be invalid", k, err)
+		}
+		if errs := c.SetMulti([]*Item{{Key: k, Value: []byte("x")}}); errs[0] != ErrInvalidKey {
+			t.Fatal("set multi should be invalid", k, errs)
+		}
+		if _, err := c.NewWriter(&Item{Key: k}, 1); err != ErrInvalidKey {
+			t.Fatal("new writer should be invalid", k, err)
+		}
+		if err := c.Append(&Item{Key: k, Value: []byte("x")}); err != ErrInvalidKey {
+			t.Fatal("append should be invalid", k, err)
+		}
+	}
+	if _, err := c.BeginUpload(partKey(id, 1)); err != ErrInvalidKey {
+		t.Fatal("begin upload should be invalid", err)
+	}
+	if infos, _ := c.Scan(internalKeyPrefix, "", 10); len(infos) != 0 {
+		t.Fatal("internal keys should not be scanned", infos)
+	}
+	if infos, _ := c.Scan("", "", 10); len(infos) != 0 {
+		t.Fatal("internal keys should not be scanned", infos)
+	}
+
+	if err := c.CommitUpload(id, 1, &Item{}); err != nil {
+		t.Fatal(err)
+	}
+	item, err := c.Get("k1")
+	if err != nil || !bytes.Equal(item.Value, v) {
+		t.Fatal("get err", err)
+	}
+	item.Free()
+}
@@ -42,6 +42,10 @@ func (p *AllocatorPool) Alloc(n int) *Item {
 	item.Timestamp = 0
 	item.TTL = 0
 	item.Flags = 0
+	item.Cas = 0
+	item.Stale = false
+	item.MD5 = nil
+	item.manifest = false
 	return item
 }
 
@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// ValueReader reads the value of an item from the cache without copying it to memory,
+// it must be closed after reading.
+type ValueReader interface {
+	io.Reader
+	io.WriterTo
+	io.Closer
+	Size() int64
+}
+
+// pin is a range of data file in use by readers, writers skip the range until unpinned
+type pin struct {
+	off, end int64
+}
+
+// ItemReader reads the value of an item from the data file directly
+type ItemReader struct {
+	*io.SectionReader
+
+	s   *Shard
+	f   *os.File
+	off int64
+	pin *pin
+}
+
+// GetReader returns the item of key for streaming its value,
+// if the value is smaller than minSize, it's read into item.Value like Get and the reader is nil.
+// otherwise the value is not read and the space of it is pinned until the reader closed,
+// and the checksum is verified before returning the reader if verifyCrc.
+func (s *Shard) GetReader(key string, minSize int64, verifyCrc bool) (*Item, *ItemReader, error) {
+	atomic.AddInt64(&s.metrics.GetTotal, 1)
+	s.mu.RLock()
+	ii, err := s.lookup(key)
+	if err != nil {
+		s.mu.RUnlock()
+		return nil, nil, err
+	}
+	size := int64(ii.ValueSize)
+	if size < minSize {
+		defer s.mu.RUnlock()
+		ci := s.allocItem(key, ii, int(size))
+		if err := s.readValue(ii, ci.Value); err != nil {
+			if err == ErrNotFound {
+				atomic.AddInt64(&s.metrics.GetMisses, 1)
+			}
+			ci.Free()
+			return nil, nil, err
+		}
+		atomic.AddInt64(&s.metrics.GetHits, 1)
+		return ci, nil, nil
+	}
+	if ii.Offset+size > s.data.Size() {
+		s.mu.RUnlock()
+		atomic.AddInt64(&s.metrics.GetMisses, 1)
+		return nil, nil, ErrNotFound // data size changed?
+	}
+	p := &pin{off: ii.Offset, end: ii.Offset + size}
+	s.pinmu.Lock()
+	s.pins[p] = struct{}{}
+	s.pinmu.Unlock()
+	s.mu.RUnlock()
+
+	r := &ItemReader{
+		SectionReader: io.NewSectionReader(s.data.f, ii.Offset, size),
+		s:             s,
+		f:             s.data.f,
+		off:           ii.Offset,
+		pin:           p,
+	}
+	if verifyCrc && ii.Crc32 != 0 {
+		h := crc32.NewIEEE()
+		if _, err := io.Copy(h, io.NewSectionReader(s.data.f, ii.Offset, size)); err != nil {
+			r.Close()
+			return nil, nil, err
+		}
+		if h.Sum32() != ii.Crc32 {
+			r.Close()
+			return nil, nil, ErrValueCrc
+		}
+	}
+	atomic.AddInt64(&s.metrics.GetHits, 1)
+	return s.allocItem(key, ii, 0), r, nil
+}
+
+// Close unpins the space of value
+func (r *ItemReader) Close() error {
+	if r.pin == nil {
+		return nil
+	}
+	s := r.s
+	s.pinmu.Lock()
+	delete(s.pins, r.pin)
+	s.pinmu.Unlock()
+	r.pin = nil
+	return nil
+}
+
+// WriteTo writes the rest of value to w, it uses sendfile(2) if w is a socket like *net.TCPConn
+func (r *ItemReader) WriteTo(w io.Writer) (int64, error) {
+	sc, ok := w.(syscall.Conn)
+	if !ok {
+		return io.Copy(w, r.SectionReader)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return io.Copy(w, r.SectionReader)
+	}
+	cur, _ := r.Seek(0, io.SeekCurrent)
+	off := r.off + cur
+	remain := r.Size() - cur
+	infd := int(r.f.Fd())
+	var written int64
+	var werr error
+	err = rc.Write(func(fd uintptr) bool {
+		for remain > 0 {
+			n, err := syscall.Sendfile(int(fd), infd, &off, int(remain))
+			if n > 0 {
+				written += int64(n)
+				remain -= int64(n)
+			}
+			switch {
+			case err == syscall.EAGAIN:
+				return false // wait for writable
+			case err == syscall.EINTR:
+			case err != nil:
+				werr = err
+				return true
+			case n == 0:
+				werr = io.ErrUnexpectedEOF
+				return true
+			}
+		}
+		return true
+	})
+	r.Seek(cur+written, io.SeekStart)
+	if err == nil {
+		err = werr
+	}
+	return written, err
+}
+
+// pinnedEnd returns the max end of pins overlapping the range [off, end), or -1 if none
+func pinnedEnd(pins map[*pin]struct{}, off, end int64) int64 {
+	ret := int64(-1)
+	for p := range pins {
+		if off < p.end && p.off < end && p.end > ret {
+			ret = p.end
+		}
+	}
+	return ret
+}
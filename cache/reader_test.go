@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestShardGetReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cachedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := LoadCacheShard(filepath.Join(dir, "shard"), &ShardOptions{Size: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	v := make([]byte, 300<<10)
+	rand.Read(v)
+	s.Set(&Item{Key: "small", Value: []byte("hello"), Flags: 1})
+	s.Set(&Item{Key: "large", Value: v, Flags: 2})
+
+	ci, r, err := s.GetReader("small", 1024, true)
+	if err != nil || r != nil || string(ci.Value) != "hello" || ci.Flags != 1 {
+		t.Fatal("get small err", err, r)
+	}
+	if _, _, err := s.GetReader("nokey", 1024, true); err != ErrNotFound {
+		t.Fatal("should not found", err)
+	}
+
+	// WriteTo sends the value by sendfile
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan []byte)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- nil
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		done <- b
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci, r, err = s.GetReader("large", 1024, true)
+	if err != nil || len(ci.Value) != 0 || ci.Flags != 2 || r.Size() != int64(len(v)) {
+		t.Fatal("get large err", err)
+	}
+	b := make([]byte, 100)
+	if _, err := io.ReadFull(r, b); err != nil || !bytes.Equal(b, v[:100]) {
+		t.Fatal("read err", err)
+	}
+	if n, err := io.Copy(conn, r); err != nil || n != int64(len(v)-100) {
+		t.Fatal("write to err", n, err)
+	}
+	conn.Close()
+	if b := <-done; !bytes.Equal(b, v[100:]) {
+		t.Fatal("value sent err", len(b))
+	}
+
+	// the pinned space is skipped by writers instead of reused, and the item of it is evicted
+	r.Seek(0, io.SeekStart)
+	for _, k := range []string{"k1", "k2"} {
+		if err := s.Set(&Item{Key: k, Value: make([]byte, 400<<10)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Get("large"); err != ErrNotFound {
+		t.Fatal("large should be evicted", err)
+	}
+	if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, v) {
+		t.Fatal("pinned value changed", err)
+	}
+	r.Close()
+
+	// the checksum is verified before returning the reader
+	s.Set(&Item{Key: "large", Value: v})
+	ii, _ := s.index.Get("large")
+	s.data.Write(ii.Offset, []byte("x"))
+	if _, _, err := s.GetReader("large", 1024, true); err != ErrValueCrc {
+		t.Fatal("crc should mismatch", err)
+	}
+	_, r, err = s.GetReader("large", 1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+}
+
+func TestShardPinSkip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cachedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := LoadCacheShard(filepath.Join(dir, "shard"), &ShardOptions{Size: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Set(&Item{Key: "large", Value: make([]byte, 300<<10)})
+	_, r, err := s.GetReader("large", 1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// no space out of the pinned range, and nothing is evicted
+	if err := s.Set(&Item{Key: "k1", Value: make([]byte, 800<<10)}); errors.Cause(err) != ErrPinned {
+		t.Fatal("set should fail", err)
+	}
+	if errs := s.SetMulti([]*Item{{Key: "k1", Value: make([]byte, 800<<10)}}); errs[0] != ErrPinned {
+		t.Fatal("set multi should fail", errs)
+	}
+	if _, err := s.Get("large"); err != nil {
+		t.Fatal("pinned item should not be evicted", err)
+	}
+
+	// concurrent conditional writes wrapping around the pinned range
+	s.Set(&Item{Key: "fill", Value: make([]byte, 720<<10)})
+	s.Set(&Item{Key: "n", Value: []byte("0")})
+	var wg sync.WaitGroup
+	var added int32
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := s.Add(&Item{Key: "a", Value: make([]byte, 4<<10)}); err == nil {
+				atomic.AddInt32(&added, 1)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := s.Incr("n", 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 1 {
+		t.Fatal("add should be stored once", added)
+	}
+	if item, err := s.Get("n"); err != nil || string(item.Value) != "20" {
+		t.Fatal("incr err", err)
+	}
+	if _, err := s.Get("large"); err != ErrNotFound {
+		t.Fatal("large should be evicted", err)
+	}
+}
@@ -1,8 +1,12 @@
 package cache
 
 import (
+	"bytes"
 	"hash/crc32"
 	"log"
+	"math/bits"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -25,6 +29,13 @@ type Shard struct {
 	stats   CacheStats
 	metrics CacheMetrics
 	exit    chan struct{}
+
+	gcmu    sync.Mutex
+	gcRound gcstat // the running gc round
+	gcLast  gcstat // the last finished gc round
+
+	pinmu sync.Mutex
+	pins  map[*pin]struct{} // the ranges of data in use by ItemReaders
 }
 
 type ShardOptions struct {
@@ -32,6 +43,8 @@ type ShardOptions struct {
 	TTL       int64
 	Allocator Allocator
 	DisableGC bool
+
+	HashKeyLen int // keys longer than it are stored in index under their digests, 0 for disabled
 }
 
 var DefualtShardOptions = ShardOptions{
@@ -54,10 +67,12 @@ func LoadCacheShard(fn string, options *ShardOptions) (*Shard, error) {
 
 	var err error
 	s := Shard{options: *options}
+	s.pins = make(map[*pin]struct{})
 	s.index, err = LoadCacheIndex(fn+indexSubfix, options.Size)
 	if err != nil {
 		return nil, errors.Wrap(err, "LoadIndex")
 	}
+	s.index.hashKeyLen = options.HashKeyLen
 	s.data, err = LoadCacheData(fn+dataSubfix, options.Size)
 	if err != nil {
 		return nil, errors.Wrap(err, "LoadData")
@@ -109,6 +124,33 @@ func (s *Shard) GetMetrics() CacheMetrics {
 	return m
 }
 
+// ResetMetrics resets all metrics to zero
+func (s *Shard) ResetMetrics() {
+	atomic.StoreInt64(&s.metrics.GetTotal, 0)
+	atomic.StoreInt64(&s.metrics.GetHits, 0)
+	atomic.StoreInt64(&s.metrics.GetMisses, 0)
+	atomic.StoreInt64(&s.metrics.GetExpired, 0)
+	atomic.StoreInt64(&s.metrics.SetTotal, 0)
+	atomic.StoreInt64(&s.metrics.DelTotal, 0)
+	atomic.StoreInt64(&s.metrics.Expired, 0)
+	atomic.StoreInt64(&s.metrics.Evicted, 0)
+	atomic.StoreInt64(&s.metrics.EvictedAge, 0)
+}
+
+func (s *Shard) GetStatus() ShardStatus {
+	meta := s.index.GetIndexMeta()
+	st := ShardStatus{Term: meta.Term, Head: meta.Head, DataSize: meta.DataSize, Cas: meta.Cas}
+	s.gcmu.Lock()
+	st.GCScanned = s.gcRound.Scanned
+	st.GCPurged = s.gcRound.Purged
+	if !s.gcLast.LastFinish.IsZero() {
+		st.GCLastFinish = s.gcLast.LastFinish.Unix()
+	}
+	st.Sizes = s.gcLast.Sizes
+	s.gcmu.Unlock()
+	return st
+}
+
 func (s *Shard) GetStats() CacheStats {
 	var st CacheStats
 	st.Keys = atomic.LoadUint64(&s.stats.Keys)
@@ -118,83 +160,503 @@ func (s *Shard) GetStats() CacheStats {
 }
 
 func (s *Shard) Set(ci *Item) error {
+	return s.store(ci, StoreSet)
+}
+
+// Add stores the item only if the key does not exist
+func (s *Shard) Add(ci *Item) error {
+	return s.store(ci, StoreAdd)
+}
+
+// Replace stores the item only if the key already exists
+func (s *Shard) Replace(ci *Item) error {
+	return s.store(ci, StoreReplace)
+}
+
+// CompareAndSwap stores the item only if the cas unique of the key is not changed
+func (s *Shard) CompareAndSwap(ci *Item) error {
+	return s.store(ci, StoreCAS)
+}
+
+func (s *Shard) store(ci *Item, mode StoreMode) error {
+	atomic.AddInt64(&s.metrics.SetTotal, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkStore(ci, mode); err != nil {
+		return err
+	}
+	return s.set(ci, 0)
+}
+
+// canStore returns nil if ci can be stored with mode now, ci is not changed
+func (s *Shard) canStore(ci *Item, mode StoreMode) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.checkStore(&Item{Key: ci.Key, Cas: ci.Cas, Stale: ci.Stale}, mode)
+}
+
+// checkStore returns nil if ci can be stored with mode, s.mu must be locked
+func (s *Shard) checkStore(ci *Item, mode StoreMode) error {
+	if mode == StoreSet {
+		return nil
+	}
+	ii, err := s.getIndexItem(ci.Key)
+	switch mode {
+	case StoreAdd:
+		if err == nil {
+			return ErrNotStored
+		}
+		if err == ErrNotFound {
+			return nil
+		}
+	case StoreReplace:
+		if err == ErrNotFound {
+			return ErrNotStored
+		}
+	}
+	if err != nil || mode != StoreCAS {
+		return err
+	}
+	// if ci.Stale, the value with an older cas unique is stored as stale instead of conflict
+	stale := ci.Stale && ci.Cas < ii.Cas
+	if ii.Cas != ci.Cas && !stale {
+		return ErrCasConflict
+	}
+	ci.Stale = stale
+	return nil
+}
+
+// Append appends the value of ci to the existing value of the key.
+// the combined value is stored as a new item with the original flags and ttl
+func (s *Shard) Append(ci *Item) error {
+	return s.concat(ci, false)
+}
+
+// Prepend is like Append but puts the value of ci before the existing value
+func (s *Shard) Prepend(ci *Item) error {
+	return s.concat(ci, true)
+}
+
+func (s *Shard) concat(ci *Item, prepend bool) error {
+	atomic.AddInt64(&s.metrics.SetTotal, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ii, err := s.getIndexItem(ci.Key)
+	if err == ErrNotFound {
+		return ErrNotStored
+	}
+	if err != nil {
+		return err
+	}
+	if ii.Manifest { // the value of multipart items can not be changed in place
+		return ErrNotStored
+	}
+	n := int64(ii.ValueSize) + int64(len(ci.Value))
+	if n > MaxValueSize {
+		return ErrValueSize
+	}
+	item := s.options.Allocator.Alloc(int(n))
+	defer item.Free()
+	item.Key = ci.Key
+	item.TTL = ii.TTL
+	item.Flags = ii.Flags
+
+	old, add := item.Value[:ii.ValueSize], item.Value[ii.ValueSize:]
+	if prepend {
+		add, old = item.Value[:len(ci.Value)], item.Value[len(ci.Value):]
+	}
+	if err := s.readValue(ii, old); err != nil {
+		return err
+	}
+	copy(add, ci.Value)
+
+	// keep the timestamp, or the ttl will be extended
+	if err := s.set(item, ii.Timestamp); err != nil {
+		return err
+	}
+	ci.Cas = item.Cas
+	return nil
+}
+
+// maxNumberSize is the max value size of a number for incr & decr, including padding spaces
+const maxNumberSize = 64
+
+// Incr increases the decimal value of the key by delta, the value wraps around at 64 bits
+func (s *Shard) Incr(key string, delta uint64) (uint64, error) {
+	return s.incrDecr(key, delta, false)
+}
+
+// Decr decreases the decimal value of the key by delta, the value will not lower than 0
+func (s *Shard) Decr(key string, delta uint64) (uint64, error) {
+	return s.incrDecr(key, delta, true)
+}
+
+func (s *Shard) incrDecr(key string, delta uint64, decr bool) (uint64, error) {
 	atomic.AddInt64(&s.metrics.SetTotal, 1)
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	ii, err := s.index.Reserve(int32(len(ci.Value)))
+	ii, err := s.getIndexItem(key)
+	if err != nil {
+		return 0, err
+	}
+	if ii.ValueSize > maxNumberSize || ii.Manifest {
+		return 0, ErrNotNumber
+	}
+	var buf [maxNumberSize]byte
+	b := buf[:ii.ValueSize]
+	if err := s.readValue(ii, b); err != nil {
+		return 0, err
+	}
+	// memcached may pad spaces after the number when decr
+	v, err := strconv.ParseUint(string(bytes.TrimRight(b, " ")), 10, 64)
+	if err != nil {
+		return 0, ErrNotNumber
+	}
+	if !decr {
+		v += delta
+	} else if delta > v {
+		v = 0
+	} else {
+		v -= delta
+	}
+	item := &Item{Key: key, TTL: ii.TTL, Flags: ii.Flags}
+	item.Value = strconv.AppendUint(buf[:0], v, 10)
+	if err := s.set(item, ii.Timestamp); err != nil {
+		return 0, err
+	}
+	return v, nil
+}
+
+// reserve reserves size bytes of data after the ranges pinned by readers, s.mu must be locked
+func (s *Shard) reserve(size int32) (*IndexItem, error) {
+	if err := s.skipPinned(size); err != nil {
+		return nil, err
+	}
+	return s.index.Reserve(size)
+}
+
+// skipPinned moves the head past the ranges pinned by readers if the next reserve of size overlaps them, s.mu must be locked.
+// writers never wait for readers, the pinned data is kept until the readers closed while the items of it are evicted.
+// it returns ErrPinned if there's no space of size out of the pinned ranges.
+func (s *Shard) skipPinned(size int32) error {
+	meta := s.index.GetIndexMeta()
+	off, wrap := meta.Head, false
+	if off+int64(size) > meta.DataSize {
+		off, wrap = 0, true
+	}
+	s.pinmu.Lock()
+	defer s.pinmu.Unlock()
+	skipped := false
+	for {
+		end := pinnedEnd(s.pins, off, off+int64(size))
+		if end < 0 {
+			break
+		}
+		off, skipped = end, true
+		if off+int64(size) > meta.DataSize {
+			if wrap {
+				return ErrPinned
+			}
+			off, wrap = 0, true
+		}
+	}
+	if skipped {
+		s.index.SkipTo(off, wrap)
+	}
+	return nil
+}
+
+// set writes the item to data and index, s.mu must be locked.
+// ts is the timestamp of the item which the ttl is relative to, 0 for now.
+func (s *Shard) set(ci *Item, ts int64) error {
+	ii, err := s.reserve(int32(len(ci.Value)))
 	if err != nil {
 		return errors.Wrap(err, "reserve index")
 	}
-	ii.TTL = ci.TTL
-	ii.Flags = ci.Flags
-	ii.Crc32 = crc32.ChecksumIEEE(ci.Value)
-	if err := s.data.Write(ii.Offset, ci.Value); err != nil {
+	if ts > 0 {
+		ii.Timestamp = ts
+	}
+	if err := s.writeItem(ci, ii); err != nil {
 		return errors.Wrap(err, "write data")
 	}
 	if err := s.index.Set(ci.Key, ii); err != nil {
 		return errors.Wrap(err, "update index")
 	}
+	ci.Cas = ii.Cas
 	return nil
 }
 
+// writeItem fills ii with the fields of ci and writes the value to the space of ii
+func (s *Shard) writeItem(ci *Item, ii *IndexItem) error {
+	ii.TTL = ci.TTL
+	ii.Flags = ci.Flags
+	ii.Stale = ci.Stale
+	ii.MD5 = ci.MD5
+	ii.Manifest = ci.manifest
+	ii.Crc32 = crc32.ChecksumIEEE(ci.Value)
+	return s.data.Write(ii.Offset, ci.Value)
+}
+
 func (s *Shard) Get(key string) (*Item, error) {
 	atomic.AddInt64(&s.metrics.GetTotal, 1)
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	ii, err := s.index.Get(key)
+	ii, err := s.lookup(key)
 	if err != nil {
+		return nil, err
+	}
+
+	ci := s.allocItem(key, ii, int(ii.ValueSize))
+	if err := s.readValue(ii, ci.Value); err != nil {
 		if err == ErrNotFound {
 			atomic.AddInt64(&s.metrics.GetMisses, 1)
 		}
+		ci.Free()
 		return nil, err
 	}
+	atomic.AddInt64(&s.metrics.GetHits, 1)
+	return ci, nil
+}
+
+// GetRange returns the item of key with at most n bytes of the value at off, and the size of the whole value.
+// if off < 0, it's relative to the end of the value. the checksum is only verified if reading the whole value.
+func (s *Shard) GetRange(key string, off, n int64) (*Item, int64, error) {
+	atomic.AddInt64(&s.metrics.GetTotal, 1)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ii, err := s.lookup(key)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	age := time.Now().Unix() - ii.Timestamp
-	if (s.options.TTL > 0 && age >= s.options.TTL) || (ii.TTL > 0 && age > int64(ii.TTL)) {
+	size := int64(ii.ValueSize)
+	if off < 0 {
+		off += size
+		if off < 0 {
+			off = 0
+		}
+	}
+	if n < 0 || off > size {
+		return nil, size, ErrInvalidRange
+	}
+	if n > size-off {
+		n = size - off
+	}
+
+	ci := s.allocItem(key, ii, int(n))
+	if off == 0 && n == size {
+		err = s.readValue(ii, ci.Value)
+	} else if err = s.data.Read(ii.Offset+off, ci.Value); err == ErrOutOfRange {
+		err = ErrNotFound
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			atomic.AddInt64(&s.metrics.GetMisses, 1)
+		}
+		ci.Free()
+		return nil, size, err
+	}
+	atomic.AddInt64(&s.metrics.GetHits, 1)
+	return ci, size, nil
+}
+
+// lookup returns the IndexItem of key for reading, the expired item is removed.
+// s.mu must be locked, and the misses are counted.
+func (s *Shard) lookup(key string) (*IndexItem, error) {
+	ii, err := s.index.Get(key)
+	return s.checkLookup(key, ii, err)
+}
+
+// checkLookup checks the result of looking up key in index like lookup
+func (s *Shard) checkLookup(key string, ii *IndexItem, err error) (*IndexItem, error) {
+	if err != nil {
+		if err == ErrNotFound {
+			atomic.AddInt64(&s.metrics.GetMisses, 1)
+		}
+		return nil, err
+	}
+	if s.isExpired(ii, time.Now().Unix()) {
 		atomic.AddInt64(&s.metrics.GetMisses, 1)
 		atomic.AddInt64(&s.metrics.GetExpired, 1)
 		atomic.AddInt64(&s.metrics.Expired, 1)
 		s.index.Del(key)
 		return nil, ErrNotFound
 	}
+	return ii, nil
+}
 
-	ci := s.options.Allocator.Alloc(int(ii.ValueSize))
+// allocItem allocates an item of key with n bytes value, and the fields from ii
+func (s *Shard) allocItem(key string, ii *IndexItem, n int) *Item {
+	ci := s.options.Allocator.Alloc(n)
 	ci.Key = key
 	ci.Timestamp = ii.Timestamp
 	ci.TTL = ii.TTL
 	ci.Flags = ii.Flags
+	ci.Cas = ii.Cas
+	ci.Stale = ii.Stale
+	ci.MD5 = ii.MD5
+	ci.manifest = ii.Manifest
+	return ci
+}
 
-	err = s.data.Read(ii.Offset, ci.Value)
+// readValue reads the value of ii to b and verifies the checksum
+func (s *Shard) readValue(ii *IndexItem, b []byte) error {
+	err := s.data.Read(ii.Offset, b)
 	if err == ErrOutOfRange {
-		err = ErrNotFound // data size changed?
+		return ErrNotFound // data size changed?
 	}
 	if err != nil {
-		if err == ErrNotFound {
-			atomic.AddInt64(&s.metrics.GetMisses, 1)
-		}
-		ci.Free()
+		return err
+	}
+	if ii.Crc32 != 0 && ii.Crc32 != crc32.ChecksumIEEE(b) {
+		return ErrValueCrc
+	}
+	return nil
+}
+
+// Touch updates the ttl of the key in index only, the value is not rewritten
+func (s *Shard) Touch(key string, ttl uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ii, err := s.getIndexItem(key)
+	if err != nil {
+		return err
+	}
+	ii.Timestamp = time.Now().Unix()
+	ii.TTL = ttl
+	return s.index.Set(key, ii)
+}
+
+// Invalidate marks the item stale and bumps its cas unique, the value is kept until it's overwritten
+func (s *Shard) Invalidate(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ii, err := s.getIndexItem(key)
+	if err != nil {
+		return err
+	}
+	ii.Cas, err = s.index.NextCas()
+	if err != nil {
+		return err
+	}
+	ii.Stale = true
+	ii.TokenSent = false
+	return s.index.Set(key, ii)
+}
+
+// ClaimToken claims the token to recache the stale item,
+// it returns true only for the first caller of the item with the cas unique.
+func (s *Shard) ClaimToken(key string, cas uint64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ii, err := s.getIndexItem(key)
+	if err != nil {
+		return false, err
+	}
+	if !ii.Stale || ii.Cas != cas || ii.TokenSent {
+		return false, nil
+	}
+	ii.TokenSent = true
+	return true, s.index.Set(key, ii)
+}
+
+// stat returns the IndexItem of key without reading the value
+func (s *Shard) stat(key string) (*IndexItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getIndexItem(key)
+}
+
+// getIndexItem returns the IndexItem of key if it's validate and not expired
+func (s *Shard) getIndexItem(key string) (*IndexItem, error) {
+	ii, err := s.index.Get(key)
+	if err != nil {
 		return nil, err
 	}
-	if ii.Crc32 != 0 && ii.Crc32 != crc32.ChecksumIEEE(ci.Value) {
-		ci.Free()
-		return nil, ErrValueCrc
+	if s.isExpired(ii, time.Now().Unix()) {
+		return nil, ErrNotFound
 	}
-	atomic.AddInt64(&s.metrics.GetHits, 1)
-	return ci, nil
+	return ii, nil
 }
 
+func (s *Shard) isExpired(ii *IndexItem, now int64) bool {
+	age := now - ii.Timestamp
+	return (s.options.TTL > 0 && age >= s.options.TTL) || (ii.TTL > 0 && age > int64(ii.TTL))
+}
+
+// Del removes the key, returns ErrNotFound if the key not exists
 func (s *Shard) Del(key string) error {
 	atomic.AddInt64(&s.metrics.DelTotal, 1)
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.getIndexItem(key)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	// expired or invalid items are also removed from index
+	if er := s.index.Del(key); er != nil {
+		return er
+	}
+	return err
+}
+
+// delIfCas removes the key only if the cas unique equals to cas
+func (s *Shard) delIfCas(key string, cas uint64) error {
+	atomic.AddInt64(&s.metrics.DelTotal, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ii, err := s.getIndexItem(key)
+	if err != nil {
+		return err
+	}
+	if ii.Cas != cas {
+		return ErrCasConflict
+	}
 	return s.index.Del(key)
 }
 
+// Scan returns at most max items with prefix and key >= start in order
+func (s *Shard) Scan(prefix, start string, max int) ([]KeyInfo, error) {
+	if start < prefix {
+		start = prefix
+	}
+	var ret []KeyInfo
+	if max <= 0 {
+		return ret, nil
+	}
+	now := time.Now().Unix()
+	err := s.index.Scan(start, func(key string, ii IndexItem) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if s.isExpired(&ii, now) {
+			return true
+		}
+		ret = append(ret, KeyInfo{Key: key, Size: int64(ii.ValueSize), Timestamp: ii.Timestamp,
+			TTL: ii.TTL, Flags: ii.Flags, Cas: ii.Cas, MD5: ii.MD5, manifest: ii.Manifest})
+		return len(ret) < max
+	})
+	return ret, err
+}
+
+// Flush invalidates all items in O(1), the index entries are removed by GC lazily
+func (s *Shard) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.index.Flush(); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&s.stats.Keys, 0)
+	atomic.StoreUint64(&s.stats.Bytes, 0)
+	return nil
+}
+
 type gcstat struct {
 	Scanned     uint64
 	Purged      uint64
 	Active      uint64
 	ActiveBytes uint64
+	Sizes       [SizeClasses]uint64
 
 	LastKey    string
 	LastFinish time.Time
@@ -228,6 +690,9 @@ func (s *Shard) GCLoop() {
 		}
 		newScanned := st.Scanned - n
 		if newScanned >= scanItemsPerRound {
+			s.gcmu.Lock()
+			s.gcRound = st
+			s.gcmu.Unlock()
 			continue // scanning
 		}
 		// newScanned < scanItemsPerRound, end of index
@@ -241,10 +706,17 @@ func (s *Shard) GCLoop() {
 		atomic.StoreUint64(&s.stats.Bytes, st.ActiveBytes)
 		atomic.StoreInt64(&s.stats.LastUpdate, now.Unix())
 
+		s.gcmu.Lock()
+		s.gcLast = st
+		s.gcLast.LastFinish = now
+		s.gcRound = gcstat{}
+		s.gcmu.Unlock()
+
 		st.Scanned = 0
 		st.Purged = 0
 		st.Active = 0
 		st.ActiveBytes = 0
+		st.Sizes = [SizeClasses]uint64{}
 		st.LastKey = ""
 
 		if cost < time.Minute { // rate limit
@@ -265,8 +737,7 @@ func (s *Shard) scanKeysForGC(maxIter int, st *gcstat) error {
 	err := s.index.Iter(st.LastKey, maxIter, func(key string, ii IndexItem) error {
 		st.Scanned += 1
 		st.LastKey = key
-		age := time.Now().Unix() - ii.Timestamp
-		if (s.options.TTL > 0 && age >= s.options.TTL) || (ii.TTL > 0 && age > int64(ii.TTL)) {
+		if s.isExpired(&ii, now) {
 			st.Purged += 1
 			atomic.AddInt64(&s.metrics.Expired, 1)
 			pendingDeletes = append(pendingDeletes, key)
@@ -281,9 +752,10 @@ func (s *Shard) scanKeysForGC(maxIter int, st *gcstat) error {
 		}
 		st.Active += 1
 		st.ActiveBytes += uint64(int64(len(key)) + ii.TotalSize())
+		st.Sizes[bits.Len32(uint32(ii.ValueSize))] += 1
 		return nil
 	})
-	err2 := s.index.Dels(pendingDeletes)
+	err2 := s.index.delIndexKeys(pendingDeletes)
 	if err == nil {
 		err = err2
 	}
@@ -87,3 +87,370 @@ EndOfTest:
 		t.Fatal(err)
 	}
 }
+
+func TestShardAddReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cachedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := LoadCacheShard(filepath.Join(dir, "shard"), &ShardOptions{Size: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Replace(&Item{Key: "k1", Value: []byte("v0")}); err != ErrNotStored {
+		t.Fatal("replace should not stored", err)
+	}
+	if err := s.Add(&Item{Key: "k1", Value: []byte("v1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(&Item{Key: "k1", Value: []byte("v2")}); err != ErrNotStored {
+		t.Fatal("add should not stored", err)
+	}
+	if err := s.Replace(&Item{Key: "k1", Value: []byte("v3")}); err != nil {
+		t.Fatal(err)
+	}
+	ci, err := s.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ci.Value) != "v3" {
+		t.Fatal("value err", string(ci.Value))
+	}
+}
+
+func TestShardCompareAndSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cachedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := LoadCacheShard(filepath.Join(dir, "shard"), &ShardOptions{Size: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.CompareAndSwap(&Item{Key: "k1", Value: []byte("v0")}); err != ErrNotFound {
+		t.Fatal("cas should not found", err)
+	}
+	item := &Item{Key: "k1", Value: []byte("v1")}
+	if err := s.Set(item); err != nil {
+		t.Fatal(err)
+	}
+	cas := item.Cas
+	ci, err := s.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Cas != cas {
+		t.Fatal("cas err", ci.Cas, cas)
+	}
+	if err := s.CompareAndSwap(&Item{Key: "k1", Value: []byte("v2"), Cas: cas}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CompareAndSwap(&Item{Key: "k1", Value: []byte("v3"), Cas: cas}); err != ErrCasConflict {
+		t.Fatal("cas should conflict", err)
+	}
+	ci, err = s.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ci.Value) != "v2" || ci.Cas <= cas {
+		t.Fatal("item err", string(ci.Value), ci.Cas)
+	}
+}
+
+func TestShardAppendPrepend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cachedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := LoadCacheShard(filepath.Join(dir, "shard"), &ShardOptions{Size: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Append(&Item{Key: "k1", Value: []byte("v0")}); err != ErrNotStored {
+		t.Fatal("append should not stored", err)
+	}
+	if err := s.Set(&Item{Key: "k1", Value: []byte("b"), Flags: 7, TTL: 100, MD5: []byte("md5")}); err != nil {
+		t.Fatal(err)
+	}
+	if ci, err := s.Get("k1"); err != nil || string(ci.MD5) != "md5" {
+		t.Fatal("get err", err)
+	}
+	if err := s.Append(&Item{Key: "k1", Value: []byte("cd")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Prepend(&Item{Key: "k1", Value: []byte("a"), Flags: 1, TTL: 1}); err != nil {
+		t.Fatal(err)
+	}
+	ci, err := s.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ci.Value) != "abcd" || ci.Flags != 7 || ci.TTL != 100 || ci.MD5 != nil {
+		t.Fatal("item err", string(ci.Value), ci.Flags, ci.TTL, ci.MD5)
+	}
+}
+
+func TestShardIncrDecr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cachedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := LoadCacheShard(filepath.Join(dir, "shard"), &ShardOptions{Size: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Incr("k1", 1); err != ErrNotFound {
+		t.Fatal("incr should not found", err)
+	}
+	s.Set(&Item{Key: "k1", Value: []byte("18446744073709551614")})
+	if v, err := s.Incr("k1", 3); err != nil || v != 1 {
+		t.Fatal("incr should wrap around", v, err)
+	}
+	if v, err := s.Decr("k1", 3); err != nil || v != 0 {
+		t.Fatal("decr should stop at 0", v, err)
+	}
+	s.Set(&Item{Key: "k1", Value: []byte("12  ")})
+	if v, err := s.Decr("k1", 2); err != nil || v != 10 {
+		t.Fatal("decr err", v, err)
+	}
+	ci, err := s.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ci.Value) != "10" {
+		t.Fatal("value err", string(ci.Value))
+	}
+	s.Set(&Item{Key: "k1", Value: []byte("x")})
+	if _, err := s.Incr("k1", 1); err != ErrNotNumber {
+		t.Fatal("incr should not number", err)
+	}
+}
+
+func TestShardTouch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cachedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := LoadCacheShard(filepath.Join(dir, "shard"), &ShardOptions{Size: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Touch("k1", 100); err != ErrNotFound {
+		t.Fatal("touch should not found", err)
+	}
+	if err := s.Set(&Item{Key: "k1", Value: []byte("v1"), TTL: 1}); err != nil {
+		t.Fatal(err)
+	}
+	meta := s.index.GetIndexMeta()
+	if err := s.Touch("k1", 100); err != nil {
+		t.Fatal(err)
+	}
+	if s.index.GetIndexMeta() != meta {
+		t.Fatal("touch should not write data")
+	}
+	ci, err := s.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ci.Value) != "v1" || ci.TTL != 100 {
+		t.Fatal("item err", string(ci.Value), ci.TTL)
+	}
+}
+
+func TestShardInvalidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cachedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := LoadCacheShard(filepath.Join(dir, "shard"), &ShardOptions{Size: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Invalidate("k1"); err != ErrNotFound {
+		t.Fatal("invalidate should not found", err)
+	}
+	item := &Item{Key: "k1", Value: []byte("v1")}
+	s.Set(item)
+	cas := item.Cas
+	if err := s.Invalidate("k1"); err != nil {
+		t.Fatal(err)
+	}
+	ci, err := s.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ci.Stale || ci.Cas <= cas || string(ci.Value) != "v1" {
+		t.Fatal("item err", ci.Stale, ci.Cas, string(ci.Value))
+	}
+	if won, err := s.ClaimToken("k1", ci.Cas); err != nil || !won {
+		t.Fatal("claim token should win", err)
+	}
+	if won, err := s.ClaimToken("k1", ci.Cas); err != nil || won {
+		t.Fatal("claim token should not win", err)
+	}
+
+	// an older value is stored as stale
+	if err := s.CompareAndSwap(&Item{Key: "k1", Value: []byte("v2"), Cas: cas, Stale: true}); err != nil {
+		t.Fatal(err)
+	}
+	ci, err = s.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ci.Stale || string(ci.Value) != "v2" {
+		t.Fatal("item err", ci.Stale, string(ci.Value))
+	}
+	if err := s.CompareAndSwap(&Item{Key: "k1", Value: []byte("v3"), Cas: ci.Cas}); err != nil {
+		t.Fatal(err)
+	}
+	ci, err = s.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Stale || string(ci.Value) != "v3" {
+		t.Fatal("item err", ci.Stale, string(ci.Value))
+	}
+}
+
+func TestShardFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cachedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := LoadCacheShard(filepath.Join(dir, "shard"), &ShardOptions{Size: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// k1 in the last term, k2 in the current term
+	s.Set(&Item{Key: "k0", Value: make([]byte, 600)})
+	s.Set(&Item{Key: "k1", Value: make([]byte, 400)})
+	s.Set(&Item{Key: "k2", Value: make([]byte, 300)})
+	if _, err := s.Get("k1"); err != nil {
+		t.Fatal(err)
+	}
+	cas := s.index.GetIndexMeta().Cas
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"k1", "k2"} {
+		if _, err := s.Get(k); err != ErrNotFound {
+			t.Fatal("key should be flushed", k, err)
+		}
+	}
+	item := &Item{Key: "k1", Value: []byte("v1")}
+	s.Set(item)
+	if item.Cas <= cas {
+		t.Fatal("cas should increase after flush", item.Cas, cas)
+	}
+	ci, err := s.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ci.Value) != "v1" {
+		t.Fatal("value err", string(ci.Value))
+	}
+	if _, err := s.Get("k2"); err != ErrNotFound {
+		t.Fatal("key should be flushed", err)
+	}
+}
+
+func TestShardStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cachedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := LoadCacheShard(filepath.Join(dir, "shard"), &ShardOptions{Size: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Set(&Item{Key: "k1", Value: make([]byte, 1)})
+	s.Set(&Item{Key: "k2", Value: make([]byte, 100)})
+	s.Set(&Item{Key: "k3", Value: make([]byte, 127)})
+	s.Get("k1")
+
+	time.Sleep(200 * time.Millisecond) // wait for a gc round
+	st := s.GetStatus()
+	if st.Term != 0 || st.Head != 228 || st.DataSize != 1024 || st.Cas != 3 {
+		t.Fatal("status err", st)
+	}
+	if st.GCLastFinish == 0 {
+		t.Fatal("gc not finished")
+	}
+	if st.Sizes[1] != 1 || st.Sizes[7] != 2 {
+		t.Fatal("sizes err", st.Sizes)
+	}
+
+	if m := s.GetMetrics(); m.SetTotal != 3 || m.GetHits != 1 {
+		t.Fatal("metrics err", m)
+	}
+	s.ResetMetrics()
+	if m := s.GetMetrics(); m != (CacheMetrics{}) {
+		t.Fatal("metrics not reset", m)
+	}
+}
+
+func TestShardGetRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cachedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := LoadCacheShard(filepath.Join(dir, "shard"), &ShardOptions{Size: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, _, err := s.GetRange("k1", 0, 1); err != ErrNotFound {
+		t.Fatal("should not found", err)
+	}
+	s.Set(&Item{Key: "k1", Value: []byte("0123456789"), Flags: 7})
+	for _, tc := range []struct {
+		off, n int64
+		value  string
+	}{
+		{0, 10, "0123456789"},
+		{0, 100, "0123456789"},
+		{2, 3, "234"},
+		{8, 100, "89"},
+		{10, 1, ""},
+		{-3, 100, "789"},
+		{-100, 2, "01"},
+	} {
+		ci, size, err := s.GetRange("k1", tc.off, tc.n)
+		if err != nil {
+			t.Fatal(tc.off, tc.n, err)
+		}
+		if size != 10 || string(ci.Value) != tc.value || ci.Flags != 7 {
+			t.Fatal("get range err", tc.off, tc.n, size, string(ci.Value))
+		}
+		ci.Free()
+	}
+	if _, size, err := s.GetRange("k1", 11, 1); err != ErrInvalidRange || size != 10 {
+		t.Fatal("should invalid range", err, size)
+	}
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const writerChunkSize = 64 << 10
+
+// ValueWriter streams the value of an item into the cache without buffering the whole value,
+// the item is stored by Commit after all reserved bytes are written.
+type ValueWriter interface {
+	io.Writer
+	io.ReaderFrom
+	Commit(mode StoreMode) error
+}
+
+// ItemWriter writes a value to the space reserved in the data file of a shard
+type ItemWriter struct {
+	s   *Shard
+	ci  *Item
+	ii  *IndexItem
+	n   int64 // bytes written
+	crc uint32
+}
+
+// NewWriter reserves n bytes in the data file for the value of ci.
+// the Key, TTL, Flags, Stale and MD5 of ci are stored by Commit, and ci.Value is not used.
+func (s *Shard) NewWriter(ci *Item, n int64) (*ItemWriter, error) {
+	atomic.AddInt64(&s.metrics.SetTotal, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ii, err := s.reserve(int32(n))
+	if err != nil {
+		return nil, err
+	}
+	return &ItemWriter{s: s, ci: ci, ii: ii}, nil
+}
+
+// Write writes p to the data file at the current offset.
+// it fails with ErrOverwritten if the reserved space is reused by later items of the ring.
+func (w *ItemWriter) Write(p []byte) (int, error) {
+	if w.n+int64(len(p)) > int64(w.ii.ValueSize) {
+		return 0, ErrValueSize
+	}
+	s := w.s
+	// the space only can be reserved by others with s.mu locked
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.index.GetIndexMeta().IsValidate(*w.ii) {
+		return 0, ErrOverwritten
+	}
+	if err := s.data.Write(w.ii.Offset+w.n, p); err != nil {
+		return 0, err
+	}
+	w.crc = crc32.Update(w.crc, crc32.IEEETable, p)
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// ReadFrom copies the rest of value from r in chunks
+func (w *ItemWriter) ReadFrom(r io.Reader) (int64, error) {
+	item := w.s.options.Allocator.Alloc(writerChunkSize)
+	defer item.Free()
+	var total int64
+	for w.n < int64(w.ii.ValueSize) {
+		b := item.Value
+		if left := int64(w.ii.ValueSize) - w.n; left < int64(len(b)) {
+			b = b[:left]
+		}
+		n, err := io.ReadFull(r, b)
+		if n > 0 {
+			if _, err := w.Write(b[:n]); err != nil {
+				return total, err
+			}
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Commit stores the item if the condition of mode is satisfied, the item gets a new cas unique.
+func (w *ItemWriter) Commit(mode StoreMode) error {
+	if w.n != int64(w.ii.ValueSize) {
+		return ErrShortValue
+	}
+	s := w.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.index.GetIndexMeta().IsValidate(*w.ii) {
+		return ErrOverwritten
+	}
+	if err := s.checkStore(w.ci, mode); err != nil {
+		return err
+	}
+	// the cas unique of reserving may be older than the items stored during writing
+	cas, err := s.index.NextCas()
+	if err != nil {
+		return err
+	}
+	ii := w.ii
+	ii.Cas = cas
+	ii.Timestamp = time.Now().Unix()
+	ii.TTL = w.ci.TTL
+	ii.Flags = w.ci.Flags
+	ii.Stale = w.ci.Stale
+	ii.MD5 = w.ci.MD5
+	ii.Crc32 = w.crc
+	if err := s.index.Set(w.ci.Key, ii); err != nil {
+		return err
+	}
+	w.ci.Cas = cas
+	return nil
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestItemWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cachedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := LoadCacheShard(filepath.Join(dir, "shard"), &ShardOptions{Size: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	v := make([]byte, 300<<10) // more than one chunk
+	rand.Read(v)
+	item := &Item{Key: "k1", Flags: 7}
+	w, err := s.NewWriter(item, int64(len(v)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(v[:100]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(StoreSet); err != ErrShortValue {
+		t.Fatal("commit should be short", err)
+	}
+	if _, err := s.Get("k1"); err != ErrNotFound {
+		t.Fatal("item should not be stored before commit", err)
+	}
+	if n, err := w.ReadFrom(bytes.NewReader(v[100:])); err != nil || n != int64(len(v)-100) {
+		t.Fatal("read from err", n, err)
+	}
+	if _, err := w.Write([]byte("x")); err != ErrValueSize {
+		t.Fatal("write should exceed", err)
+	}
+	if err := w.Commit(StoreAdd); err != nil {
+		t.Fatal(err)
+	}
+	ci, err := s.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ci.Value, v) || ci.Flags != 7 || ci.Cas != item.Cas {
+		t.Fatal("item err", ci.Flags, ci.Cas, item.Cas)
+	}
+
+	// the condition is checked by commit
+	w, _ = s.NewWriter(&Item{Key: "k1"}, 1)
+	w.Write([]byte("x"))
+	if err := w.Commit(StoreAdd); err != ErrNotStored {
+		t.Fatal("add should not stored", err)
+	}
+	w, _ = s.NewWriter(&Item{Key: "k1", Cas: item.Cas}, 1)
+	w.Write([]byte("x"))
+	s.Set(&Item{Key: "k1", Value: []byte("y")}) // cas changed while writing
+	if err := w.Commit(StoreCAS); err != ErrCasConflict {
+		t.Fatal("cas should conflict", err)
+	}
+
+	// the reserved space is overwritten by later items of the ring
+	w, _ = s.NewWriter(&Item{Key: "k2"}, 600<<10)
+	if err := s.Set(&Item{Key: "k3", Value: make([]byte, 600<<10)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("x")); err != ErrOverwritten {
+		t.Fatal("write should be overwritten", err)
+	}
+	if _, err := s.Get("k3"); err != nil {
+		t.Fatal(err)
+	}
+}
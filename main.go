@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/xiaost/blobcached/cache"
 	"github.com/xiaost/blobcached/server"
@@ -15,19 +19,80 @@ const VERSION = "0.1.1-dev"
 func main() {
 	var (
 		bindAddr    string
+		binAddr     string
+		udpAddr     string
+		httpAddr    string
+		redisAddr   string
+		s3Addr      string
 		cachePath   string
 		cacheSize   int64
 		cacheShards int64
 		cacheTTL    int64
+		hashKeyLen  int
 		bufsize     int
+		verbosity   int
 
-		printVersion bool
+		s3Options server.S3Options
+
+		tlsOptions server.TLSOptions
+
+		enableShutdown  bool
+		skipSendfileCrc bool
+		printVersion    bool
 	)
 
 	flag.StringVar(&bindAddr,
 		"addr", ":11211",
 		"the addr that blobcached listen on.")
 
+	flag.StringVar(&binAddr,
+		"binaddr", "",
+		"the additional addr for the memcached binary protocol, which is also served on -addr.")
+
+	flag.StringVar(&udpAddr,
+		"udpaddr", "",
+		"the addr for get and gets of the memcached udp protocol, disabled if empty. it can amplify traffic to spoofed source addrs, only listen on trusted networks.")
+
+	flag.StringVar(&httpAddr,
+		"httpaddr", "",
+		"the addr for the http api, disabled if empty.")
+
+	flag.StringVar(&redisAddr,
+		"redisaddr", "",
+		"the addr for the redis protocol (RESP2/RESP3) of string commands, disabled if empty.")
+
+	flag.StringVar(&s3Addr,
+		"s3addr", "",
+		"the addr for the s3 compatible api, disabled if empty.")
+
+	flag.StringVar(&s3Options.AccessKey,
+		"s3-access-key", "",
+		"the access key of the s3 api, requests must be signed with AWS SigV4 if set.")
+
+	flag.StringVar(&s3Options.SecretKey,
+		"s3-secret-key", "",
+		"the secret key of the s3 api.")
+
+	flag.StringVar(&s3Options.Region,
+		"s3-region", "us-east-1",
+		"the region of the s3 api used by AWS SigV4.")
+
+	flag.StringVar(&tlsOptions.CertFile,
+		"tls-cert", "",
+		"the certificate file in PEM, the tcp listeners are served over TLS if set. reloaded on SIGHUP.")
+
+	flag.StringVar(&tlsOptions.KeyFile,
+		"tls-key", "",
+		"the private key file of -tls-cert in PEM.")
+
+	flag.StringVar(&tlsOptions.CAFile,
+		"tls-ca", "",
+		"the CA file in PEM for verifying client certificates.")
+
+	flag.BoolVar(&tlsOptions.VerifyClient,
+		"tls-verify-client", false,
+		"require client certificates signed by -tls-ca, -udpaddr is refused with it.")
+
 	flag.StringVar(&cachePath,
 		"path", "cachedata",
 		"the cache path used by blobcached to store items.")
@@ -44,10 +109,26 @@ func main() {
 		"ttl", 0,
 		"the global ttl of cache items.")
 
+	flag.IntVar(&hashKeyLen,
+		"hash-key-len", 0,
+		"keys longer than it are stored in the index under their digests, which allows long keys. 0 for disabled.")
+
 	flag.IntVar(&bufsize,
 		"buf", 4096,
 		"default buffer size used by get/set.")
 
+	flag.IntVar(&verbosity,
+		"verbosity", server.LogError,
+		"log level, 0: errors, 1: connections, 2: requests. changed by the verbosity command at runtime.")
+
+	flag.BoolVar(&enableShutdown,
+		"enable-shutdown", false,
+		"enable the shutdown command to stop blobcached gracefully.")
+
+	flag.BoolVar(&skipSendfileCrc,
+		"sendfile-skip-crc", false,
+		"skip verifying the checksum of large values sent by sendfile.")
+
 	flag.BoolVar(&printVersion, "v", false,
 		"print the version and exit")
 
@@ -58,11 +139,33 @@ func main() {
 		return
 	}
 
-	l, err := net.Listen("tcp", bindAddr)
-	if err != nil {
-		log.Fatal(err)
+	// the udp listener has no client authentication, it would bypass the client certificates
+	if tlsOptions.VerifyClient && udpAddr != "" {
+		log.Fatal("-udpaddr can not be used with -tls-verify-client")
 	}
 
+	var tlsConfig *server.TLSConfig
+	if tlsOptions.CertFile != "" {
+		var err error
+		if tlsConfig, err = server.NewTLSConfig(&tlsOptions); err != nil {
+			log.Fatal(err)
+		}
+		go reloadTLSConfig(tlsConfig)
+	}
+	// listen returns a tcp listener of addr, over TLS if enabled
+	listen := func(addr string) net.Listener {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tlsConfig != nil {
+			l = tlsConfig.NewListener(l)
+		}
+		return l
+	}
+
+	l := listen(bindAddr)
+
 	// cacheSize: limit to [2*MaxValueSize, +)
 	if cacheSize <= 2*cache.MaxValueSize {
 		cacheSize = 2 * cache.MaxValueSize
@@ -90,11 +193,91 @@ func main() {
 		Size:      cacheSize,
 		TTL:       cacheTTL,
 		Allocator: allocator,
+
+		HashKeyLen: hashKeyLen,
 	}
 	c, err := cache.NewCache(cachePath, options)
 	if err != nil {
 		log.Fatal(err)
 	}
-	s := server.NewMemcacheServer(l, c, allocator)
-	log.Fatal(s.Serv())
+	soptions := &server.ServerOptions{
+		Version:         VERSION,
+		Verbosity:       verbosity,
+		EnableShutdown:  enableShutdown,
+		SkipSendfileCrc: skipSendfileCrc,
+	}
+	s := server.NewMemcacheServer(l, c, allocator, soptions)
+	if binAddr != "" {
+		bl := listen(binAddr)
+		go func() {
+			if err := s.ServListener(bl); err != server.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if udpAddr != "" {
+		pc, err := net.ListenPacket("udp", udpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := s.ServUDP(pc); err != server.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if redisAddr != "" {
+		rl := listen(redisAddr)
+		go func() {
+			if err := s.ServRedis(rl); err != server.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	var hs *server.HTTPServer
+	if httpAddr != "" {
+		hl := listen(httpAddr)
+		hs = server.NewHTTPServer(hl, c, allocator)
+		go func() {
+			if err := hs.Serv(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	var s3s *server.S3Server
+	if s3Addr != "" {
+		sl := listen(s3Addr)
+		s3s = server.NewS3Server(sl, c, allocator, &s3Options)
+		go func() {
+			if err := s3s.Serv(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if err := s.Serv(); err != server.ErrServerClosed {
+		log.Fatal(err)
+	}
+	if hs != nil {
+		hs.Shutdown()
+	}
+	if s3s != nil {
+		s3s.Shutdown()
+	}
+	if err := c.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("blobcached shutdown")
+}
+
+// reloadTLSConfig reloads the certificates of c on SIGHUP, existing connections are not affected
+func reloadTLSConfig(c *server.TLSConfig) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := c.Reload(); err != nil {
+			log.Printf("reload tls config err: %s", err)
+			continue
+		}
+		log.Printf("tls config reloaded")
+	}
 }
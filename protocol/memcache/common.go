@@ -1,5 +1,7 @@
 package memcache
 
+import "strings"
+
 var (
 	RspErr       = []byte("ERROR\r\n")
 	RspStored    = []byte("STORED\r\n")
@@ -9,6 +11,14 @@ var (
 	RspDeleted   = []byte("DELETED\r\n")
 	RspEnd       = []byte("END\r\n")
 	RspTouched   = []byte("TOUCHED\r\n")
+	RspOK        = []byte("OK\r\n")
+	RspReset     = []byte("RESET\r\n")
+
+	RspShutdownDisabled = []byte("ERROR: shutdown not enabled\r\n")
+
+	// meta commands
+	RspMetaEN = []byte("EN\r\n")
+	RspMetaMN = []byte("MN\r\n")
 
 	EOL = []byte("\r\n")
 )
@@ -26,9 +36,44 @@ type CommandInfo struct {
 	Key        string
 	Keys       []string // for retrieval commands
 	Delta      uint64   // for incr/decr
+	Offset     int64    // for getrange
+	Length     int64    // for getrange
+	Part       int      // for mpput, or the number of parts for mpcommit
+	Level      uint32   // for verbosity
 	Flags      uint32
-	Exptime    uint32
+	Exptime    uint32 // or the delay of flush_all
 	PayloadLen int64
-	CasUnique  int64
+	CasUnique  uint64
 	NoReply    bool
+	MetaFlags  []MetaFlag // for meta commands
+}
+
+// MetaFlag is a flag of meta commands, like `v`, `T30` or `Oopaque`
+type MetaFlag struct {
+	Flag  byte
+	Token string
+}
+
+// MetaFlag returns the token of the meta flag f, ok is false if f not exists
+func (c *CommandInfo) MetaFlag(f byte) (token string, ok bool) {
+	for _, mf := range c.MetaFlags {
+		if mf.Flag == f {
+			return mf.Token, true
+		}
+	}
+	return "", false
+}
+
+// CloneKeys copies Key and Keys, which are views of the buffer of Parser and overwritten by the next Parse
+func (c *CommandInfo) CloneKeys() {
+	c.Key = strings.Clone(c.Key)
+	for i, k := range c.Keys {
+		c.Keys[i] = strings.Clone(k)
+	}
+}
+
+// HasMetaFlag returns true if the meta flag f exists
+func (c *CommandInfo) HasMetaFlag(f byte) bool {
+	_, ok := c.MetaFlag(f)
+	return ok
 }
@@ -2,159 +2,462 @@ package memcache
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
-	"fmt"
+	"math"
+	"unsafe"
 )
 
+// MaxKeyLen is the max length of keys, same as memcached
+const MaxKeyLen = 250
+
 var (
 	ErrNeedMoreData = errors.New("need more data")
 
 	errCommand = errors.New("command err")
+	errKey     = errors.New("invalid key")
 )
 
+// commands are the names of supported commands, CommandInfo.Cmd is always one of them
+var commands = []string{
+	"set", "add", "replace", "append", "prepend", "cas",
+	"get", "gets", "gat", "gats", "getrange",
+	"mpbegin", "mpput", "mpcommit", "mpabort",
+	"delete", "incr", "decr", "touch", "flush_all", "verbosity",
+	"mg", "ms", "md", "ma", "mn", "me",
+	"stats", "version", "quit", "shutdown",
+}
+
+var norepl = []byte("noreply")
+
 // ParseCommand parses cmd from `data` and return CommandInfo
 // return ErrNeedMoreData if data not contains '\n'
 // implements: https://github.com/memcached/memcached/blob/master/doc/protocol.txt
 func ParseCommand(data []byte) (advance int, cmdinfo *CommandInfo, err error) {
+	var p Parser
+	return p.Parse(data)
+}
+
+// Parser parses commands like ParseCommand, but reuses the CommandInfo and buffers across calls,
+// so it does not allocate after the buffers grown to fit the commands.
+// the strings of the returned CommandInfo refer to the buffer of the parser except Cmd,
+// they are only valid until the next Parse, and must be copied to be retained, see CommandInfo.CloneKeys.
+type Parser struct {
+	MaxKeyLen int // the max length of keys, MaxKeyLen if 0
+
+	cmd  CommandInfo
+	buf  []byte   // copy of the line
+	args [][]byte // tokens of the line
+	key  []byte   // decoded base64 key of meta commands
+}
+
+// Parse parses a command from data, the returned CommandInfo is reused by the next Parse
+func (p *Parser) Parse(data []byte) (advance int, cmdinfo *CommandInfo, err error) {
 	idx := bytes.IndexByte(data, '\n')
 	if idx < 0 {
 		return 0, nil, ErrNeedMoreData
 	}
 	advance = idx + 1
-	left := bytes.TrimSpace(data[:advance])
-	if len(left) == 0 {
+	line := data[:idx]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	p.buf = append(p.buf[:0], line...)
+	p.args = p.args[:0]
+	for b := p.buf; len(b) > 0; {
+		i := bytes.IndexByte(b, ' ')
+		if i < 0 {
+			i = len(b)
+		}
+		if i > 0 {
+			p.args = append(p.args, b[:i:i])
+		}
+		if i < len(b) {
+			i++
+		}
+		b = b[i:]
+	}
+	if len(p.args) == 0 {
 		return advance, nil, errCommand
 	}
 
-	var cmd string
-	idx = bytes.IndexByte(left, ' ')
-	if idx < 0 { // single cmd
-		cmd = string(left)
-		left = left[0:0]
-	} else {
-		cmd = string(left[:idx])
-		left = left[idx+1:] // remove cmd
+	c := &p.cmd
+	*c = CommandInfo{Keys: c.Keys[:0], MetaFlags: c.MetaFlags[:0]}
+	for _, name := range commands {
+		if string(p.args[0]) == name {
+			c.Cmd = name
+			break
+		}
 	}
-
-	var parser func(cmd string, left []byte) (*CommandInfo, error)
-	switch cmd {
+	args := p.args[1:]
+	switch c.Cmd {
 	case "set", "add", "replace", "append", "prepend", "cas":
-		parser = parseStorageCommands
+		err = p.parseStorageCommands(c, args)
 	case "get", "gets":
-		parser = parseRetrievalCommands
+		err = p.parseRetrievalCommands(c, args)
+	case "gat", "gats":
+		err = p.parseGatCommands(c, args)
+	case "getrange":
+		err = p.parseGetRangeCommand(c, args)
+	case "mpbegin", "mpput", "mpcommit", "mpabort":
+		err = p.parseMultipartCommands(c, args)
 	case "delete":
-		parser = parseDeleteCommand
+		err = p.parseDeleteCommand(c, args)
 	case "incr", "decr":
-		parser = parseIncrDecrCommands
+		err = p.parseIncrDecrCommands(c, args)
 	case "touch":
-		parser = parseTouchCommand
+		err = p.parseTouchCommand(c, args)
+	case "flush_all":
+		err = parseFlushAllCommand(c, args)
+	case "verbosity":
+		err = parseVerbosityCommand(c, args)
+	case "mg", "ms", "md", "ma", "mn", "me":
+		err = p.parseMetaCommands(c, args)
 	default:
-		parser = parseOtherCommands
+		err = parseOtherCommands(c, args)
+	}
+	if err != nil {
+		return advance, nil, err
 	}
-	cmdinfo, err = parser(cmd, left)
-	return advance, cmdinfo, err
+	return advance, c, nil
 }
 
-var (
-	norepl = []byte("noreply")
-)
+// str returns the string of b without copying, b must not be changed before the next Parse
+func str(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(&b[0], len(b))
+}
 
-// parse:
-// <command name> <key> <flags> <exptime> <bytes> [noreply]
-// cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
-func parseStorageCommands(cmd string, line []byte) (*CommandInfo, error) {
-	c := CommandInfo{Cmd: cmd}
-
-	if cmd != "cas" {
-		n, _ := fmt.Sscanf(string(line), "%s %d %d %d",
-			&c.Key, &c.Flags, &c.Exptime, &c.PayloadLen)
-		if n != 4 {
-			return nil, errCommand
+// maxKeyLen returns the max length of keys of p
+func (p *Parser) maxKeyLen() int {
+	if p.MaxKeyLen > 0 {
+		return p.MaxKeyLen
+	}
+	return MaxKeyLen
+}
+
+// parseKey returns the key of b, keys are at most maxKeyLen bytes without control characters
+func (p *Parser) parseKey(b []byte) (string, error) {
+	if len(b) == 0 || len(b) > p.maxKeyLen() {
+		return "", errKey
+	}
+	for _, ch := range b {
+		if ch < ' ' || ch == 0x7f {
+			return "", errKey
+		}
+	}
+	return str(b), nil
+}
+
+// parseUint parses the decimal number of b which is not larger than max
+func parseUint(b []byte, max uint64) (uint64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	var n uint64
+	for _, ch := range b {
+		if ch < '0' || ch > '9' {
+			return 0, false
 		}
-	} else {
-		n, _ := fmt.Sscanf(string(line), "%s %d %d %d %d",
-			&c.Key, &c.Flags, &c.Exptime, &c.PayloadLen, &c.CasUnique)
-		if n != 5 {
-			return nil, errCommand
+		d := uint64(ch - '0')
+		if n > (max-d)/10 {
+			return 0, false
 		}
+		n = n*10 + d
 	}
-	if bytes.HasSuffix(line, norepl) {
+	return n, true
+}
+
+func parseUint32(b []byte, v *uint32) bool {
+	n, ok := parseUint(b, math.MaxUint32)
+	*v = uint32(n)
+	return ok
+}
+
+func parseInt64(b []byte, v *int64) bool {
+	n, ok := parseUint(b, math.MaxInt64)
+	*v = int64(n)
+	return ok
+}
+
+// trimNoReply removes the optional `noreply` after n arguments
+func trimNoReply(c *CommandInfo, args [][]byte, n int) [][]byte {
+	if len(args) == n+1 && bytes.Equal(args[n], norepl) {
 		c.NoReply = true
+		return args[:n]
 	}
-	return &c, nil
+	return args
+}
+
+// parse:
+// <command name> <key> <flags> <exptime> <bytes> [noreply]
+// cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+func (p *Parser) parseStorageCommands(c *CommandInfo, args [][]byte) error {
+	n := 4
+	if c.Cmd == "cas" {
+		n = 5
+	}
+	args = trimNoReply(c, args, n)
+	if len(args) != n {
+		return errCommand
+	}
+	var err error
+	if c.Key, err = p.parseKey(args[0]); err != nil {
+		return err
+	}
+	if !parseUint32(args[1], &c.Flags) || !parseUint32(args[2], &c.Exptime) || !parseInt64(args[3], &c.PayloadLen) {
+		return errCommand
+	}
+	if n == 5 {
+		var ok bool
+		if c.CasUnique, ok = parseUint(args[4], math.MaxUint64); !ok {
+			return errCommand
+		}
+	}
+	return nil
 }
 
 // parse:
 // get <key>*
 // gets <key>*
-func parseRetrievalCommands(cmd string, line []byte) (*CommandInfo, error) {
-	if len(line) == 0 {
-		return nil, errCommand
+func (p *Parser) parseRetrievalCommands(c *CommandInfo, args [][]byte) error {
+	if len(args) == 0 {
+		return errCommand
 	}
-	bb := bytes.Split(line, []byte(" "))
-	c := CommandInfo{Cmd: cmd}
-	c.Keys = make([]string, 0, len(bb))
-	for _, b := range bb {
-		c.Keys = append(c.Keys, string(b))
+	for _, b := range args {
+		key, err := p.parseKey(b)
+		if err != nil {
+			return err
+		}
+		c.Keys = append(c.Keys, key)
 	}
 	c.Key = c.Keys[0]
-	return &c, nil
+	return nil
 }
 
 // parse:
-// delete <key> [noreply]
-func parseDeleteCommand(cmd string, line []byte) (*CommandInfo, error) {
-	c := CommandInfo{Cmd: cmd}
-	bb := bytes.Split(line, []byte(" "))
-	c.Key = string(bb[0])
-	if len(bb) == 1 {
-		return &c, nil
+// gat <exptime> <key>*
+// gats <exptime> <key>*
+func (p *Parser) parseGatCommands(c *CommandInfo, args [][]byte) error {
+	if len(args) < 2 || !parseUint32(args[0], &c.Exptime) {
+		return errCommand
 	}
-	if len(bb) != 2 || !bytes.Equal(bb[1], norepl) {
-		return nil, errCommand
+	return p.parseRetrievalCommands(c, args[1:])
+}
+
+// parse:
+// getrange <key> <offset> <length>
+func (p *Parser) parseGetRangeCommand(c *CommandInfo, args [][]byte) error {
+	if len(args) != 3 {
+		return errCommand
+	}
+	var err error
+	if c.Key, err = p.parseKey(args[0]); err != nil {
+		return err
+	}
+	if !parseInt64(args[1], &c.Offset) || !parseInt64(args[2], &c.Length) {
+		return errCommand
+	}
+	return nil
+}
+
+// parse:
+// mpbegin <key>
+// mpput <upload id> <part> <bytes> [noreply]
+// mpcommit <upload id> <parts> <flags> <exptime> [noreply]
+// mpabort <upload id> [noreply]
+func (p *Parser) parseMultipartCommands(c *CommandInfo, args [][]byte) error {
+	var n int
+	switch c.Cmd {
+	case "mpbegin":
+		n = 1
+	case "mpput":
+		n = 3
+	case "mpcommit":
+		n = 4
+	case "mpabort":
+		n = 1
+	}
+	if c.Cmd != "mpbegin" {
+		args = trimNoReply(c, args, n)
+	}
+	if len(args) != n {
+		return errCommand
+	}
+	var err error
+	if c.Key, err = p.parseKey(args[0]); err != nil {
+		return err
+	}
+	if n == 1 {
+		return nil
 	}
-	c.NoReply = true
-	return &c, nil
+	part, ok := parseUint(args[1], math.MaxInt32)
+	if !ok {
+		return errCommand
+	}
+	c.Part = int(part)
+	if c.Cmd == "mpput" && !parseInt64(args[2], &c.PayloadLen) {
+		return errCommand
+	}
+	if c.Cmd == "mpcommit" && (!parseUint32(args[2], &c.Flags) || !parseUint32(args[3], &c.Exptime)) {
+		return errCommand
+	}
+	return nil
+}
+
+// parse:
+// delete <key> [noreply]
+func (p *Parser) parseDeleteCommand(c *CommandInfo, args [][]byte) error {
+	args = trimNoReply(c, args, 1)
+	if len(args) != 1 {
+		return errCommand
+	}
+	var err error
+	c.Key, err = p.parseKey(args[0])
+	return err
 }
 
 // parse:
 // incr <key> <value> [noreply]
 // decr <key> <value> [noreply]
-func parseIncrDecrCommands(cmd string, line []byte) (*CommandInfo, error) {
-	c := CommandInfo{Cmd: cmd}
-	n, _ := fmt.Sscanf(string(line), "%s %d", &c.Key, &c.Delta)
-	if n != 2 {
-		return nil, errCommand
+func (p *Parser) parseIncrDecrCommands(c *CommandInfo, args [][]byte) error {
+	args = trimNoReply(c, args, 2)
+	if len(args) != 2 {
+		return errCommand
 	}
-	if bytes.HasSuffix(line, norepl) {
-		c.NoReply = true
+	var err error
+	if c.Key, err = p.parseKey(args[0]); err != nil {
+		return err
+	}
+	var ok bool
+	if c.Delta, ok = parseUint(args[1], math.MaxUint64); !ok {
+		return errCommand
 	}
-	return &c, nil
+	return nil
 }
 
 // parse:
 // touch <key> <exptime> [noreply]
-func parseTouchCommand(cmd string, line []byte) (*CommandInfo, error) {
-	c := CommandInfo{Cmd: cmd}
-	n, _ := fmt.Sscanf(string(line), "%s %d", &c.Key, &c.Exptime)
-	if n != 2 {
-		return nil, errCommand
+func (p *Parser) parseTouchCommand(c *CommandInfo, args [][]byte) error {
+	args = trimNoReply(c, args, 2)
+	if len(args) != 2 {
+		return errCommand
 	}
-	if bytes.HasSuffix(line, norepl) {
+	var err error
+	if c.Key, err = p.parseKey(args[0]); err != nil {
+		return err
+	}
+	if !parseUint32(args[1], &c.Exptime) {
+		return errCommand
+	}
+	return nil
+}
+
+// parse:
+// flush_all [delay] [noreply]
+func parseFlushAllCommand(c *CommandInfo, args [][]byte) error {
+	if len(args) > 0 && bytes.Equal(args[len(args)-1], norepl) {
 		c.NoReply = true
+		args = args[:len(args)-1]
+	}
+	if len(args) > 1 {
+		return errCommand
+	}
+	if len(args) == 1 && !parseUint32(args[0], &c.Exptime) {
+		return errCommand
+	}
+	return nil
+}
+
+// parse:
+// mg <key> <flags>*
+// ms <key> <datalen> <flags>*
+// md <key> <flags>*
+// ma <key> <flags>*
+// me <key> [b]
+// mn
+func (p *Parser) parseMetaCommands(c *CommandInfo, args [][]byte) error {
+	if c.Cmd == "mn" {
+		if len(args) != 0 {
+			return errCommand
+		}
+		return nil
+	}
+	if len(args) == 0 {
+		return errCommand
+	}
+	key := args[0]
+	args = args[1:]
+	if c.Cmd == "ms" {
+		if len(args) == 0 || !parseInt64(args[0], &c.PayloadLen) {
+			return errCommand
+		}
+		args = args[1:]
+	}
+	for _, b := range args {
+		f := b[0]
+		if !('a' <= f && f <= 'z' || 'A' <= f && f <= 'Z') {
+			return errCommand
+		}
+		c.MetaFlags = append(c.MetaFlags, MetaFlag{Flag: f, Token: str(b[1:])})
+	}
+	if !c.HasMetaFlag('b') {
+		var err error
+		c.Key, err = p.parseKey(key)
+		return err
+	}
+	// base64 encoded key, which may contain any bytes
+	max := p.maxKeyLen()
+	n := base64.StdEncoding.DecodedLen(len(key))
+	if n > max+2 { // DecodedLen may be 2 bytes more for paddings
+		return errKey
+	}
+	if cap(p.key) < n {
+		p.key = make([]byte, max+2)
 	}
-	return &c, nil
+	n, err := base64.StdEncoding.Decode(p.key[:n], key)
+	if err != nil || n == 0 {
+		return errCommand
+	}
+	if n > max {
+		return errKey
+	}
+	c.Key = str(p.key[:n])
+	return nil
 }
 
-func parseOtherCommands(cmd string, line []byte) (*CommandInfo, error) {
-	c := CommandInfo{Cmd: cmd}
-	if cmd == "stats" {
-		bb := bytes.Split(line, []byte(" "))
-		c.Keys = make([]string, len(bb), len(bb))
-		for i, b := range bb {
-			c.Keys[i] = string(b)
+// parse:
+// verbosity <level> [noreply]
+func parseVerbosityCommand(c *CommandInfo, args [][]byte) error {
+	args = trimNoReply(c, args, 1)
+	if len(args) != 1 || !parseUint32(args[0], &c.Level) {
+		return errCommand
+	}
+	return nil
+}
+
+// parse:
+// stats [args]
+// version
+// quit
+// shutdown [graceful]
+func parseOtherCommands(c *CommandInfo, args [][]byte) error {
+	switch c.Cmd {
+	case "stats":
+		for _, b := range args {
+			c.Keys = append(c.Keys, str(b))
+		}
+		return nil
+	case "version", "quit":
+		if len(args) == 0 {
+			return nil
+		}
+	case "shutdown": // always graceful
+		if len(args) == 0 || len(args) == 1 && string(args[0]) == "graceful" {
+			return nil
 		}
-		return &c, nil
 	}
-	return nil, errCommand
+	return errCommand
 }
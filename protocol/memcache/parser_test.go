@@ -1,6 +1,12 @@
 package memcache
 
-import "testing"
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestParseSet(t *testing.T) {
 	b := []byte("set k1 1 2 3 noreply\r\nxxx\r\n")
@@ -90,6 +96,79 @@ func TestParseGet(t *testing.T) {
 	}
 }
 
+func TestParseGat(t *testing.T) {
+	b := []byte("gats 100 k1 k2\r\nxxx\r\n")
+	advance, cmd, err := ParseCommand(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Cmd != "gats" {
+		t.Fatal("cmd err", cmd.Cmd)
+	}
+	if cmd.Exptime != 100 {
+		t.Fatal("exptime err", cmd.Exptime)
+	}
+	if len(cmd.Keys) != 2 || cmd.Keys[0] != "k1" || cmd.Keys[1] != "k2" {
+		t.Fatal("keys err", cmd.Keys)
+	}
+	if string(b[advance:]) != "xxx\r\n" {
+		t.Fatal("left buf err", string(b[advance:]))
+	}
+
+	if _, _, err := ParseCommand([]byte("gat 100\r\n")); err != errCommand {
+		t.Fatal("err != errCommand", err)
+	}
+}
+
+func TestParseGetRange(t *testing.T) {
+	b := []byte("getrange k1 100 20\r\nxxx\r\n")
+	advance, cmd, err := ParseCommand(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Cmd != "getrange" || cmd.Key != "k1" {
+		t.Fatal("cmd err", cmd.Cmd, cmd.Key)
+	}
+	if cmd.Offset != 100 || cmd.Length != 20 {
+		t.Fatal("range err", cmd.Offset, cmd.Length)
+	}
+	if string(b[advance:]) != "xxx\r\n" {
+		t.Fatal("left buf err", string(b[advance:]))
+	}
+
+	for _, s := range []string{"getrange k1 100\r\n", "getrange k1 -1 20\r\n", "getrange k1 0 x\r\n", "getrange k1 0 1 2\r\n"} {
+		if _, _, err := ParseCommand([]byte(s)); err != errCommand {
+			t.Fatal("err != errCommand", s, err)
+		}
+	}
+}
+
+func TestParseMultipart(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		cmd  CommandInfo
+	}{
+		{"mpbegin k1\r\n", CommandInfo{Cmd: "mpbegin", Key: "k1"}},
+		{"mpput 0a1b 2 100\r\n", CommandInfo{Cmd: "mpput", Key: "0a1b", Part: 2, PayloadLen: 100}},
+		{"mpput 0a1b 2 100 noreply\r\n", CommandInfo{Cmd: "mpput", Key: "0a1b", Part: 2, PayloadLen: 100, NoReply: true}},
+		{"mpcommit 0a1b 3 5 60\r\n", CommandInfo{Cmd: "mpcommit", Key: "0a1b", Part: 3, Flags: 5, Exptime: 60}},
+		{"mpabort 0a1b noreply\r\n", CommandInfo{Cmd: "mpabort", Key: "0a1b", NoReply: true}},
+	} {
+		_, cmd, err := ParseCommand([]byte(tc.line))
+		if err != nil {
+			t.Fatal(tc.line, err)
+		}
+		if !reflect.DeepEqual(*cmd, tc.cmd) {
+			t.Fatalf("%q: %+v != %+v", tc.line, *cmd, tc.cmd)
+		}
+	}
+	for _, s := range []string{"mpbegin\r\n", "mpbegin k1 noreply\r\n", "mpput 0a1b 2\r\n", "mpput 0a1b x 100\r\n", "mpput 0a1b 1 -1\r\n", "mpcommit 0a1b 3 5\r\n", "mpabort\r\n"} {
+		if _, _, err := ParseCommand([]byte(s)); err != errCommand {
+			t.Fatal("err != errCommand", s, err)
+		}
+	}
+}
+
 func TestParseDelete(t *testing.T) {
 	b := []byte("delete k1 noreply\r\nxxx\r\n")
 	advance, cmd, err := ParseCommand(b)
@@ -185,6 +264,49 @@ func TestParseStats(t *testing.T) {
 	}
 }
 
+func TestParseMeta(t *testing.T) {
+	b := []byte("ms azE= 3 b T10 F5 Oabc q\r\nxxx\r\n")
+	advance, cmd, err := ParseCommand(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Cmd != "ms" {
+		t.Fatal("cmd err", cmd.Cmd)
+	}
+	if cmd.Key != "k1" {
+		t.Fatal("key err", cmd.Key)
+	}
+	if cmd.PayloadLen != 3 {
+		t.Fatal("payload len err", cmd.PayloadLen)
+	}
+	if len(cmd.MetaFlags) != 5 {
+		t.Fatal("flags err", cmd.MetaFlags)
+	}
+	if v, ok := cmd.MetaFlag('T'); !ok || v != "10" {
+		t.Fatal("flag T err", v)
+	}
+	if v, ok := cmd.MetaFlag('O'); !ok || v != "abc" {
+		t.Fatal("flag O err", v)
+	}
+	if !cmd.HasMetaFlag('q') || cmd.HasMetaFlag('v') {
+		t.Fatal("flag q err")
+	}
+	if string(b[advance:]) != "xxx\r\n" {
+		t.Fatal("left buf err", string(b[advance:]))
+	}
+
+	_, cmd, err = ParseCommand([]byte("mn\r\n"))
+	if err != nil || cmd.Cmd != "mn" {
+		t.Fatal("parse mn err", err)
+	}
+
+	for _, s := range []string{"mg\r\n", "ms k1\r\n", "ms k1 x\r\n", "mg k1 1\r\n", "mg !! b\r\n", "mn k1\r\n"} {
+		if _, _, err := ParseCommand([]byte(s)); err != errCommand {
+			t.Fatalf("parse %q: err != errCommand: %v", s, err)
+		}
+	}
+}
+
 func TestParseErr(t *testing.T) {
 	b := []byte("xxx k1 7 noreply\r\nxxx\r\n")
 	advance, _, err := ParseCommand(b)
@@ -195,3 +317,293 @@ func TestParseErr(t *testing.T) {
 		t.Fatal("advance err", advance)
 	}
 }
+
+func TestParseFlushAll(t *testing.T) {
+	for _, tc := range []struct {
+		line    string
+		delay   uint32
+		noreply bool
+	}{
+		{"flush_all\r\n", 0, false},
+		{"flush_all 10\r\n", 10, false},
+		{"flush_all noreply\r\n", 0, true},
+		{"flush_all 10 noreply\r\n", 10, true},
+	} {
+		_, cmd, err := ParseCommand([]byte(tc.line))
+		if err != nil {
+			t.Fatal(tc.line, err)
+		}
+		if cmd.Cmd != "flush_all" || cmd.Exptime != tc.delay || cmd.NoReply != tc.noreply {
+			t.Fatal("cmd err", tc.line, cmd)
+		}
+	}
+	for _, line := range []string{"flush_all x\r\n", "flush_all 1 2\r\n"} {
+		if _, _, err := ParseCommand([]byte(line)); err == nil {
+			t.Fatal("should err", line)
+		}
+	}
+}
+
+func TestParseOther(t *testing.T) {
+	for _, line := range []string{"version\r\n", "quit\r\n", "shutdown\r\n", "shutdown graceful\r\n"} {
+		if _, _, err := ParseCommand([]byte(line)); err != nil {
+			t.Fatal(line, err)
+		}
+	}
+	for _, line := range []string{"version 1\r\n", "quit 1\r\n", "shutdown now\r\n", "verbosity\r\n", "unknown\r\n"} {
+		if _, _, err := ParseCommand([]byte(line)); err == nil {
+			t.Fatal("should err", line)
+		}
+	}
+	_, cmd, err := ParseCommand([]byte("verbosity 2 noreply\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Cmd != "verbosity" || cmd.Level != 2 || !cmd.NoReply {
+		t.Fatal("cmd err", cmd)
+	}
+}
+
+func TestParseEdgeCases(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		cmd  CommandInfo
+	}{
+		{"  get   k1  k2 \r\n", CommandInfo{Cmd: "get", Key: "k1", Keys: []string{"k1", "k2"}}},
+		{"delete k1\n", CommandInfo{Cmd: "delete", Key: "k1"}},
+		{"set k1 0 0 1\r\n", CommandInfo{Cmd: "set", Key: "k1", PayloadLen: 1}},
+		{"incr k1 18446744073709551615\r\n", CommandInfo{Cmd: "incr", Key: "k1", Delta: 1<<64 - 1}},
+		{"touch k1 4294967295 noreply\r\n", CommandInfo{Cmd: "touch", Key: "k1", Exptime: 1<<32 - 1, NoReply: true}},
+		{"get " + strings.Repeat("k", MaxKeyLen) + "\r\n", CommandInfo{Cmd: "get", Key: strings.Repeat("k", MaxKeyLen),
+			Keys: []string{strings.Repeat("k", MaxKeyLen)}}},
+		{"mg " + base64.StdEncoding.EncodeToString([]byte("k\x00\r\n")) + " b\r\n", CommandInfo{Cmd: "mg", Key: "k\x00\r\n",
+			MetaFlags: []MetaFlag{{Flag: 'b'}}}},
+	} {
+		_, cmd, err := ParseCommand([]byte(tc.line))
+		if err != nil {
+			t.Fatalf("%q: %v", tc.line, err)
+		}
+		if !reflect.DeepEqual(*cmd, tc.cmd) {
+			t.Fatalf("%q: %+v != %+v", tc.line, *cmd, tc.cmd)
+		}
+	}
+	for _, tc := range []struct {
+		line string
+		err  error
+	}{
+		{"\r\n", errCommand},
+		{"   \r\n", errCommand},
+		{"delete\r\n", errCommand},
+		{"delete k1 0\r\n", errCommand},
+		{"set k1 1 2 3 xnoreply\r\n", errCommand},
+		{"set k1 1 2 3 noreply x\r\n", errCommand},
+		{"set k1 4294967296 0 1\r\n", errCommand},
+		{"set k1 0 0 9223372036854775808\r\n", errCommand},
+		{"set k1 0 0 -1\r\n", errCommand},
+		{"cas k1 0 0 1 18446744073709551616\r\n", errCommand},
+		{"incr k1 18446744073709551616\r\n", errCommand},
+		{"incr k1 +1\r\n", errCommand},
+		{"getrange k1 0 9223372036854775808\r\n", errCommand},
+		{"mpput 0a1b 2147483648 1\r\n", errCommand},
+		{"GET k1\r\n", errCommand},
+		{"get " + strings.Repeat("k", MaxKeyLen+1) + "\r\n", errKey},
+		{"get k1 k\x00\r\n", errKey},
+		{"get k\tk\r\n", errKey},
+		{"set k\x7f 0 0 1\r\n", errKey},
+		{"mg " + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", MaxKeyLen+1))) + " b\r\n", errKey},
+		{"mg k\x01 v\r\n", errKey},
+	} {
+		if _, _, err := ParseCommand([]byte(tc.line)); err != tc.err {
+			t.Fatalf("%q: %v != %v", tc.line, err, tc.err)
+		}
+	}
+	if _, _, err := ParseCommand([]byte("get k1")); err != ErrNeedMoreData {
+		t.Fatal("should need more data", err)
+	}
+}
+
+// parseSamples are commands of every type for benchmarks and fuzzing
+var parseSamples = []struct {
+	name string
+	line string
+}{
+	{"set", "set key:1234567890 123 3600 1024 noreply\r\n"},
+	{"cas", "cas key:1234567890 123 3600 1024 1234567 noreply\r\n"},
+	{"get", "get key:1234567890\r\n"},
+	{"multiget", "get key:1 key:2 key:3 key:4 key:5 key:6 key:7 key:8 key:9 key:10\r\n"},
+	{"gat", "gats 3600 key:1 key:2 key:3\r\n"},
+	{"getrange", "getrange key:1234567890 1048576 65536\r\n"},
+	{"mpput", "mpput 0123456789abcdef 12 1048576 noreply\r\n"},
+	{"mpcommit", "mpcommit 0123456789abcdef 12 123 3600\r\n"},
+	{"delete", "delete key:1234567890 noreply\r\n"},
+	{"incr", "incr key:1234567890 100\r\n"},
+	{"touch", "touch key:1234567890 3600\r\n"},
+	{"flush_all", "flush_all 10 noreply\r\n"},
+	{"verbosity", "verbosity 1\r\n"},
+	{"mg", "mg key:1234567890 v c f t k s Oopaque123 q\r\n"},
+	{"ms", "ms a2V5OjEyMzQ1Njc4OTA= 1024 b T3600 F123 I q\r\n"},
+	{"mn", "mn\r\n"},
+	{"stats", "stats settings\r\n"},
+	{"version", "version\r\n"},
+}
+
+func TestParserReuse(t *testing.T) {
+	var p Parser
+	for i := 0; i < 2; i++ {
+		for _, s := range parseSamples {
+			_, expect, err := ParseCommand([]byte(s.line))
+			if err != nil {
+				t.Fatal(s.line, err)
+			}
+			_, cmd, err := p.Parse([]byte(s.line))
+			if err != nil {
+				t.Fatal(s.line, err)
+			}
+			if !equalCommandInfo(cmd, expect) {
+				t.Fatalf("%q: %+v != %+v", s.line, *cmd, *expect)
+			}
+		}
+	}
+	if _, _, err := p.Parse([]byte("get\r\n")); err != errCommand {
+		t.Fatal("err != errCommand", err)
+	}
+}
+
+func TestParseAllocs(t *testing.T) {
+	var p Parser
+	for _, s := range parseSamples {
+		b := []byte(s.line)
+		if n := testing.AllocsPerRun(100, func() { p.Parse(b) }); n != 0 {
+			t.Fatalf("%s: %v allocs", s.name, n)
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	for _, s := range parseSamples {
+		line := []byte(s.line)
+		b.Run(s.name, func(b *testing.B) {
+			var p Parser
+			b.ReportAllocs()
+			b.SetBytes(int64(len(line)))
+			for i := 0; i < b.N; i++ {
+				if _, _, err := p.Parse(line); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// equalCommandInfo is like reflect.DeepEqual but empty slices equal to nil
+func equalCommandInfo(a, b *CommandInfo) bool {
+	x, y := *a, *b
+	for _, c := range []*CommandInfo{&x, &y} {
+		if len(c.Keys) == 0 {
+			c.Keys = nil
+		}
+		if len(c.MetaFlags) == 0 {
+			c.MetaFlags = nil
+		}
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// checkParse checks the invariants of parsing data by ParseCommand and a reused Parser
+func checkParse(t *testing.T, p *Parser, data []byte) {
+	advance, cmd, err := ParseCommand(data)
+	if idx := bytes.IndexByte(data, '\n'); idx < 0 {
+		if err != ErrNeedMoreData || advance != 0 {
+			t.Fatalf("%q: should need more data: %v", data, err)
+		}
+		return
+	} else if advance != idx+1 {
+		t.Fatalf("%q: advance %d != %d", data, advance, idx+1)
+	}
+	_, cmd2, err2 := p.Parse(data)
+	if err != err2 || (err == nil && !equalCommandInfo(cmd, cmd2)) {
+		t.Fatalf("%q: reused parser %+v %v != %+v %v", data, cmd2, err2, cmd, err)
+	}
+	if err != nil {
+		if err != errCommand && err != errKey {
+			t.Fatalf("%q: unexpected err %v", data, err)
+		}
+		return
+	}
+	keys := cmd.Keys
+	if cmd.Cmd == "stats" {
+		keys = nil
+	}
+	if cmd.Cmd != "mn" && cmd.Cmd != "stats" && cmd.Cmd != "version" && cmd.Cmd != "quit" &&
+		cmd.Cmd != "shutdown" && cmd.Cmd != "flush_all" && cmd.Cmd != "verbosity" {
+		keys = append(keys, cmd.Key)
+	}
+	for _, key := range keys {
+		if len(key) == 0 || len(key) > MaxKeyLen {
+			t.Fatalf("%q: invalid key %q", data, key)
+		}
+		if cmd.HasMetaFlag('b') {
+			continue
+		}
+		for i := 0; i < len(key); i++ {
+			if key[i] <= ' ' || key[i] == 0x7f {
+				t.Fatalf("%q: invalid key %q", data, key)
+			}
+		}
+	}
+	if cmd.PayloadLen < 0 || cmd.Offset < 0 || cmd.Length < 0 || cmd.Part < 0 {
+		t.Fatalf("%q: negative number %+v", data, cmd)
+	}
+}
+
+// fuzzCommands fuzzes the arguments of cmds, which are seeded by the samples of cmds
+func fuzzCommands(f *testing.F, cmds ...string) {
+	for i, cmd := range cmds {
+		for _, s := range parseSamples {
+			if strings.HasPrefix(s.line, cmd+" ") {
+				f.Add(uint8(i), []byte(strings.TrimPrefix(s.line, cmd+" ")))
+			}
+		}
+		f.Add(uint8(i), []byte("k1 noreply\r\n"))
+	}
+	f.Fuzz(func(t *testing.T, n uint8, args []byte) {
+		var p Parser
+		p.Parse([]byte("get k1 k2 k3\r\n")) // the buffers of p are reused
+		checkParse(t, &p, append([]byte(cmds[int(n)%len(cmds)]+" "), args...))
+	})
+}
+
+func FuzzParseCommand(f *testing.F) {
+	for _, s := range parseSamples {
+		f.Add([]byte(s.line))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var p Parser
+		p.Parse([]byte("get k1 k2 k3\r\n"))
+		checkParse(t, &p, data)
+	})
+}
+
+func FuzzParseStorage(f *testing.F) {
+	fuzzCommands(f, "set", "add", "replace", "append", "prepend", "cas")
+}
+
+func FuzzParseRetrieval(f *testing.F) {
+	fuzzCommands(f, "get", "gets", "gat", "gats", "getrange")
+}
+
+func FuzzParseMultipart(f *testing.F) {
+	fuzzCommands(f, "mpbegin", "mpput", "mpcommit", "mpabort")
+}
+
+func FuzzParseUpdate(f *testing.F) {
+	fuzzCommands(f, "delete", "incr", "decr", "touch")
+}
+
+func FuzzParseMeta(f *testing.F) {
+	fuzzCommands(f, "mg", "ms", "md", "ma", "mn", "me")
+}
+
+func FuzzParseOther(f *testing.F) {
+	fuzzCommands(f, "flush_all", "verbosity", "stats", "version", "quit", "shutdown")
+}
@@ -0,0 +1,47 @@
+package memcache
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// UDPHeaderLen is the length of the frame header of udp datagrams
+const UDPHeaderLen = 8
+
+var ErrUDPHeader = errors.New("bad udp frame header")
+
+// UDPHeader is the frame header of udp datagrams, a message is sent in Total datagrams with the same RequestID
+type UDPHeader struct {
+	RequestID uint16
+	Seq       uint16 // the sequence number of the datagram, starts from 0
+	Total     uint16 // the total number of datagrams in the message
+	Reserved  uint16
+}
+
+// ParseUDPHeader parses the frame header of the datagram `data`
+// return ErrUDPHeader if data is too short or the sequence number is out of range
+func ParseUDPHeader(data []byte) (UDPHeader, error) {
+	if len(data) < UDPHeaderLen {
+		return UDPHeader{}, ErrUDPHeader
+	}
+	h := UDPHeader{
+		RequestID: binary.BigEndian.Uint16(data),
+		Seq:       binary.BigEndian.Uint16(data[2:]),
+		Total:     binary.BigEndian.Uint16(data[4:]),
+		Reserved:  binary.BigEndian.Uint16(data[6:]),
+	}
+	if h.Seq >= h.Total {
+		return UDPHeader{}, ErrUDPHeader
+	}
+	return h, nil
+}
+
+// Append appends the encoded header to b
+func (h *UDPHeader) Append(b []byte) []byte {
+	var buf [UDPHeaderLen]byte
+	binary.BigEndian.PutUint16(buf[0:], h.RequestID)
+	binary.BigEndian.PutUint16(buf[2:], h.Seq)
+	binary.BigEndian.PutUint16(buf[4:], h.Total)
+	binary.BigEndian.PutUint16(buf[6:], h.Reserved)
+	return append(b, buf[:]...)
+}
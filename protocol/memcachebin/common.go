@@ -0,0 +1,141 @@
+package memcachebin
+
+import "encoding/binary"
+
+// https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped
+
+const (
+	MagicRequest  = 0x80
+	MagicResponse = 0x81
+
+	HeaderLen = 24
+)
+
+type Opcode uint8
+
+const (
+	OpGet      Opcode = 0x00
+	OpSet      Opcode = 0x01
+	OpAdd      Opcode = 0x02
+	OpReplace  Opcode = 0x03
+	OpDelete   Opcode = 0x04
+	OpQuit     Opcode = 0x07
+	OpFlush    Opcode = 0x08
+	OpGetQ     Opcode = 0x09
+	OpNoop     Opcode = 0x0a
+	OpVersion  Opcode = 0x0b
+	OpGetK     Opcode = 0x0c
+	OpGetKQ    Opcode = 0x0d
+	OpStat     Opcode = 0x10
+	OpSetQ     Opcode = 0x11
+	OpAddQ     Opcode = 0x12
+	OpReplaceQ Opcode = 0x13
+	OpDeleteQ  Opcode = 0x14
+	OpQuitQ    Opcode = 0x17
+	OpFlushQ   Opcode = 0x18
+	OpTouch    Opcode = 0x1c
+	OpGAT      Opcode = 0x1d
+	OpGATQ     Opcode = 0x1e
+	OpGATK     Opcode = 0x23
+	OpGATKQ    Opcode = 0x24
+)
+
+// Quiet returns true if op is a quiet variant,
+// quiet get commands suppress misses and other quiet commands suppress successes
+func (op Opcode) Quiet() bool {
+	switch op {
+	case OpGetQ, OpGetKQ, OpSetQ, OpAddQ, OpReplaceQ, OpDeleteQ, OpQuitQ, OpFlushQ, OpGATQ, OpGATKQ:
+		return true
+	}
+	return false
+}
+
+// WithKey returns true if the response of op includes the key
+func (op Opcode) WithKey() bool {
+	return op == OpGetK || op == OpGetKQ || op == OpGATK || op == OpGATKQ
+}
+
+type Status uint16
+
+const (
+	StatusOK             Status = 0x0000
+	StatusKeyNotFound    Status = 0x0001
+	StatusKeyExists      Status = 0x0002
+	StatusValueTooLarge  Status = 0x0003
+	StatusInvalidArgs    Status = 0x0004
+	StatusNotStored      Status = 0x0005
+	StatusNonNumeric     Status = 0x0006
+	StatusUnknownCommand Status = 0x0081
+	StatusOutOfMemory    Status = 0x0082
+	StatusInternalError  Status = 0x0084
+)
+
+var statusText = map[Status]string{
+	StatusOK:             "OK",
+	StatusKeyNotFound:    "Not found",
+	StatusKeyExists:      "Data exists for key",
+	StatusValueTooLarge:  "Too large",
+	StatusInvalidArgs:    "Invalid arguments",
+	StatusNotStored:      "Not stored",
+	StatusNonNumeric:     "Non-numeric server-side value for incr or decr",
+	StatusUnknownCommand: "Unknown command",
+	StatusOutOfMemory:    "Out of memory",
+	StatusInternalError:  "Internal error",
+}
+
+// String returns the error message used as the value of error responses
+func (s Status) String() string {
+	return statusText[s]
+}
+
+// Header is the 24 bytes header of requests and responses
+type Header struct {
+	Magic     uint8
+	Opcode    Opcode
+	KeyLen    uint16
+	ExtrasLen uint8
+	DataType  uint8
+	Status    Status // vbucket id for requests
+	BodyLen   uint32 // extras + key + value
+	Opaque    uint32 // copied back in the response
+	Cas       uint64
+}
+
+// Append appends the encoded header to b
+func (h *Header) Append(b []byte) []byte {
+	var buf [HeaderLen]byte
+	buf[0] = h.Magic
+	buf[1] = uint8(h.Opcode)
+	binary.BigEndian.PutUint16(buf[2:], h.KeyLen)
+	buf[4] = h.ExtrasLen
+	buf[5] = h.DataType
+	binary.BigEndian.PutUint16(buf[6:], uint16(h.Status))
+	binary.BigEndian.PutUint32(buf[8:], h.BodyLen)
+	binary.BigEndian.PutUint32(buf[12:], h.Opaque)
+	binary.BigEndian.PutUint64(buf[16:], h.Cas)
+	return append(b, buf[:]...)
+}
+
+// Request is a parsed request without the value
+type Request struct {
+	Header
+
+	Key      string
+	Flags    uint32 // for set/add/replace
+	Exptime  uint32 // for set/add/replace/touch/gat, or the delay of flush
+	ValueLen int64
+}
+
+// MakeResponseHeader returns the response header of req with the lengths of the body
+func MakeResponseHeader(req *Header, status Status, cas uint64, extrasLen, keyLen, valueLen int) Header {
+	return Header{
+		Magic:     MagicResponse,
+		Opcode:    req.Opcode,
+		KeyLen:    uint16(keyLen),
+		ExtrasLen: uint8(extrasLen),
+		Status:    status,
+		BodyLen:   uint32(extrasLen + keyLen + valueLen),
+		Opaque:    req.Opaque,
+		Cas:       cas,
+	}
+}
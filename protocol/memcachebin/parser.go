@@ -0,0 +1,88 @@
+package memcachebin
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrNeedMoreData   = errors.New("need more data")
+	ErrMagic          = errors.New("bad magic")
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrInvalidArgs    = errors.New("invalid arguments")
+)
+
+// ParseHeader parses the request header from `data`
+// return ErrNeedMoreData if len(data) < HeaderLen
+func ParseHeader(data []byte) (*Header, error) {
+	if len(data) < HeaderLen {
+		return nil, ErrNeedMoreData
+	}
+	if data[0] != MagicRequest {
+		return nil, ErrMagic
+	}
+	h := &Header{
+		Magic:     data[0],
+		Opcode:    Opcode(data[1]),
+		KeyLen:    binary.BigEndian.Uint16(data[2:]),
+		ExtrasLen: data[4],
+		DataType:  data[5],
+		Status:    Status(binary.BigEndian.Uint16(data[6:])),
+		BodyLen:   binary.BigEndian.Uint32(data[8:]),
+		Opaque:    binary.BigEndian.Uint32(data[12:]),
+		Cas:       binary.BigEndian.Uint64(data[16:]),
+	}
+	if uint32(h.KeyLen)+uint32(h.ExtrasLen) > h.BodyLen {
+		return nil, ErrInvalidArgs
+	}
+	return h, nil
+}
+
+// ParseRequest parses the request of h from `data` which contains the extras and key,
+// the value of ValueLen bytes follows them and is read by the caller.
+// return ErrNeedMoreData if len(data) < h.ExtrasLen + h.KeyLen
+// return ErrUnknownCommand if the opcode is not supported
+// return ErrInvalidArgs if the lengths of extras, key or value not match the opcode
+func ParseRequest(h *Header, data []byte) (*Request, error) {
+	extrasLen := int(h.ExtrasLen)
+	keyLen := int(h.KeyLen)
+	if len(data) < extrasLen+keyLen {
+		return nil, ErrNeedMoreData
+	}
+	var needExtras int
+	var needKey, allowKey, allowValue bool
+	switch h.Opcode {
+	case OpGet, OpGetQ, OpGetK, OpGetKQ, OpDelete, OpDeleteQ:
+		needKey = true
+	case OpSet, OpSetQ, OpAdd, OpAddQ, OpReplace, OpReplaceQ:
+		needExtras, needKey, allowValue = 8, true, true
+	case OpTouch, OpGAT, OpGATQ, OpGATK, OpGATKQ:
+		needExtras, needKey = 4, true
+	case OpFlush, OpFlushQ:
+		if extrasLen > 0 { // the delay is optional
+			needExtras = 4
+		}
+	case OpStat:
+		allowKey = true
+	case OpNoop, OpVersion, OpQuit, OpQuitQ:
+	default:
+		return nil, ErrUnknownCommand
+	}
+	valueLen := int64(h.BodyLen) - int64(extrasLen+keyLen)
+	if extrasLen != needExtras ||
+		(needKey && keyLen == 0) || (!needKey && !allowKey && keyLen > 0) ||
+		(!allowValue && valueLen > 0) {
+		return nil, ErrInvalidArgs
+	}
+	req := &Request{Header: *h, ValueLen: valueLen}
+	extras := data[:extrasLen]
+	switch extrasLen {
+	case 8:
+		req.Flags = binary.BigEndian.Uint32(extras)
+		req.Exptime = binary.BigEndian.Uint32(extras[4:])
+	case 4:
+		req.Exptime = binary.BigEndian.Uint32(extras)
+	}
+	req.Key = string(data[extrasLen : extrasLen+keyLen])
+	return req, nil
+}
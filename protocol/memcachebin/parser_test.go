@@ -0,0 +1,69 @@
+package memcachebin
+
+import "testing"
+
+func TestParseSet(t *testing.T) {
+	b := []byte{
+		0x80, 0x01, 0x00, 0x02, // magic, opcode, key length
+		0x08, 0x00, 0x00, 0x00, // extras length, data type, vbucket
+		0x00, 0x00, 0x00, 0x0d, // total body length
+		0xde, 0xad, 0xbe, 0xef, // opaque
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07, // cas
+		0x00, 0x00, 0x00, 0x01, // flags
+		0x00, 0x00, 0x00, 0x02, // exptime
+		'k', '1', // key
+		'x', 'x', 'x', // value
+	}
+	h, err := ParseHeader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Opcode != OpSet || h.Opaque != 0xdeadbeef || h.Cas != 7 || h.BodyLen != 13 {
+		t.Fatal("header err", h)
+	}
+	req, err := ParseRequest(h, b[HeaderLen:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Key != "k1" || req.Flags != 1 || req.Exptime != 2 || req.ValueLen != 3 {
+		t.Fatal("request err", req)
+	}
+
+	rh := MakeResponseHeader(h, StatusOK, 8, 0, 0, 0)
+	rsp := rh.Append(nil)
+	if len(rsp) != HeaderLen || rsp[0] != MagicResponse || rsp[1] != byte(OpSet) ||
+		string(rsp[12:16]) != "\xde\xad\xbe\xef" || rsp[23] != 8 {
+		t.Fatalf("response err %x", rsp)
+	}
+}
+
+func TestParseErr(t *testing.T) {
+	h := &Header{Magic: MagicRequest, Opcode: OpGet}
+	b := h.Append(nil)
+	if _, err := ParseHeader(b[:HeaderLen-1]); err != ErrNeedMoreData {
+		t.Fatal("should need more data", err)
+	}
+	b[0] = MagicResponse
+	if _, err := ParseHeader(b); err != ErrMagic {
+		t.Fatal("should magic err", err)
+	}
+
+	// get without key
+	if _, err := ParseRequest(h, nil); err != ErrInvalidArgs {
+		t.Fatal("should invalid args", err)
+	}
+	// get with value
+	h.KeyLen, h.BodyLen = 1, 2
+	if _, err := ParseRequest(h, []byte("k")); err != ErrInvalidArgs {
+		t.Fatal("should invalid args", err)
+	}
+	// set without extras
+	h.Opcode, h.BodyLen = OpSet, 1
+	if _, err := ParseRequest(h, []byte("k")); err != ErrInvalidArgs {
+		t.Fatal("should invalid args", err)
+	}
+	h.Opcode = 0x20 // sasl list mechs
+	if _, err := ParseRequest(h, []byte("k")); err != ErrUnknownCommand {
+		t.Fatal("should unknown command", err)
+	}
+}
@@ -0,0 +1,85 @@
+package resp
+
+import "strconv"
+
+// limits of requests, same as redis
+const (
+	MaxArgs      = 1024 * 1024 // max number of arguments of a multibulk request
+	MaxBulkLen   = 512 << 20   // max length of a bulk string
+	MaxInlineLen = 64 << 10    // max length of an inline request
+)
+
+var (
+	RspOK   = []byte("+OK\r\n")
+	RspPong = []byte("+PONG\r\n")
+
+	RspNilBulk = []byte("$-1\r\n") // the null of RESP2
+	RspNull    = []byte("_\r\n")   // the null of RESP3
+
+	EOL = []byte("\r\n")
+)
+
+// AppendError appends an error reply, s should start with an error code like ERR.
+// \r and \n in s are replaced with spaces since error replies are single line.
+func AppendError(b []byte, s string) []byte {
+	b = append(b, '-')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\r' || c == '\n' {
+			c = ' '
+		}
+		b = append(b, c)
+	}
+	return append(b, '\r', '\n')
+}
+
+// AppendInt appends an integer reply
+func AppendInt(b []byte, n int64) []byte {
+	b = append(b, ':')
+	b = strconv.AppendInt(b, n, 10)
+	return append(b, '\r', '\n')
+}
+
+// AppendBulkHeader appends the header of a bulk string with n bytes, the caller writes data and EOL
+func AppendBulkHeader(b []byte, n int) []byte {
+	return appendLen(b, '$', n)
+}
+
+// AppendBulk appends a bulk string reply
+func AppendBulk(b []byte, v []byte) []byte {
+	b = AppendBulkHeader(b, len(v))
+	b = append(b, v...)
+	return append(b, '\r', '\n')
+}
+
+// AppendBulkString appends a bulk string reply
+func AppendBulkString(b []byte, s string) []byte {
+	b = AppendBulkHeader(b, len(s))
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// AppendVerbatim appends a verbatim string reply of RESP3, the format is like `txt`
+func AppendVerbatim(b []byte, format string, s string) []byte {
+	b = appendLen(b, '=', len(format)+1+len(s))
+	b = append(b, format...)
+	b = append(b, ':')
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// AppendArrayHeader appends the header of an array with n elements
+func AppendArrayHeader(b []byte, n int) []byte {
+	return appendLen(b, '*', n)
+}
+
+// AppendMapHeader appends the header of a RESP3 map with n key-value pairs
+func AppendMapHeader(b []byte, n int) []byte {
+	return appendLen(b, '%', n)
+}
+
+func appendLen(b []byte, t byte, n int) []byte {
+	b = append(b, t)
+	b = strconv.AppendInt(b, int64(n), 10)
+	return append(b, '\r', '\n')
+}
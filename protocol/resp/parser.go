@@ -0,0 +1,139 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var (
+	ErrInvalidMultibulkLen = errors.New("invalid multibulk length")
+	ErrInvalidBulkLen      = errors.New("invalid bulk length")
+	ErrUnbalancedQuotes    = errors.New("unbalanced quotes in request")
+)
+
+// ParseLength parses the length line of a request, it's `*<n>\r\n` of arrays if t is '*',
+// or `$<n>\r\n` of bulk strings if t is '$'.
+// implements: https://redis.io/docs/reference/protocol-spec/#sending-commands-to-a-redis-server
+func ParseLength(line []byte, t byte) (int64, error) {
+	if len(line) == 0 || line[0] != t {
+		got := "EOL"
+		if len(line) > 0 {
+			got = string(line[:1])
+		}
+		return 0, fmt.Errorf("expected '%c', got '%s'", t, got)
+	}
+	line = bytes.TrimRight(line[1:], "\r\n")
+	n, err := strconv.ParseInt(string(line), 10, 64)
+	if t == '*' {
+		if err != nil || n > MaxArgs {
+			return 0, ErrInvalidMultibulkLen
+		}
+		if n < 0 { // null array
+			n = 0
+		}
+		return n, nil
+	}
+	if err != nil || n < 0 || n > MaxBulkLen {
+		return 0, ErrInvalidBulkLen
+	}
+	return n, nil
+}
+
+// ParseInline splits the arguments of an inline request like `SET k "hello world"`.
+// quoted arguments are supported, the escapes of double quotes are \" \\ \n \r \t \b \a and \xhh.
+func ParseInline(line []byte) ([][]byte, error) {
+	var args [][]byte
+	line = bytes.TrimRight(line, "\r\n")
+	for {
+		line = bytes.TrimLeft(line, " \t")
+		if len(line) == 0 {
+			return args, nil
+		}
+		var arg []byte
+		var err error
+		switch line[0] {
+		case '"':
+			arg, line, err = parseDoubleQuoted(line[1:])
+		case '\'':
+			arg, line, err = parseSingleQuoted(line[1:])
+		default:
+			idx := bytes.IndexAny(line, " \t")
+			if idx < 0 {
+				idx = len(line)
+			}
+			arg, line = line[:idx], line[idx:]
+		}
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+}
+
+// parseDoubleQuoted returns the unescaped argument and the data after the closing quote
+func parseDoubleQuoted(b []byte) (arg, left []byte, err error) {
+	arg = []byte{}
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c == '"' {
+			return arg, b[i+1:], checkQuoteEnd(b[i+1:])
+		}
+		if c != '\\' || i+1 == len(b) {
+			arg = append(arg, c)
+			continue
+		}
+		i++
+		switch b[i] {
+		case 'n':
+			c = '\n'
+		case 'r':
+			c = '\r'
+		case 't':
+			c = '\t'
+		case 'b':
+			c = '\b'
+		case 'a':
+			c = '\a'
+		case 'x':
+			if i+2 < len(b) {
+				if v, err := strconv.ParseUint(string(b[i+1:i+3]), 16, 8); err == nil {
+					c = byte(v)
+					i += 2
+					break
+				}
+			}
+			c = 'x'
+		default:
+			c = b[i]
+		}
+		arg = append(arg, c)
+	}
+	return nil, nil, ErrUnbalancedQuotes
+}
+
+// parseSingleQuoted returns the argument and the data after the closing quote, only \' is escaped
+func parseSingleQuoted(b []byte) (arg, left []byte, err error) {
+	arg = []byte{}
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c == '\'' {
+			return arg, b[i+1:], checkQuoteEnd(b[i+1:])
+		}
+		if c == '\\' && i+1 < len(b) && b[i+1] == '\'' {
+			i++
+			c = '\''
+		}
+		arg = append(arg, c)
+	}
+	return nil, nil, ErrUnbalancedQuotes
+}
+
+// checkQuoteEnd checks the closing quote is followed by a space or nothing
+func checkQuoteEnd(b []byte) error {
+	if len(b) > 0 && b[0] != ' ' && b[0] != '\t' {
+		return ErrUnbalancedQuotes
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package resp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseLength(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		t    byte
+		n    int64
+		ok   bool
+	}{
+		{"*3\r\n", '*', 3, true},
+		{"*-1\r\n", '*', 0, true},
+		{"$5\r\n", '$', 5, true},
+		{"$0\r\n", '$', 0, true},
+		{"$-1\r\n", '$', 0, false},
+		{"$x\r\n", '$', 0, false},
+		{"*5\r\n", '$', 0, false},
+		{"$536870913\r\n", '$', 0, false},
+		{"*1048577\r\n", '*', 0, false},
+		{"", '*', 0, false},
+	} {
+		n, err := ParseLength([]byte(tc.line), tc.t)
+		if (err == nil) != tc.ok || n != tc.n {
+			t.Fatal("parse err", tc.line, n, err)
+		}
+	}
+}
+
+func TestParseInline(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		args []string
+	}{
+		{"PING\r\n", []string{"PING"}},
+		{"  set k  v \n", []string{"set", "k", "v"}},
+		{`set k "hello \"world\"\x41\n"` + "\r\n", []string{"set", "k", "hello \"world\"A\n"}},
+		{`set k 'it\'s' ""`, []string{"set", "k", "it's", ""}},
+		{"\r\n", nil},
+	} {
+		args, err := ParseInline([]byte(tc.line))
+		if err != nil {
+			t.Fatal(tc.line, err)
+		}
+		if len(args) != len(tc.args) {
+			t.Fatal("args err", tc.line, len(args))
+		}
+		for i := range args {
+			if !bytes.Equal(args[i], []byte(tc.args[i])) {
+				t.Fatalf("%q arg %d err: %q", tc.line, i, args[i])
+			}
+		}
+	}
+	for _, line := range []string{`get "k`, `get 'k`, `get "k"v`} {
+		if _, err := ParseInline([]byte(line)); err != ErrUnbalancedQuotes {
+			t.Fatal("should be unbalanced", line, err)
+		}
+	}
+}
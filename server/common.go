@@ -2,21 +2,48 @@ package server
 
 import (
 	"io"
+	"net"
 
 	"github.com/xiaost/blobcached/cache"
 )
 
-const Version = "1.0"
-
+// Cache is the cache served by servers, the key strings passed to it may refer to the buffers of requests,
+// they are only valid during the call and must be copied to be retained
 type Cache interface {
 	Set(item *cache.Item) error
+	SetMulti(items []*cache.Item) []error
+	Add(item *cache.Item) error
+	Replace(item *cache.Item) error
+	CompareAndSwap(item *cache.Item) error
+	CanStore(item *cache.Item, mode cache.StoreMode) error
+	NewWriter(item *cache.Item, n int64) (cache.ValueWriter, error)
+	Append(item *cache.Item) error
+	Prepend(item *cache.Item) error
+	Incr(key string, delta uint64) (uint64, error)
+	Decr(key string, delta uint64) (uint64, error)
 	Get(key string) (*cache.Item, error)
+	GetMulti(keys []string, maxSize int64) ([]*cache.Item, []error)
+	GetReader(key string, minSize int64, verifyCrc bool) (*cache.Item, cache.ValueReader, error)
+	GetRange(key string, off, n int64) (*cache.Item, int64, error)
+	Scan(prefix, start string, max int) ([]cache.KeyInfo, error)
 	Del(key string) error
+	DelIfCas(key string, cas uint64) error
+	DelMulti(keys []string) []error
+	Touch(key string, ttl uint32) error
+	Flush() error
+	Invalidate(key string) error
+	ClaimToken(key string, cas uint64) (bool, error)
+	BeginUpload(key string) (string, error)
+	NewPartWriter(id string, n int, size int64) (cache.ValueWriter, error)
+	CommitUpload(id string, n int, item *cache.Item) error
+	AbortUpload(id string) error
 	GetOptions() cache.CacheOptions
 	GetMetrics() cache.CacheMetrics
 	GetMetricsByShards() []cache.CacheMetrics
 	GetStats() cache.CacheStats
 	GetStatsByShards() []cache.CacheStats
+	GetStatusByShards() []cache.ShardStatus
+	ResetMetrics()
 }
 
 type WriterCounter struct {
@@ -31,3 +58,54 @@ func (w *WriterCounter) Write(p []byte) (int, error) {
 	}
 	return n, err
 }
+
+// bufferedWriterSize is the max size of pending data of BufferedWriter
+const bufferedWriterSize = 16 << 10
+
+// BufferedWriter coalesces small writes of responses,
+// a large write is sent with the pending data by writev if W is a *net.TCPConn, without copying it.
+// Flush must be called before waiting for the next requests.
+type BufferedWriter struct {
+	W   io.Writer
+	N   int64 // bytes written, including the pending data
+	buf []byte
+}
+
+func NewBufferedWriter(w io.Writer) *BufferedWriter {
+	return &BufferedWriter{W: w, buf: make([]byte, 0, bufferedWriterSize)}
+}
+
+func (w *BufferedWriter) Write(p []byte) (int, error) {
+	if len(w.buf)+len(p) <= cap(w.buf) {
+		w.buf = append(w.buf, p...)
+		w.N += int64(len(p))
+		return len(p), nil
+	}
+	bufs := net.Buffers{w.buf, p}
+	if len(w.buf) == 0 {
+		bufs = bufs[1:]
+	}
+	pending := int64(len(w.buf))
+	n, err := bufs.WriteTo(w.W)
+	w.buf = w.buf[:0]
+	if n -= pending; n < 0 {
+		n = 0
+	}
+	w.N += n
+	return int(n), err
+}
+
+// Flush writes the pending data
+func (w *BufferedWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.W.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// Buffered returns the size of the pending data
+func (w *BufferedWriter) Buffered() int {
+	return len(w.buf)
+}
@@ -1,15 +1,25 @@
 package server
 
 import (
+	"bytes"
+	"io"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
-	"unsafe"
 
-	"blobcached/cache"
+	"github.com/xiaost/blobcached/cache"
 )
 
 type InMemoryCache struct {
-	m map[string]cache.Item
+	mu     sync.Mutex
+	m      map[string]cache.Item
+	cas    uint64
+	tokens map[string]bool // stale keys which token sent
+
+	uploads map[string]*inMemoryUpload
 
 	options cache.CacheOptions
 
@@ -20,36 +30,458 @@ type InMemoryCache struct {
 func NewInMemoryCache() *InMemoryCache {
 	c := &InMemoryCache{}
 	c.m = make(map[string]cache.Item)
-	c.options.Allocator = cache.NewAllocatorPool()
+	c.tokens = make(map[string]bool)
+	c.uploads = make(map[string]*inMemoryUpload)
+	c.options.Allocator = cache.NewAllocatorPool(4096)
 	return c
 }
 
-func (c *InMemoryCache) Set(item cache.Item) error {
+func (c *InMemoryCache) Set(item *cache.Item) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.metrics.SetTotal += 1
-	item.Timestamp = time.Now().Unix()
-	c.m[item.Key] = item
-	c.updateStats()
+	c.set(item)
+	return nil
+}
+
+func (c *InMemoryCache) SetMulti(items []*cache.Item) []error {
+	errs := make([]error, len(items))
+	for i, item := range items {
+		errs[i] = c.Set(item)
+	}
+	return errs
+}
+
+func (c *InMemoryCache) Add(item *cache.Item) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics.SetTotal += 1
+	if _, ok := c.m[item.Key]; ok {
+		return cache.ErrNotStored
+	}
+	c.set(item)
+	return nil
+}
+
+func (c *InMemoryCache) Replace(item *cache.Item) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics.SetTotal += 1
+	if _, ok := c.m[item.Key]; !ok {
+		return cache.ErrNotStored
+	}
+	c.set(item)
+	return nil
+}
+
+func (c *InMemoryCache) CompareAndSwap(item *cache.Item) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics.SetTotal += 1
+	it, ok := c.m[item.Key]
+	if !ok {
+		return cache.ErrNotFound
+	}
+	stale := item.Stale && item.Cas < it.Cas
+	if it.Cas != item.Cas && !stale {
+		return cache.ErrCasConflict
+	}
+	item.Stale = stale
+	c.set(item)
+	return nil
+}
+
+func (c *InMemoryCache) CanStore(item *cache.Item, mode cache.StoreMode) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it, ok := c.m[item.Key]
+	switch {
+	case mode == cache.StoreAdd && ok:
+		return cache.ErrNotStored
+	case mode == cache.StoreReplace && !ok:
+		return cache.ErrNotStored
+	case mode == cache.StoreCAS && !ok:
+		return cache.ErrNotFound
+	case mode == cache.StoreCAS && it.Cas != item.Cas && !(item.Stale && item.Cas < it.Cas):
+		return cache.ErrCasConflict
+	}
+	return nil
+}
+
+func (c *InMemoryCache) NewWriter(item *cache.Item, n int64) (cache.ValueWriter, error) {
+	if n > cache.MaxChunkedValueSize {
+		return nil, cache.ErrValueSize
+	}
+	return &inMemoryWriter{c: c, item: item, n: n}, nil
+}
+
+// inMemoryWriter buffers the value, and stores the item by the methods of InMemoryCache
+type inMemoryWriter struct {
+	c    *InMemoryCache
+	item *cache.Item
+	n    int64
+	buf  bytes.Buffer
+}
+
+func (w *inMemoryWriter) Write(p []byte) (int, error) {
+	if int64(w.buf.Len()+len(p)) > w.n {
+		return 0, cache.ErrValueSize
+	}
+	return w.buf.Write(p)
+}
+
+func (w *inMemoryWriter) ReadFrom(r io.Reader) (int64, error) {
+	return w.buf.ReadFrom(io.LimitReader(r, w.n-int64(w.buf.Len())))
+}
+
+func (w *inMemoryWriter) Commit(mode cache.StoreMode) error {
+	if int64(w.buf.Len()) != w.n {
+		return cache.ErrShortValue
+	}
+	w.item.Value = w.buf.Bytes()
+	switch mode {
+	case cache.StoreAdd:
+		return w.c.Add(w.item)
+	case cache.StoreReplace:
+		return w.c.Replace(w.item)
+	case cache.StoreCAS:
+		return w.c.CompareAndSwap(w.item)
+	}
+	return w.c.Set(w.item)
+}
+
+func (c *InMemoryCache) Invalidate(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it, ok := c.m[key]
+	if !ok {
+		return cache.ErrNotFound
+	}
+	c.cas += 1
+	it.Cas = c.cas
+	it.Stale = true
+	c.m[it.Key] = it
+	delete(c.tokens, key)
+	return nil
+}
+
+func (c *InMemoryCache) ClaimToken(key string, cas uint64) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it, ok := c.m[key]
+	if !ok {
+		return false, cache.ErrNotFound
+	}
+	if !it.Stale || it.Cas != cas || c.tokens[key] {
+		return false, nil
+	}
+	c.tokens[strings.Clone(key)] = true
+	return true, nil
+}
+
+func (c *InMemoryCache) Append(item *cache.Item) error {
+	return c.concat(item, false)
+}
+
+func (c *InMemoryCache) Prepend(item *cache.Item) error {
+	return c.concat(item, true)
+}
+
+func (c *InMemoryCache) concat(item *cache.Item, prepend bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics.SetTotal += 1
+	it, ok := c.m[item.Key]
+	if !ok {
+		return cache.ErrNotStored
+	}
+	if prepend {
+		it.Value = append(append([]byte(nil), item.Value...), it.Value...)
+	} else {
+		it.Value = append(append([]byte(nil), it.Value...), item.Value...)
+	}
+	it.MD5 = nil
+	c.set(&it)
+	item.Cas = it.Cas
 	return nil
 }
 
-func (c *InMemoryCache) Get(key string) (cache.Item, error) {
+func (c *InMemoryCache) Incr(key string, delta uint64) (uint64, error) {
+	return c.incrDecr(key, delta, false)
+}
+
+func (c *InMemoryCache) Decr(key string, delta uint64) (uint64, error) {
+	return c.incrDecr(key, delta, true)
+}
+
+func (c *InMemoryCache) incrDecr(key string, delta uint64, decr bool) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it, ok := c.m[key]
+	if !ok {
+		return 0, cache.ErrNotFound
+	}
+	v, err := strconv.ParseUint(string(it.Value), 10, 64)
+	if err != nil {
+		return 0, cache.ErrNotNumber
+	}
+	if !decr {
+		v += delta
+	} else if delta > v {
+		v = 0
+	} else {
+		v -= delta
+	}
+	it.Value = strconv.AppendUint(nil, v, 10)
+	c.set(&it)
+	return v, nil
+}
+
+func (c *InMemoryCache) set(item *cache.Item) {
+	c.cas += 1
+	it := cache.Item{Key: strings.Clone(item.Key), TTL: item.TTL, Flags: item.Flags, Cas: c.cas, Stale: item.Stale, MD5: item.MD5}
+	it.Value = append([]byte(nil), item.Value...)
+	it.Timestamp = time.Now().Unix()
+	c.m[it.Key] = it
+	delete(c.tokens, item.Key)
+	item.Cas = it.Cas
+	c.updateStats()
+}
+
+func (c *InMemoryCache) Get(key string) (*cache.Item, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.metrics.GetTotal += 1
-	item, ok := c.m[key]
-	if ok {
-		c.metrics.GetHits += 1
-		return item, nil
+	it, ok := c.m[key]
+	if !ok {
+		c.metrics.GetMisses += 1
+		return nil, cache.ErrNotFound
+	}
+	c.metrics.GetHits += 1
+	item := c.options.Allocator.Alloc(len(it.Value))
+	copy(item.Value, it.Value)
+	item.Key = it.Key
+	item.Timestamp = it.Timestamp
+	item.TTL = it.TTL
+	item.Flags = it.Flags
+	item.Cas = it.Cas
+	item.Stale = it.Stale
+	item.MD5 = it.MD5
+	return item, nil
+}
+
+func (c *InMemoryCache) GetMulti(keys []string, maxSize int64) ([]*cache.Item, []error) {
+	items := make([]*cache.Item, len(keys))
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		items[i], errs[i] = c.Get(key)
+		if errs[i] == nil && int64(len(items[i].Value)) > maxSize {
+			items[i].Free()
+			items[i], errs[i] = nil, cache.ErrValueSize
+		}
 	}
-	c.metrics.GetMisses += 1
-	return item, cache.ErrNotFound
+	return items, errs
+}
+
+func (c *InMemoryCache) GetReader(key string, minSize int64, verifyCrc bool) (*cache.Item, cache.ValueReader, error) {
+	item, err := c.Get(key)
+	if err != nil || int64(len(item.Value)) < minSize {
+		return item, nil, err
+	}
+	r := &inMemoryReader{bytes.NewReader(append([]byte(nil), item.Value...))}
+	item.Value = item.Value[:0]
+	return item, r, nil
+}
+
+type inMemoryReader struct {
+	*bytes.Reader
+}
+
+func (r *inMemoryReader) Close() error {
+	return nil
+}
+
+type inMemoryUpload struct {
+	key   string
+	parts map[int][]byte
+}
+
+func (c *InMemoryCache) BeginUpload(key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cas++
+	id := strconv.FormatUint(c.cas, 16)
+	c.uploads[id] = &inMemoryUpload{key: strings.Clone(key), parts: make(map[int][]byte)}
+	return id, nil
+}
+
+func (c *InMemoryCache) NewPartWriter(id string, n int, size int64) (cache.ValueWriter, error) {
+	if n < 1 || n > cache.MaxUploadParts {
+		return nil, cache.ErrInvalidPart
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.uploads[id] == nil {
+		return nil, cache.ErrNotFound
+	}
+	return &inMemoryPartWriter{inMemoryWriter{c: c, n: size}, id, n}, nil
+}
+
+type inMemoryPartWriter struct {
+	inMemoryWriter
+	id   string
+	part int
+}
+
+func (w *inMemoryPartWriter) Commit(mode cache.StoreMode) error {
+	if int64(w.buf.Len()) != w.n {
+		return cache.ErrShortValue
+	}
+	w.c.mu.Lock()
+	defer w.c.mu.Unlock()
+	u := w.c.uploads[w.id]
+	if u == nil {
+		return cache.ErrNotFound
+	}
+	u.parts[w.part] = w.buf.Bytes()
+	return nil
+}
+
+// CommitUpload stores the concatenated parts as a normal item
+func (c *InMemoryCache) CommitUpload(id string, n int, item *cache.Item) error {
+	if n < 1 || n > cache.MaxUploadParts {
+		return cache.ErrInvalidPart
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u := c.uploads[id]
+	if u == nil {
+		return cache.ErrNotFound
+	}
+	var v []byte
+	for i := 1; i <= n; i++ {
+		b, ok := u.parts[i]
+		if !ok {
+			return cache.ErrMissingPart
+		}
+		v = append(v, b...)
+	}
+	delete(c.uploads, id)
+	item.Key = u.key
+	item.Value = v
+	c.set(item)
+	item.Value = nil
+	return nil
+}
+
+func (c *InMemoryCache) AbortUpload(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.uploads[id] == nil {
+		return cache.ErrNotFound
+	}
+	delete(c.uploads, id)
+	return nil
+}
+
+func (c *InMemoryCache) GetRange(key string, off, n int64) (*cache.Item, int64, error) {
+	item, err := c.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := int64(len(item.Value))
+	if off < 0 {
+		off += size
+		if off < 0 {
+			off = 0
+		}
+	}
+	if n < 0 || off > size {
+		item.Free()
+		return nil, size, cache.ErrInvalidRange
+	}
+	if n > size-off {
+		n = size - off
+	}
+	item.Value = append(item.Value[:0], item.Value[off:off+n]...)
+	return item, size, nil
+}
+
+func (c *InMemoryCache) Scan(prefix, start string, max int) ([]cache.KeyInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ret []cache.KeyInfo
+	for k, it := range c.m {
+		if strings.HasPrefix(k, prefix) && k >= start {
+			ret = append(ret, cache.KeyInfo{Key: k, Size: int64(len(it.Value)), Timestamp: it.Timestamp,
+				TTL: it.TTL, Flags: it.Flags, Cas: it.Cas, MD5: it.MD5})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	if len(ret) > max {
+		ret = ret[:max]
+	}
+	return ret, nil
 }
 
 func (c *InMemoryCache) Del(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics.DelTotal += 1
+	if _, ok := c.m[key]; !ok {
+		return cache.ErrNotFound
+	}
+	delete(c.m, key)
+	c.updateStats()
+	return nil
+}
+
+func (c *InMemoryCache) DelIfCas(key string, cas uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.metrics.DelTotal += 1
+	it, ok := c.m[key]
+	if !ok {
+		return cache.ErrNotFound
+	}
+	if it.Cas != cas {
+		return cache.ErrCasConflict
+	}
 	delete(c.m, key)
 	c.updateStats()
 	return nil
 }
 
+func (c *InMemoryCache) DelMulti(keys []string) []error {
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = c.Del(key)
+	}
+	return errs
+}
+
+func (c *InMemoryCache) Touch(key string, ttl uint32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it, ok := c.m[key]
+	if !ok {
+		return cache.ErrNotFound
+	}
+	it.TTL = ttl
+	it.Timestamp = time.Now().Unix()
+	c.m[it.Key] = it
+	return nil
+}
+
+func (c *InMemoryCache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = make(map[string]cache.Item)
+	c.tokens = make(map[string]bool)
+	c.updateStats()
+	return nil
+}
+
 func (c *InMemoryCache) updateStats() {
 	c.stats.Keys = uint64(len(c.m))
 	c.stats.Bytes = 0
@@ -59,49 +491,43 @@ func (c *InMemoryCache) updateStats() {
 	c.stats.LastUpdate = time.Now().Unix()
 }
 
+func (c *InMemoryCache) GetStatusByShards() []cache.ShardStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var st cache.ShardStatus
+	st.Cas = c.cas
+	for _, it := range c.m {
+		st.Sizes[bits.Len32(uint32(len(it.Value)))] += 1
+	}
+	return []cache.ShardStatus{st}
+}
+
+func (c *InMemoryCache) ResetMetrics() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = cache.CacheMetrics{}
+}
+
 func (c *InMemoryCache) GetOptions() cache.CacheOptions {
 	return c.options
 }
 
 func (c *InMemoryCache) GetMetrics() cache.CacheMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.metrics
 }
 
 func (c *InMemoryCache) GetMetricsByShards() []cache.CacheMetrics {
-	return []cache.CacheMetrics{c.metrics}
+	return []cache.CacheMetrics{c.GetMetrics()}
 }
 
 func (c *InMemoryCache) GetStats() cache.CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.stats
 }
 
 func (c *InMemoryCache) GetStatsByShards() []cache.CacheStats {
-	return []cache.CacheStats{c.stats}
-}
-
-type DebugAllocator struct {
-	mu  sync.Mutex
-	all map[unsafe.Pointer]bool
-}
-
-func NewDebugAllocator() *DebugAllocator {
-	return &DebugAllocator{all: make(map[unsafe.Pointer]bool)}
-}
-
-func (a *DebugAllocator) Free(b []byte) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	p := unsafe.Pointer(&b[0])
-	if !a.all[p] {
-		panic(p)
-	}
-}
-
-func (a *DebugAllocator) Malloc(n int) []byte {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	b := make([]byte, n)
-	p := unsafe.Pointer(&b[0])
-	a.all[p] = true
-	return b
+	return []cache.CacheStats{c.GetStats()}
 }
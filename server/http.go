@@ -0,0 +1,310 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xiaost/blobcached/cache"
+)
+
+const (
+	httpKeysPrefix = "/v1/keys/"
+
+	HeaderFlags = "X-Blobcached-Flags" // flags of the item
+	HeaderTTL   = "X-Blobcached-Ttl"   // ttl of the item in seconds, 0 for never expired
+)
+
+// HTTPServer serves the cache with REST API `GET|HEAD|PUT|DELETE /v1/keys/{key}`
+type HTTPServer struct {
+	l         net.Listener
+	cache     Cache
+	allocator cache.Allocator
+	srv       http.Server
+}
+
+func NewHTTPServer(l net.Listener, cache Cache, allocator cache.Allocator) *HTTPServer {
+	s := &HTTPServer{l: l, cache: cache, allocator: allocator}
+	s.srv.Handler = s
+	s.srv.ReadHeaderTimeout = 60 * time.Second
+	s.srv.IdleTimeout = 48 * time.Hour
+	return s
+}
+
+// Serv serves the listener until Shutdown, it returns http.ErrServerClosed after Shutdown
+func (s *HTTPServer) Serv() error {
+	log.Printf("http server listening on %s", s.l.Addr())
+	return s.srv.Serve(s.l)
+}
+
+// Shutdown stops the server gracefully
+func (s *HTTPServer) Shutdown() error {
+	return s.srv.Shutdown(context.Background())
+}
+
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, httpKeysPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	key := r.URL.Path[len(httpKeysPrefix):]
+	if key == "" {
+		http.Error(w, "empty key", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		s.HandleGet(w, r, key)
+	case "PUT":
+		s.HandlePut(w, r, key)
+	case "DELETE":
+		s.HandleDelete(w, r, key)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleGet writes the value of key, or the part of value for single byte-range requests
+func (s *HTTPServer) HandleGet(w http.ResponseWriter, r *http.Request, key string) {
+	item, rd, rg, err := getItemForRequest(s.cache, r, key)
+	switch err {
+	case nil:
+	case cache.ErrNotFound:
+		http.NotFound(w, r)
+		return
+	case cache.ErrInvalidRange:
+		w.Header().Set("Content-Range", rg.ContentRange())
+		http.Error(w, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+		return
+	default:
+		log.Printf("http get key %s err: %s", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer item.Free()
+	if rd != nil {
+		defer rd.Close()
+	}
+	writeItemHeader(w.Header(), item)
+	writeItemValue(w, r, item, rd, rg)
+}
+
+// itemRange is the byte-range of the item value in response
+type itemRange struct {
+	Partial bool
+	Off     int64
+	Len     int64
+	Size    int64 // size of the whole value
+}
+
+// ContentRange returns the Content-Range header for partial contents or unsatisfied ranges
+func (rg *itemRange) ContentRange() string {
+	size := strconv.FormatInt(rg.Size, 10)
+	if !rg.Partial {
+		return "bytes */" + size
+	}
+	return "bytes " + strconv.FormatInt(rg.Off, 10) + "-" + strconv.FormatInt(rg.Off+rg.Len-1, 10) + "/" + size
+}
+
+// getItemForRequest returns the item of key for GET and HEAD requests with a single byte-range of the Range header,
+// the value is empty for HEAD requests. it returns cache.ErrInvalidRange if the range is not satisfiable.
+// the whole value of GET requests is returned by the reader if it's large, which must be closed by the caller.
+func getItemForRequest(c Cache, r *http.Request, key string) (*cache.Item, cache.ValueReader, *itemRange, error) {
+	var off, n int64 // metadata only for HEAD requests
+	var partial bool
+	if r.Method != "HEAD" {
+		// multiple ranges are ignored and the whole value is sent
+		if rg := r.Header.Get("Range"); rg != "" {
+			off, n, partial = parseRange(rg)
+		}
+		if !partial {
+			// the value may be larger than cache.MaxValueSize
+			item, rd, err := c.GetReader(key, sendfileSize, true)
+			if err != nil {
+				return nil, nil, &itemRange{}, err
+			}
+			size := int64(len(item.Value))
+			if rd != nil {
+				size = rd.Size()
+			}
+			return item, rd, &itemRange{Size: size}, nil
+		}
+	}
+	item, size, err := c.GetRange(key, off, n)
+	rg := &itemRange{Size: size}
+	if err != nil {
+		return nil, nil, rg, err
+	}
+	if partial && len(item.Value) == 0 { // empty value or off == size
+		item.Free()
+		return nil, nil, rg, cache.ErrInvalidRange
+	}
+	if partial {
+		rg.Partial = true
+		rg.Len = int64(len(item.Value))
+		rg.Off = size - int64(len(item.Value)) // suffix range
+		if off >= 0 {
+			rg.Off = off
+		}
+	}
+	return item, nil, rg, nil
+}
+
+// writeItemValue writes the value with the status 200 or 206, and the value is not written for HEAD requests.
+// the value is copied from rd instead of item.Value if rd is not nil.
+func writeItemValue(w http.ResponseWriter, r *http.Request, item *cache.Item, rd cache.ValueReader, rg *itemRange) {
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	if !rg.Partial {
+		h.Set("Content-Length", strconv.FormatInt(rg.Size, 10))
+		w.WriteHeader(http.StatusOK)
+	} else {
+		h.Set("Content-Range", rg.ContentRange())
+		h.Set("Content-Length", strconv.Itoa(len(item.Value)))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+	if rd != nil {
+		io.Copy(w, rd)
+	} else {
+		w.Write(item.Value)
+	}
+}
+
+// writeItemHeader sets the headers of item except the length
+func writeItemHeader(h http.Header, item *cache.Item) {
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("ETag", `"`+strconv.FormatUint(item.Cas, 10)+`"`)
+	h.Set("Last-Modified", time.Unix(item.Timestamp, 0).UTC().Format(http.TimeFormat))
+	h.Set(HeaderFlags, strconv.FormatUint(uint64(item.Flags), 10))
+	h.Set(HeaderTTL, strconv.FormatUint(uint64(item.TTL), 10))
+}
+
+// parseRange parses a single byte-range of the Range header,
+// off < 0 for the suffix range like `bytes=-500`. ok is false if it's not a single byte-range.
+func parseRange(s string) (off, n int64, ok bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return 0, 0, false
+	}
+	s = strings.TrimSpace(s[len(prefix):])
+	idx := strings.IndexByte(s, '-')
+	if idx < 0 || strings.IndexByte(s, ',') >= 0 {
+		return 0, 0, false
+	}
+	start, end := strings.TrimSpace(s[:idx]), strings.TrimSpace(s[idx+1:])
+	if start == "" { // suffix range
+		n, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return -n, n, true
+	}
+	off, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || off < 0 {
+		return 0, 0, false
+	}
+	if end == "" {
+		return off, cache.MaxValueSize, true
+	}
+	e, err := strconv.ParseInt(end, 10, 64)
+	if err != nil || e < off {
+		return 0, 0, false
+	}
+	return off, e - off + 1, true
+}
+
+// HandlePut stores the request body as the value of key, the body length must be known
+func (s *HTTPServer) HandlePut(w http.ResponseWriter, r *http.Request, key string) {
+	if r.ContentLength < 0 {
+		http.Error(w, http.StatusText(http.StatusLengthRequired), http.StatusLengthRequired)
+		return
+	}
+	if r.ContentLength > cache.MaxChunkedValueSize {
+		http.Error(w, cache.ErrValueSize.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var flags, ttl uint64
+	var err error
+	if v := r.Header.Get(HeaderFlags); v != "" {
+		if flags, err = strconv.ParseUint(v, 10, 32); err != nil {
+			http.Error(w, "invalid "+HeaderFlags, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.Header.Get(HeaderTTL); v != "" {
+		if ttl, err = strconv.ParseUint(v, 10, 32); err != nil {
+			http.Error(w, "invalid "+HeaderTTL, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if r.ContentLength > streamingSetSize {
+		item := &cache.Item{Key: key, Flags: uint32(flags), TTL: uint32(ttl)}
+		vw, err := s.cache.NewWriter(item, r.ContentLength)
+		if err != nil {
+			log.Printf("http set key %s err: %s", key, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := readBodyTo(vw, r.Body, r.ContentLength); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := vw.Commit(cache.StoreSet); err != nil {
+			log.Printf("http set key %s err: %s", key, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", `"`+strconv.FormatUint(item.Cas, 10)+`"`)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	item := s.allocator.Alloc(int(r.ContentLength))
+	defer item.Free()
+	if _, err := io.ReadFull(r.Body, item.Value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	item.Key = key
+	item.Flags = uint32(flags)
+	item.TTL = uint32(ttl)
+	if err := s.cache.Set(item); err != nil {
+		log.Printf("http set key %s err: %s", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", `"`+strconv.FormatUint(item.Cas, 10)+`"`)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readBodyTo copies the body of n bytes to vw for values too large to buffer
+func readBodyTo(vw cache.ValueWriter, body io.Reader, n int64) error {
+	m, err := vw.ReadFrom(io.LimitReader(body, n))
+	if err == nil && m != n {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (s *HTTPServer) HandleDelete(w http.ResponseWriter, r *http.Request, key string) {
+	err := s.cache.Del(key)
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case cache.ErrNotFound:
+		http.NotFound(w, r)
+	default:
+		log.Printf("http del key %s err: %s", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/xiaost/blobcached/cache"
+)
+
+func TestHTTPServer(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewHTTPServer(l, NewInMemoryCache(), cache.NewAllocatorPool(4096))
+	go s.Serv()
+	defer s.Shutdown()
+
+	url := "http://" + l.Addr().String() + "/v1/keys/k1"
+	do := func(method string, header http.Header, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != nil {
+			req.Header = header
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		b, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp, string(b)
+	}
+
+	if rsp, _ := do("GET", nil, ""); rsp.StatusCode != http.StatusNotFound {
+		t.Fatal("get should not found", rsp.Status)
+	}
+	rsp, _ := do("PUT", http.Header{HeaderFlags: {"7"}, HeaderTTL: {"100"}}, "0123456789")
+	if rsp.StatusCode != http.StatusNoContent || rsp.Header.Get("ETag") == "" {
+		t.Fatal("put err", rsp.Status, rsp.Header)
+	}
+	etag := rsp.Header.Get("ETag")
+
+	rsp, body := do("GET", nil, "")
+	if rsp.StatusCode != http.StatusOK || body != "0123456789" ||
+		rsp.Header.Get(HeaderFlags) != "7" || rsp.Header.Get(HeaderTTL) != "100" || rsp.Header.Get("ETag") != etag {
+		t.Fatal("get err", rsp.Status, body, rsp.Header)
+	}
+	rsp, body = do("HEAD", nil, "")
+	if rsp.StatusCode != http.StatusOK || body != "" || rsp.ContentLength != 10 || rsp.Header.Get(HeaderFlags) != "7" {
+		t.Fatal("head err", rsp.Status, body, rsp.Header)
+	}
+
+	for _, tc := range []struct {
+		rg, contentRange, body string
+	}{
+		{"bytes=2-4", "bytes 2-4/10", "234"},
+		{"bytes=8-", "bytes 8-9/10", "89"},
+		{"bytes=8-100", "bytes 8-9/10", "89"},
+		{"bytes=-3", "bytes 7-9/10", "789"},
+		{"bytes=-100", "bytes 0-9/10", "0123456789"},
+	} {
+		rsp, body := do("GET", http.Header{"Range": {tc.rg}}, "")
+		if rsp.StatusCode != http.StatusPartialContent || rsp.Header.Get("Content-Range") != tc.contentRange || body != tc.body {
+			t.Fatal("range err", tc.rg, rsp.Status, rsp.Header.Get("Content-Range"), body)
+		}
+	}
+	for _, rg := range []string{"bytes=10-", "bytes=20-30"} {
+		rsp, _ := do("GET", http.Header{"Range": {rg}}, "")
+		if rsp.StatusCode != http.StatusRequestedRangeNotSatisfiable || rsp.Header.Get("Content-Range") != "bytes */10" {
+			t.Fatal("range should not satisfiable", rg, rsp.Status)
+		}
+	}
+	// multiple ranges are not supported
+	if rsp, body := do("GET", http.Header{"Range": {"bytes=0-1,3-4"}}, ""); rsp.StatusCode != http.StatusOK || body != "0123456789" {
+		t.Fatal("multiple ranges err", rsp.Status, body)
+	}
+
+	// large values are written and read by streaming
+	large := strings.Repeat("0123456789", streamingSetSize/10+1)
+	if rsp, _ := do("PUT", nil, large); rsp.StatusCode != http.StatusNoContent || rsp.Header.Get("ETag") == "" {
+		t.Fatal("put large err", rsp.Status)
+	}
+	if rsp, body := do("GET", nil, ""); rsp.StatusCode != http.StatusOK || body != large || rsp.ContentLength != int64(len(large)) {
+		t.Fatal("get large err", rsp.Status, len(body))
+	}
+
+	if rsp, _ := do("PUT", http.Header{HeaderTTL: {"x"}}, "v"); rsp.StatusCode != http.StatusBadRequest {
+		t.Fatal("put with invalid ttl should fail", rsp.Status)
+	}
+	if rsp, _ := do("POST", nil, ""); rsp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("post should not allowed", rsp.Status)
+	}
+	if rsp, _ := do("DELETE", nil, ""); rsp.StatusCode != http.StatusNoContent {
+		t.Fatal("delete err", rsp.Status)
+	}
+	if rsp, _ := do("DELETE", nil, ""); rsp.StatusCode != http.StatusNotFound {
+		t.Fatal("delete should not found", rsp.Status)
+	}
+}
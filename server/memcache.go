@@ -3,6 +3,7 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -10,95 +11,369 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/xiaost/blobcached/cache"
 	"github.com/xiaost/blobcached/protocol/memcache"
+	"github.com/xiaost/blobcached/protocol/memcachebin"
 )
 
-var errNotSupportedCommand = errors.New("not supported command")
+var (
+	ErrServerClosed = errors.New("server closed")
+
+	errNotSupportedCommand = errors.New("not supported command")
+	errQuit                = errors.New("quit")
+	errBadDataChunk        = errors.New("bad data chunk")
+	errLineTooLong         = errors.New("line too long")
+)
+
+const (
+	// values larger than streamingSetSize are copied to the cache in chunks instead of buffering the whole value
+	streamingSetSize = 1 << 20
+
+	// values not smaller than sendfileSize are sent from the data file by sendfile without copying to memory
+	sendfileSize = 64 << 10
+
+	// keys are at most maxLongKeyLen bytes if long keys are hashed by the cache,
+	// with a larger read buffer for the command lines of them
+	maxLongKeyLen   = 8 << 10
+	longKeyReadSize = 16 << 10
+
+	// command lines longer than the read buffer are copied until maxLineLen like multigets of long keys
+	maxLineLen = 1 << 20
+)
+
+// requestTimeout is the deadline of processing a request, and the max time between the reads of its data block
+var requestTimeout = 60 * time.Second
 
 type ServerMetrics struct {
 	BytesRead        uint64 // Total number of bytes read by this server
 	BytesWritten     uint64 // Total number of bytes sent by this server
 	CurrConnections  int64  // Number of active connections
 	TotalConnections uint64 // Total number of connections opened since the server started running
+	CmdFlush         uint64 // Total number of flush requests
 }
 
+type ServerOptions struct {
+	Version         string // reported by version and stats commands
+	Verbosity       int    // the initial log level, changed by verbosity command
+	EnableShutdown  bool   // enable shutdown command
+	SkipSendfileCrc bool   // skip verifying the checksum of values sent by sendfile
+}
+
+var DefaultServerOptions = ServerOptions{
+	Version:   "1.0",
+	Verbosity: LogError,
+}
+
+// log levels of verbosity
+const (
+	LogError = 0 // errors of connections and requests
+	LogInfo  = 1 // connections opened and closed
+	LogDebug = 2 // every request
+)
+
 type MemcacheServer struct {
 	l         net.Listener
 	cache     Cache
 	allocator cache.Allocator
+	options   ServerOptions
 	metrics   ServerMetrics
+	verbosity int32
 
 	startTime time.Time
+
+	mu         sync.Mutex
+	flushTimer *time.Timer // the pending flush_all with delay
+	closed     bool
+	listeners  map[io.Closer]struct{} // net.Listener or net.PacketConn
+	conns      map[net.Conn]bool      // conn -> idle
+	wg         sync.WaitGroup         // for active conns
 }
 
-func NewMemcacheServer(l net.Listener, cache Cache, allocator cache.Allocator) *MemcacheServer {
-	return &MemcacheServer{l: l, cache: cache, allocator: allocator}
+func NewMemcacheServer(l net.Listener, cache Cache, allocator cache.Allocator, options *ServerOptions) *MemcacheServer {
+	if options == nil {
+		options = &ServerOptions{}
+		*options = DefaultServerOptions
+	}
+	s := &MemcacheServer{l: l, cache: cache, allocator: allocator, options: *options}
+	s.verbosity = int32(options.Verbosity)
+	s.startTime = time.Now()
+	s.listeners = make(map[io.Closer]struct{})
+	s.conns = make(map[net.Conn]bool)
+	return s
 }
 
+// Serv serves the listener until Shutdown, it returns ErrServerClosed after all connections closed
 func (s *MemcacheServer) Serv() error {
-	s.startTime = time.Now()
-	log.Printf("memcache server listening on %s", s.l.Addr())
+	err := s.ServListener(s.l)
+	if err == ErrServerClosed {
+		s.wg.Wait()
+	}
+	return err
+}
+
+// ServListener serves an additional listener with the same cache and metrics, like a binary protocol port
+func (s *MemcacheServer) ServListener(l net.Listener) error {
+	return s.servListener(l, "memcache", s.Handle)
+}
+
+// servListener accepts conns of l and processes them by handle until the server closed
+func (s *MemcacheServer) servListener(l net.Listener, name string, handle func(conn net.Conn)) error {
+	if !s.addListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	log.Printf("%s server listening on %s", name, l.Addr())
 	for {
-		conn, err := s.l.Accept()
+		conn, err := l.Accept()
 		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
 			return err
 		}
-		if tcpconn, ok := conn.(*net.TCPConn); ok {
+		rawconn := conn
+		if tlsconn, ok := conn.(*tls.Conn); ok {
+			rawconn = tlsconn.NetConn()
+		}
+		if tcpconn, ok := rawconn.(*net.TCPConn); ok {
 			tcpconn.SetKeepAlive(true)
 			tcpconn.SetKeepAlivePeriod(30 * time.Second)
 		}
+		if !s.addConn(conn) {
+			conn.Close()
+			continue
+		}
 		atomic.AddUint64(&s.metrics.TotalConnections, 1)
 		go func(conn net.Conn) {
 			atomic.AddInt64(&s.metrics.CurrConnections, 1)
-
-			s.Handle(conn)
+			if err := s.handshake(conn); err != nil {
+				if !s.isClosed() {
+					log.Printf("client %s handshake err: %s", conn.RemoteAddr(), err)
+				}
+			} else {
+				if subject, ok := ClientCertSubject(conn); ok {
+					s.logf(LogInfo, "client %s connected, subject: %s", conn.RemoteAddr(), subject)
+				} else {
+					s.logf(LogInfo, "client %s connected", conn.RemoteAddr())
+				}
+				handle(conn)
+			}
 			conn.Close()
 
+			s.logf(LogInfo, "client %s closed", conn.RemoteAddr())
 			atomic.AddInt64(&s.metrics.CurrConnections, -1)
+			s.delConn(conn)
 		}(conn)
 	}
 }
 
+// handshake completes the handshake of TLS conns before handling them, so handlers can get the client certificate.
+// the conn is idle during the handshake, which is interrupted by Shutdown.
+func (s *MemcacheServer) handshake(conn net.Conn) error {
+	tlsconn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tlsconn.SetDeadline(time.Now().Add(60 * time.Second))
+	if !s.setConnIdle(conn, true) {
+		return ErrServerClosed
+	}
+	defer s.setConnIdle(conn, false)
+	return tlsconn.Handshake()
+}
+
+// Shutdown stops the server gracefully: listeners and idle connections are closed at once,
+// active connections are closed after their processing requests finished.
+func (s *MemcacheServer) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn, idle := range s.conns {
+		if idle { // wake up the reading
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+}
+
+func (s *MemcacheServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *MemcacheServer) addListener(l io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *MemcacheServer) addConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = false
+	s.wg.Add(1)
+	return true
+}
+
+func (s *MemcacheServer) delConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// setConnIdle marks conn idle while waiting for requests, it returns false if the server is closed
+func (s *MemcacheServer) setConnIdle(conn net.Conn, idle bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = idle
+	return true
+}
+
+// logf logs if the verbosity of server >= level
+func (s *MemcacheServer) logf(level int, format string, args ...interface{}) {
+	if int(atomic.LoadInt32(&s.verbosity)) >= level {
+		log.Printf(format, args...)
+	}
+}
+
+// readMemcacheLine reads a command line, the line is only valid until the next read
+func readMemcacheLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		b := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull && len(b) <= maxLineLen {
+			line, err = r.ReadSlice('\n')
+			b = append(b, line...)
+		}
+		if len(b) > maxLineLen {
+			return nil, errLineTooLong
+		}
+		line = b
+	}
+	return line, err
+}
+
 func (s *MemcacheServer) Handle(conn net.Conn) {
-	const maxReadPerRequest = 2 * cache.MaxValueSize
-	r := &io.LimitedReader{R: conn, N: maxReadPerRequest}
-	w := &WriterCounter{conn, 0}
+	const maxReadPerRequest = cache.MaxChunkedValueSize + 4096 // the data block of streaming set
+	dr := &deadlineReader{conn: conn}
+	r := &io.LimitedReader{R: dr, N: maxReadPerRequest}
+	w := NewBufferedWriter(conn)
+	defer w.Flush()
 	var rbuf *bufio.Reader
+	parser := memcache.Parser{MaxKeyLen: s.maxKeyLen()}
+	readSize := 4096
+	if parser.MaxKeyLen > memcache.MaxKeyLen {
+		readSize = longKeyReadSize
+	}
 	for {
+		// the rsps of pipelined requests are sent at once, and flushed before blocking on reading.
+		// it's flushed with the deadline of the last request.
+		if !pipelined(rbuf) {
+			if err := w.Flush(); err != nil {
+				log.Printf("write %s err: %s", conn.RemoteAddr(), err)
+				return
+			}
+		}
+
 		atomic.AddUint64(&s.metrics.BytesRead, uint64(maxReadPerRequest-r.N))
 		atomic.AddUint64(&s.metrics.BytesWritten, uint64(w.N))
 
 		r.N = maxReadPerRequest
 		w.N = 0
 
+		dr.timeout = 0
 		conn.SetDeadline(time.Now().Add(48 * time.Hour))
 
 		if rbuf == nil {
-			rbuf = bufio.NewReader(r)
+			rbuf = bufio.NewReaderSize(r, readSize)
+		}
+
+		// wait for the next request
+		if !s.setConnIdle(conn, true) {
+			return
+		}
+		magic, err := rbuf.Peek(1)
+		s.setConnIdle(conn, false)
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				log.Printf("read %s err: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		// binary protocol requests start with the magic byte
+		if magic[0] == memcachebin.MagicRequest {
+			conn.SetDeadline(time.Now().Add(requestTimeout))
+			dr.timeout = requestTimeout
+			if err := s.HandleBinary(w, rbuf); err != nil {
+				if err != io.EOF && err != errQuit {
+					log.Printf("client %s process err: %s", conn.RemoteAddr(), err)
+				}
+				return
+			}
+			continue
+		}
+
+		b, err := readMemcacheLine(rbuf)
+		if err == errLineTooLong {
+			w.Write(memcache.MakeRspClientErr(err))
+			return
 		}
-		b, err := rbuf.ReadSlice('\n')
 		if err != nil {
 			if err != io.EOF {
 				log.Printf("read %s err: %s", conn.RemoteAddr(), err)
 			}
 			return
 		}
-		advance, cmdinfo, err := memcache.ParseCommand(b)
+		advance, cmdinfo, err := parser.Parse(b)
 		if err != nil {
 			log.Printf("parse %s command err: %s", conn.RemoteAddr(), err)
 			w.Write(memcache.MakeRspClientErr(err))
 			return
 		}
+		// the strings of cmdinfo are only valid until the next command, see Cache
 		if advance != len(b) {
 			panic("advance != len(b)")
 		}
+		s.logf(LogDebug, "client %s command: %s", conn.RemoteAddr(), bytes.TrimSpace(b))
 
 		// avoid blocking on reading data block or writing rsp
-		conn.SetDeadline(time.Now().Add(60 * time.Second))
+		conn.SetDeadline(time.Now().Add(requestTimeout))
+		dr.timeout = requestTimeout
+
+		// the data block may arrive slowly, don't hold the rsps of previous requests until it's read
+		if hasDataBlock(cmdinfo.Cmd) && int64(rbuf.Buffered()) < cmdinfo.PayloadLen+2 {
+			if err := w.Flush(); err != nil {
+				log.Printf("write %s err: %s", conn.RemoteAddr(), err)
+				return
+			}
+		}
 
 		var ww io.Writer = w
 		if cmdinfo.NoReply {
@@ -106,18 +381,57 @@ func (s *MemcacheServer) Handle(conn net.Conn) {
 		}
 
 		switch cmdinfo.Cmd {
-		case "get", "gets":
-			// some clients always use "gets" instead of "get"
-			// we implement "gets" with fake cas uniq
+		case "get", "gets", "gat", "gats":
 			err = s.HandleGet(ww, cmdinfo)
-		case "set":
+		case "getrange":
+			err = s.HandleGetRange(ww, cmdinfo)
+		case "set", "add", "replace", "append", "prepend", "cas":
 			err = s.HandleSet(ww, rbuf, cmdinfo)
 		case "delete":
 			err = s.HandleDel(ww, cmdinfo)
+		case "incr", "decr":
+			err = s.HandleIncrDecr(ww, cmdinfo)
 		case "touch":
 			err = s.HandleTouch(ww, cmdinfo)
 		case "stats":
-			err = s.HandleStats(ww)
+			err = s.HandleStats(ww, cmdinfo.Keys)
+		case "flush_all":
+			err = s.HandleFlushAll(ww, cmdinfo)
+		case "mpbegin":
+			err = s.HandleMultipartBegin(w, cmdinfo)
+		case "mpput":
+			err = s.HandleMultipartPut(ww, rbuf, cmdinfo)
+		case "mpcommit":
+			err = s.HandleMultipartCommit(ww, cmdinfo)
+		case "mpabort":
+			err = s.HandleMultipartAbort(ww, cmdinfo)
+		case "mg":
+			err = s.HandleMetaGet(ww, cmdinfo)
+		case "ms":
+			err = s.HandleMetaSet(ww, rbuf, cmdinfo)
+		case "md":
+			err = s.HandleMetaDelete(ww, cmdinfo)
+		case "ma":
+			err = s.HandleMetaArithmetic(ww, cmdinfo)
+		case "me":
+			err = s.HandleMetaDebug(ww, cmdinfo)
+		case "mn":
+			_, err = ww.Write(memcache.RspMetaMN)
+		case "version":
+			_, err = ww.Write([]byte("VERSION " + s.options.Version + "\r\n"))
+		case "verbosity":
+			atomic.StoreInt32(&s.verbosity, int32(cmdinfo.Level))
+			_, err = ww.Write(memcache.RspOK)
+		case "quit":
+			return
+		case "shutdown":
+			if !s.options.EnableShutdown {
+				_, err = ww.Write(memcache.RspShutdownDisabled)
+				break
+			}
+			log.Printf("client %s shutdown the server", conn.RemoteAddr())
+			s.Shutdown()
+			return
 		default:
 			ww.Write(memcache.MakeRspServerErr(errNotSupportedCommand))
 			return
@@ -137,62 +451,245 @@ func (s *MemcacheServer) Handle(conn net.Conn) {
 }
 
 func (s *MemcacheServer) HandleSet(w io.Writer, r *bufio.Reader, cmdinfo *memcache.CommandInfo) error {
-	if cmdinfo.PayloadLen > cache.MaxValueSize-4096 {
-		w.Write(memcache.MakeRspClientErr(cache.ErrValueSize))
-		return cache.ErrValueSize
+	if cmdinfo.PayloadLen > streamingSetSize && cmdinfo.Cmd != "append" && cmdinfo.Cmd != "prepend" {
+		return s.handleStreamingSet(w, r, cmdinfo)
 	}
-
-	item := s.allocator.Alloc(int(cmdinfo.PayloadLen) + 2) // including \r\n
-	defer item.Free()
-
-	_, err := io.ReadFull(r, item.Value)
+	item, err := s.readItem(w, r, cmdinfo.PayloadLen)
 	if err != nil {
 		return err
 	}
+	defer item.Free()
+
 	item.Key = cmdinfo.Key
-	item.Value = item.Value[:len(item.Value)-2] // remove \r\n
 	item.Flags = cmdinfo.Flags
 
-	/* https://github.com/memcached/memcached/blob/master/doc/protocol.txt
-
-	Expiration times
-	----------------
+	var expired bool
+	item.TTL, expired = exptimeToTTL(cmdinfo.Exptime)
+	// append & prepend ignore flags and exptime
+	if expired && cmdinfo.Cmd != "append" && cmdinfo.Cmd != "prepend" {
+		return writeStoreRsp(w, s.storeExpired(cmdinfo.Key, cmdinfo.CasUnique, storeMode(cmdinfo.Cmd)))
+	}
 
-	Some commands involve a client sending some kind of expiration time
-	(relative to an item or to an operation requested by the client) to
-	the server. In all such cases, the actual value sent may either be
-	Unix time (number of seconds since January 1, 1970, as a 32-bit
-	value), or a number of seconds starting from current time. In the
-	latter case, this number of seconds may not exceed 60*60*24*30 (number
-	of seconds in 30 days); if the number sent by a client is larger than
-	that, the server will consider it to be real Unix time value rather
-	than an offset from current time.
+	switch cmdinfo.Cmd {
+	case "append":
+		err = s.cache.Append(item)
+	case "prepend":
+		err = s.cache.Prepend(item)
+	case "add":
+		err = s.cache.Add(item)
+	case "replace":
+		err = s.cache.Replace(item)
+	case "cas":
+		item.Cas = cmdinfo.CasUnique
+		err = s.cache.CompareAndSwap(item)
+	default:
+		err = s.cache.Set(item)
+	}
+	return writeStoreRsp(w, err)
+}
 
-	*/
-	if cmdinfo.Exptime <= 30*86400 {
-		item.TTL = cmdinfo.Exptime
-	} else {
-		now := time.Now().Unix()
-		if now >= int64(cmdinfo.Exptime) {
-			_, err = w.Write(memcache.RspStored)
+// handleStreamingSet copies the data block of set, add, replace and cas to the cache in chunks,
+// the item is stored only if the data block ends with \r\n.
+func (s *MemcacheServer) handleStreamingSet(w io.Writer, r *bufio.Reader, cmdinfo *memcache.CommandInfo) error {
+	n := cmdinfo.PayloadLen
+	if n > cache.MaxChunkedValueSize {
+		w.Write(memcache.MakeRspClientErr(cache.ErrValueSize))
+		return cache.ErrValueSize
+	}
+	mode := storeMode(cmdinfo.Cmd)
+	item := &cache.Item{Key: cmdinfo.Key, Flags: cmdinfo.Flags, Cas: cmdinfo.CasUnique}
+	ttl, expired := exptimeToTTL(cmdinfo.Exptime)
+	var err error
+	if expired {
+		err = s.storeExpired(item.Key, item.Cas, mode)
+	} else if mode != cache.StoreSet {
+		// checked before reserving the space, which may evict other items
+		err = s.cache.CanStore(item, mode)
+	}
+	if expired || err != nil {
+		if _, err := r.Discard(int(n) + 2); err != nil {
 			return err
-		} else {
-			item.TTL = uint32(int64(cmdinfo.Exptime) - now)
 		}
+		return writeStoreRsp(w, err)
 	}
 
-	if err := s.cache.Set(item); err != nil {
+	item.TTL = ttl
+	vw, err := s.cache.NewWriter(item, n)
+	if err != nil {
 		w.Write(memcache.MakeRspServerErr(err))
 		return err
 	}
-	_, err = w.Write(memcache.RspStored)
+	if err := readValueTo(w, r, vw, n); err != nil {
+		return err
+	}
+	return writeStoreRsp(w, vw.Commit(mode))
+}
+
+// storeMode returns the StoreMode of set, add, replace and cas
+func storeMode(cmd string) cache.StoreMode {
+	switch cmd {
+	case "add":
+		return cache.StoreAdd
+	case "replace":
+		return cache.StoreReplace
+	case "cas":
+		return cache.StoreCAS
+	}
+	return cache.StoreSet
+}
+
+// storeExpired stores an item of a passed exptime with mode,
+// which removes the existing item instead of storing as it expires immediately.
+func (s *MemcacheServer) storeExpired(key string, cas uint64, mode cache.StoreMode) error {
+	var err error
+	switch mode {
+	case cache.StoreAdd:
+		return s.cache.CanStore(&cache.Item{Key: key}, mode)
+	case cache.StoreCAS:
+		return s.cache.DelIfCas(key, cas)
+	case cache.StoreReplace:
+		if err = s.cache.Del(key); err == cache.ErrNotFound {
+			err = cache.ErrNotStored
+		}
+	default:
+		if err = s.cache.Del(key); err == cache.ErrNotFound {
+			err = nil
+		}
+	}
 	return err
 }
 
+// deadlineReader extends the deadline of conn by timeout before each read if timeout > 0,
+// so the data block of large values only needs to make progress in every timeout instead of arriving at once,
+// and the rsp is written in timeout after the data block.
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if r.timeout > 0 {
+		r.conn.SetDeadline(time.Now().Add(r.timeout))
+	}
+	return r.conn.Read(p)
+}
+
+// maxKeyLen returns the max length of keys, it's maxLongKeyLen if long keys are hashed by the cache
+func (s *MemcacheServer) maxKeyLen() int {
+	if s.cache.GetOptions().HashKeyLen > 0 {
+		return maxLongKeyLen
+	}
+	return memcache.MaxKeyLen
+}
+
+// hasDataBlock returns true if the command line of cmd is followed by a data block of PayloadLen bytes
+func hasDataBlock(cmd string) bool {
+	switch cmd {
+	case "set", "add", "replace", "append", "prepend", "cas", "ms", "mpput":
+		return true
+	}
+	return false
+}
+
+// pipelined returns true if a command line or a whole binary request is buffered in r,
+// the data blocks of text commands are checked by Handle after parsing the command line.
+func pipelined(r *bufio.Reader) bool {
+	if r == nil || r.Buffered() == 0 {
+		return false
+	}
+	b, _ := r.Peek(r.Buffered())
+	if b[0] == memcachebin.MagicRequest {
+		h, err := memcachebin.ParseHeader(b)
+		return err == nil && len(b) >= memcachebin.HeaderLen+int(h.BodyLen)
+	}
+	return bytes.IndexByte(b, '\n') >= 0
+}
+
+// readValueTo copies the data block of n bytes to vw, and checks the trailing \r\n
+func readValueTo(w io.Writer, r *bufio.Reader, vw cache.ValueWriter, n int64) error {
+	m, err := vw.ReadFrom(io.LimitReader(r, n))
+	if err == nil && m != n {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	eol, err := r.Peek(2)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(eol, memcache.EOL) {
+		w.Write(memcache.MakeRspClientErr(errBadDataChunk))
+		return errBadDataChunk
+	}
+	r.Discard(2)
+	return nil
+}
+
+// writeStoreRsp writes the rsp of storage commands by the err of storing
+func writeStoreRsp(w io.Writer, err error) error {
+	switch err {
+	case nil:
+		_, err = w.Write(memcache.RspStored)
+		return err
+	case cache.ErrNotStored:
+		_, err = w.Write(memcache.RspNotStored)
+		return err
+	case cache.ErrCasConflict:
+		_, err = w.Write(memcache.RspExists)
+		return err
+	case cache.ErrNotFound:
+		_, err = w.Write(memcache.RspNotFound)
+		return err
+	case cache.ErrInvalidKey:
+		_, err = w.Write(memcache.MakeRspClientErr(err))
+		return err
+	}
+	w.Write(memcache.MakeRspServerErr(err))
+	return err
+}
+
+// readItem reads the data block of storage commands with the trailing \r\n
+func (s *MemcacheServer) readItem(w io.Writer, r *bufio.Reader, n int64) (*cache.Item, error) {
+	if n > cache.MaxValueSize-4096 {
+		w.Write(memcache.MakeRspClientErr(cache.ErrValueSize))
+		return nil, cache.ErrValueSize
+	}
+	item := s.allocator.Alloc(int(n) + 2) // including \r\n
+	if _, err := io.ReadFull(r, item.Value); err != nil {
+		item.Free()
+		return nil, err
+	}
+	item.Value = item.Value[:n] // remove \r\n
+	return item, nil
+}
+
 func (s *MemcacheServer) HandleGet(w io.Writer, cmdinfo *memcache.CommandInfo) error {
+	// the small values are read in batch, and the large ones are streamed by readers one by one
+	items, errs := s.cache.GetMulti(cmdinfo.Keys, sendfileSize-1)
+	defer func() { // the rest items if the rsp is broken
+		for _, item := range items {
+			if item != nil {
+				item.Free()
+			}
+		}
+	}()
 	var prepend string
-	for _, k := range cmdinfo.Keys {
-		item, err := s.cache.Get(k)
+	for i, k := range cmdinfo.Keys {
+		item, err := items[i], errs[i]
+		items[i] = nil
+		var rd cache.ValueReader
+		if err == cache.ErrValueSize {
+			item, rd, err = s.cache.GetReader(k, sendfileSize, !s.options.SkipSendfileCrc)
+		}
+		if err == nil && (cmdinfo.Cmd == "gat" || cmdinfo.Cmd == "gats") {
+			if err = s.touch(k, cmdinfo.Exptime); err != nil {
+				item.Free()
+				if rd != nil {
+					rd.Close()
+				}
+			}
+		}
 		if err == cache.ErrNotFound {
 			continue
 		}
@@ -200,23 +697,81 @@ func (s *MemcacheServer) HandleGet(w io.Writer, cmdinfo *memcache.CommandInfo) e
 			log.Printf("get key %s err: %s", k, err)
 			continue
 		}
+		size := int64(len(item.Value))
+		if rd != nil {
+			size = rd.Size()
+		}
 		// VALUE <key> <flags> <bytes> [<cas unique>]\r\n
 		// <data block>\r\n
-		if cmdinfo.Cmd == "gets" {
-			fmt.Fprintf(w, "%sVALUE %s %d %d %d\r\n", prepend, k, item.Flags, len(item.Value), 0)
+		if cmdinfo.Cmd == "gets" || cmdinfo.Cmd == "gats" {
+			fmt.Fprintf(w, "%sVALUE %s %d %d %d\r\n", prepend, k, item.Flags, size, item.Cas)
+		} else {
+			fmt.Fprintf(w, "%sVALUE %s %d %d\r\n", prepend, k, item.Flags, size)
+		}
+		if rd != nil {
+			err = writeValue(w, rd)
+			rd.Close()
 		} else {
-			fmt.Fprintf(w, "%sVALUE %s %d %d\r\n", prepend, k, item.Flags, len(item.Value))
+			_, err = w.Write(item.Value)
 		}
-		w.Write(item.Value)
 		item.Free()
+		if err != nil { // the rsp is broken
+			return err
+		}
 		prepend = "\r\n" // reduce len(cmdinfo.Keys) times w.Write("\r\n")
 	}
 	_, err := w.Write([]byte(prepend + "END\r\n"))
 	return err
 }
 
+// HandleGetRange sends at most cmdinfo.Length bytes of the value at cmdinfo.Offset,
+// the checksum is only verified if the range covers the whole value.
+func (s *MemcacheServer) HandleGetRange(w io.Writer, cmdinfo *memcache.CommandInfo) error {
+	n := cmdinfo.Length
+	if n > cache.MaxValueSize {
+		n = cache.MaxValueSize
+	}
+	item, size, err := s.cache.GetRange(cmdinfo.Key, cmdinfo.Offset, n)
+	switch err {
+	case nil:
+	case cache.ErrNotFound:
+		_, err = w.Write(memcache.RspEnd)
+		return err
+	case cache.ErrInvalidRange:
+		_, err = w.Write(memcache.MakeRspClientErr(err))
+		return err
+	default:
+		log.Printf("getrange key %s err: %s", cmdinfo.Key, err)
+		_, err = w.Write(memcache.MakeRspServerErr(err))
+		return err
+	}
+	defer item.Free()
+	// VALUE <key> <flags> <bytes> <cas unique> <total bytes>\r\n
+	// <data block>\r\n
+	fmt.Fprintf(w, "VALUE %s %d %d %d %d\r\n", item.Key, item.Flags, len(item.Value), item.Cas, size)
+	if _, err := w.Write(item.Value); err != nil {
+		return err
+	}
+	_, err = w.Write([]byte("\r\nEND\r\n"))
+	return err
+}
+
+// writeValue copies the value of rd to w, the conn of BufferedWriter is used for sendfile after flushing
+func writeValue(w io.Writer, rd cache.ValueReader) error {
+	if bw, ok := w.(*BufferedWriter); ok {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		n, err := io.Copy(bw.W, rd)
+		bw.N += n
+		return err
+	}
+	_, err := io.Copy(w, rd)
+	return err
+}
+
 func (s *MemcacheServer) HandleTouch(w io.Writer, cmdinfo *memcache.CommandInfo) error {
-	item, err := s.cache.Get(cmdinfo.Key)
+	err := s.touch(cmdinfo.Key, cmdinfo.Exptime)
 	if err != nil {
 		if err == cache.ErrNotFound {
 			_, err = w.Write(memcache.RspNotFound)
@@ -225,29 +780,68 @@ func (s *MemcacheServer) HandleTouch(w io.Writer, cmdinfo *memcache.CommandInfo)
 		}
 		return err
 	}
-	defer item.Free()
+	_, err = w.Write(memcache.RspTouched)
+	return err
+}
+
+// touch updates the exptime of key, the item is deleted if exptime is passed
+func (s *MemcacheServer) touch(key string, exptime uint32) error {
+	ttl, expired := exptimeToTTL(exptime)
+	if !expired {
+		return s.cache.Touch(key, ttl)
+	}
+	// returns ErrNotFound if key not exists
+	if err := s.cache.Touch(key, 0); err != nil {
+		return err
+	}
+	return s.cache.Del(key)
+}
+
+// getAndTouch returns the item of key after updating its exptime
+func (s *MemcacheServer) getAndTouch(key string, exptime uint32) (*cache.Item, error) {
+	item, err := s.cache.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.touch(key, exptime); err != nil {
+		item.Free()
+		return nil, err
+	}
+	return item, nil
+}
 
-	if cmdinfo.Exptime <= 30*86400 {
-		item.TTL = cmdinfo.Exptime
+func (s *MemcacheServer) HandleIncrDecr(w io.Writer, cmdinfo *memcache.CommandInfo) error {
+	var v uint64
+	var err error
+	if cmdinfo.Cmd == "incr" {
+		v, err = s.cache.Incr(cmdinfo.Key, cmdinfo.Delta)
 	} else {
-		now := time.Now().Unix()
-		if now >= int64(cmdinfo.Exptime) { // already expired
-			w.Write(memcache.RspTouched)
-			return s.cache.Del(cmdinfo.Key)
-		} else {
-			item.TTL = uint32(int64(cmdinfo.Exptime) - now)
-		}
+		v, err = s.cache.Decr(cmdinfo.Key, cmdinfo.Delta)
 	}
-	if err := s.cache.Set(item); err != nil {
-		w.Write(memcache.MakeRspServerErr(err))
+	switch err {
+	case nil:
+		_, err = w.Write(strconv.AppendUint(nil, v, 10))
+		if err == nil {
+			_, err = w.Write(memcache.EOL)
+		}
+		return err
+	case cache.ErrNotFound:
+		_, err = w.Write(memcache.RspNotFound)
+		return err
+	case cache.ErrNotNumber:
+		_, err = w.Write(memcache.MakeRspClientErr(err))
 		return err
 	}
-	_, err = w.Write(memcache.RspTouched)
+	w.Write(memcache.MakeRspServerErr(err))
 	return err
 }
 
 func (s *MemcacheServer) HandleDel(w io.Writer, cmdinfo *memcache.CommandInfo) error {
 	err := s.cache.Del(cmdinfo.Key)
+	if err == cache.ErrNotFound {
+		_, err = w.Write(memcache.RspNotFound)
+		return err
+	}
 	if err != nil {
 		w.Write(memcache.MakeRspServerErr(err))
 		return nil
@@ -256,17 +850,198 @@ func (s *MemcacheServer) HandleDel(w io.Writer, cmdinfo *memcache.CommandInfo) e
 	return err
 }
 
-func (s *MemcacheServer) HandleStats(w io.Writer) error {
+func (s *MemcacheServer) HandleFlushAll(w io.Writer, cmdinfo *memcache.CommandInfo) error {
+	if err := s.flushAll(cmdinfo.Exptime); err != nil {
+		w.Write(memcache.MakeRspServerErr(err))
+		return err
+	}
+	_, err := w.Write(memcache.RspOK)
+	return err
+}
+
+// flushAll flushes the cache after delay which is the same as exptime,
+// a new flush_all replaces the pending one.
+func (s *MemcacheServer) flushAll(delay uint32) error {
+	atomic.AddUint64(&s.metrics.CmdFlush, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	ttl, expired := exptimeToTTL(delay)
+	if expired || ttl == 0 {
+		return s.cache.Flush()
+	}
+	s.flushTimer = time.AfterFunc(time.Duration(ttl)*time.Second, func() {
+		if err := s.cache.Flush(); err != nil {
+			log.Printf("flush cache err: %s", err)
+		}
+	})
+	return nil
+}
+
+/* https://github.com/memcached/memcached/blob/master/doc/protocol.txt
+
+Expiration times
+----------------
+
+Some commands involve a client sending some kind of expiration time
+(relative to an item or to an operation requested by the client) to
+the server. In all such cases, the actual value sent may either be
+Unix time (number of seconds since January 1, 1970, as a 32-bit
+value), or a number of seconds starting from current time. In the
+latter case, this number of seconds may not exceed 60*60*24*30 (number
+of seconds in 30 days); if the number sent by a client is larger than
+that, the server will consider it to be real Unix time value rather
+than an offset from current time.
+
+*/
+// exptimeToTTL converts exptime to ttl in seconds, expired is true if exptime is a passed unix time
+func exptimeToTTL(exptime uint32) (ttl uint32, expired bool) {
+	if exptime <= 30*86400 {
+		return exptime, false
+	}
+	now := time.Now().Unix()
+	if now >= int64(exptime) {
+		return 0, true
+	}
+	return uint32(int64(exptime) - now), false
+}
+
+// HandleStats writes the statistics of stats subcommand in args, or resets metrics for `stats reset`
+func (s *MemcacheServer) HandleStats(w io.Writer, args []string) error {
+	var sub string
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	if len(args) > 1 {
+		_, err := w.Write(memcache.RspErr)
+		return err
+	}
+	if sub == "reset" {
+		s.resetStats()
+		_, err := w.Write(memcache.RspReset)
+		return err
+	}
 	var buf bytes.Buffer
-	writeStat := func(name string, v interface{}) {
+	ok := s.collectStats(sub, func(name string, v interface{}) {
 		fmt.Fprintf(&buf, "STAT %s %v\r\n", name, v)
+	})
+	if !ok {
+		_, err := w.Write(memcache.RspErr)
+		return err
 	}
+	buf.Write(memcache.RspEnd)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// resetStats resets the metrics of server and cache
+func (s *MemcacheServer) resetStats() {
+	atomic.StoreUint64(&s.metrics.BytesRead, 0)
+	atomic.StoreUint64(&s.metrics.BytesWritten, 0)
+	atomic.StoreUint64(&s.metrics.TotalConnections, 0)
+	atomic.StoreUint64(&s.metrics.CmdFlush, 0)
+	s.cache.ResetMetrics()
+}
 
+// collectStats calls writeStat with the name and value of each statistic of the stats subcommand,
+// "" for general-purpose statistics. it returns false if the subcommand is not supported.
+func (s *MemcacheServer) collectStats(sub string, writeStat func(name string, v interface{})) bool {
+	switch sub {
+	case "":
+		s.collectGeneralStats(writeStat)
+	case "settings":
+		s.collectSettingsStats(writeStat)
+	case "shards":
+		s.collectShardsStats(writeStat)
+	case "items":
+		s.collectItemsStats(writeStat)
+	case "sizes":
+		s.collectSizesStats(writeStat)
+	default:
+		return false
+	}
+	return true
+}
+
+func (s *MemcacheServer) collectSettingsStats(writeStat func(name string, v interface{})) {
+	options := s.cache.GetOptions()
+	writeStat("maxbytes", options.Size)
+	writeStat("shards", options.ShardNum)
+	writeStat("ttl", options.TTL)
+	writeStat("item_size_max", cache.MaxValueSize)
+	writeStat("gc_enabled", !options.DisableGC)
+	writeStat("verbosity", atomic.LoadInt32(&s.verbosity))
+	writeStat("shutdown_enabled", s.options.EnableShutdown)
+}
+
+// collectShardsStats writes the stats of each shard with the prefix `shard:<index>:`
+func (s *MemcacheServer) collectShardsStats(writeStat func(name string, v interface{})) {
+	stats := s.cache.GetStatsByShards()
+	metrics := s.cache.GetMetricsByShards()
+	status := s.cache.GetStatusByShards()
+	for i := range status {
+		prefix := "shard:" + strconv.Itoa(i) + ":"
+		writeStat(prefix+"curr_items", stats[i].Keys)
+		writeStat(prefix+"bytes", stats[i].Bytes)
+		writeStat(prefix+"cmd_get", metrics[i].GetTotal)
+		writeStat(prefix+"cmd_set", metrics[i].SetTotal)
+		writeStat(prefix+"get_hits", metrics[i].GetHits)
+		writeStat(prefix+"get_misses", metrics[i].GetMisses)
+		writeStat(prefix+"reclaimed", metrics[i].Expired)
+		writeStat(prefix+"evictions", metrics[i].Evicted)
+		writeStat(prefix+"term", status[i].Term)
+		writeStat(prefix+"head", status[i].Head)
+		writeStat(prefix+"datasize", status[i].DataSize)
+		writeStat(prefix+"cas", status[i].Cas)
+		writeStat(prefix+"gc_scanned", status[i].GCScanned)
+		writeStat(prefix+"gc_purged", status[i].GCPurged)
+		writeStat(prefix+"gc_last_finish", status[i].GCLastFinish)
+	}
+}
+
+// collectItemsStats writes the stats of each shard like slab classes of memcached, the class id is shard index + 1
+func (s *MemcacheServer) collectItemsStats(writeStat func(name string, v interface{})) {
+	stats := s.cache.GetStatsByShards()
+	metrics := s.cache.GetMetricsByShards()
+	for i := range stats {
+		prefix := "items:" + strconv.Itoa(i+1) + ":"
+		writeStat(prefix+"number", stats[i].Keys)
+		writeStat(prefix+"evicted", metrics[i].Evicted)
+		writeStat(prefix+"evicted_time", metrics[i].EvictedAge)
+		writeStat(prefix+"reclaimed", metrics[i].Expired)
+	}
+}
+
+// collectSizesStats writes `<n> <count>` for the number of values with size in [n, 2n), and n is 0 for empty values
+func (s *MemcacheServer) collectSizesStats(writeStat func(name string, v interface{})) {
+	var sizes [cache.SizeClasses]uint64
+	for _, st := range s.cache.GetStatusByShards() {
+		for i, n := range st.Sizes {
+			sizes[i] += n
+		}
+	}
+	for i, n := range sizes {
+		if n == 0 {
+			continue
+		}
+		var size int64
+		if i > 0 {
+			size = 1 << uint(i-1)
+		}
+		writeStat(strconv.FormatInt(size, 10), n)
+	}
+}
+
+// collectGeneralStats calls writeStat with the name and value of each general-purpose statistic
+func (s *MemcacheServer) collectGeneralStats(writeStat func(name string, v interface{})) {
 	now := time.Now()
 	writeStat("pid", os.Getpid())
 	writeStat("uptime", int64(now.Sub(s.startTime).Seconds()))
 	writeStat("time", now.Unix())
-	writeStat("version", Version+"(blobcached)")
+	writeStat("version", s.options.Version)
 
 	// options
 	options := s.cache.GetOptions()
@@ -287,14 +1062,11 @@ func (s *MemcacheServer) HandleStats(w io.Writer) error {
 	metrics := s.cache.GetMetrics()
 	writeStat("cmd_get", metrics.GetTotal)
 	writeStat("cmd_set", metrics.SetTotal)
+	writeStat("cmd_flush", atomic.LoadUint64(&s.metrics.CmdFlush))
 	writeStat("get_hits", metrics.GetHits)
 	writeStat("get_misses", metrics.GetMisses)
 	writeStat("get_expired", metrics.GetExpired)
 	writeStat("reclaimed", metrics.Expired)
 	writeStat("evictions", metrics.Evicted)
 	writeStat("last_evicted_age", metrics.EvictedAge)
-
-	buf.Write(memcache.RspEnd)
-	_, err := w.Write(buf.Bytes())
-	return err
 }
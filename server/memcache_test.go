@@ -1,13 +1,18 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/xiaost/blobcached/cache"
 )
 
 func getstat(lines string, name string, value interface{}) {
@@ -20,6 +25,24 @@ func getstat(lines string, name string, value interface{}) {
 	}
 }
 
+// roundtrip writes req to conn and reads the rsp lines until a line has the prefix `end`
+func roundtrip(t *testing.T, conn net.Conn, r *bufio.Reader, req string, end string) string {
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	var rsp string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp += line
+		if strings.HasPrefix(line, end) {
+			return rsp
+		}
+	}
+}
+
 func TestMemcacheServer(t *testing.T) {
 	l, err := net.ListenTCP("tcp", nil)
 	if err != nil {
@@ -27,7 +50,7 @@ func TestMemcacheServer(t *testing.T) {
 	}
 	defer l.Close()
 
-	s := NewMemcacheServer(l, NewInMemoryCache(), NewDebugAllocator())
+	s := NewMemcacheServer(l, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
 	go s.Serv()
 
 	mc := memcache.New(l.Addr().String())
@@ -38,6 +61,54 @@ func TestMemcacheServer(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	if err := mc.Add(&memcache.Item{Key: "k2", Value: []byte("v2-add")}); err != memcache.ErrNotStored {
+		t.Fatal("add existing key should not stored", err)
+	}
+	if err := mc.Replace(&memcache.Item{Key: "k3", Value: []byte("v3")}); err != memcache.ErrNotStored {
+		t.Fatal("replace missing key should not stored", err)
+	}
+
+	it, err := mc.Get("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.Value = []byte("v2-cas")
+	if err := mc.CompareAndSwap(it); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.CompareAndSwap(it); err != memcache.ErrCASConflict {
+		t.Fatal("cas with stale cas unique should conflict", err)
+	}
+
+	if err := mc.Append(&memcache.Item{Key: "k3", Value: []byte("v3")}); err != memcache.ErrNotStored {
+		t.Fatal("append missing key should not stored", err)
+	}
+	if err := mc.Set(&memcache.Item{Key: "k4", Value: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.Append(&memcache.Item{Key: "k4", Value: []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.Prepend(&memcache.Item{Key: "k4", Value: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if it, err := mc.Get("k4"); err != nil || string(it.Value) != "abc" {
+		t.Fatal("append & prepend err", err)
+	}
+
+	if err := mc.Set(&memcache.Item{Key: "n1", Value: []byte("10")}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := mc.Increment("n1", 5); err != nil || v != 15 {
+		t.Fatal("incr err", v, err)
+	}
+	if v, err := mc.Decrement("n1", 20); err != nil || v != 0 {
+		t.Fatal("decr err", v, err)
+	}
+	if _, err := mc.Increment("n-notfound", 1); err != memcache.ErrCacheMiss {
+		t.Fatal("incr should cache miss", err)
+	}
+
 	if err := mc.Touch("k2", 3); err != nil {
 		t.Fatal(err)
 	}
@@ -63,7 +134,7 @@ func TestMemcacheServer(t *testing.T) {
 	if g, e := string(m["k1"].Value), "v1"; g != e {
 		t.Errorf("GetMulti: k1: got %q, want %q", g, e)
 	}
-	if g, e := string(m["k2"].Value), "v2"; g != e {
+	if g, e := string(m["k2"].Value), "v2-cas"; g != e {
 		t.Errorf("GetMulti: k2: got %q, want %q", g, e)
 	}
 
@@ -76,7 +147,7 @@ func TestMemcacheServer(t *testing.T) {
 	}
 
 	var buf bytes.Buffer
-	s.HandleStats(&buf)
+	s.HandleStats(&buf, nil)
 	t.Log("stat\n", buf.String())
 
 	var n int
@@ -86,3 +157,680 @@ func TestMemcacheServer(t *testing.T) {
 	}
 
 }
+
+func TestMemcacheServerGat(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewMemcacheServer(l, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
+	go s.Serv()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	roundtrip(t, conn, r, "set k1 1 0 2\r\nv1\r\n", "STORED")
+	rsp := roundtrip(t, conn, r, "gat 100 k1 k-notfound\r\n", "END")
+	if rsp != "VALUE k1 1 2\r\nv1\r\nEND\r\n" {
+		t.Fatalf("gat rsp err: %q", rsp)
+	}
+	rsp = roundtrip(t, conn, r, "gats 100 k-notfound\r\n", "END")
+	if rsp != "END\r\n" {
+		t.Fatalf("gats rsp err: %q", rsp)
+	}
+	rsp = roundtrip(t, conn, r, "gets k1\r\n", "END")
+	var cas uint64
+	if n, _ := fmt.Sscanf(rsp, "VALUE k1 1 2 %d", &cas); n != 1 {
+		t.Fatalf("gets rsp err: %q", rsp)
+	}
+	// touch updates ttl only, the cas unique is not changed
+	rsp = roundtrip(t, conn, r, "gats 200 k1\r\n", "END")
+	if rsp != fmt.Sprintf("VALUE k1 1 2 %d\r\nv1\r\nEND\r\n", cas) {
+		t.Fatalf("gats rsp err: %q", rsp)
+	}
+}
+
+func TestMemcacheServerFlushAll(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewMemcacheServer(l, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
+	go s.Serv()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	roundtrip(t, conn, r, "set k1 1 0 2\r\nv1\r\n", "STORED")
+	if rsp := roundtrip(t, conn, r, "flush_all 100\r\n", "OK"); rsp != "OK\r\n" {
+		t.Fatalf("flush_all rsp err: %q", rsp)
+	}
+	if rsp := roundtrip(t, conn, r, "get k1\r\n", "END"); rsp != "VALUE k1 1 2\r\nv1\r\nEND\r\n" {
+		t.Fatalf("get before delay rsp err: %q", rsp)
+	}
+	// replaces the pending one
+	roundtrip(t, conn, r, "flush_all 1 noreply\r\nflush_all 1\r\n", "OK")
+	if rsp := roundtrip(t, conn, r, "get k1\r\n", "END"); rsp != "VALUE k1 1 2\r\nv1\r\nEND\r\n" {
+		t.Fatalf("get before delay rsp err: %q", rsp)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if rsp := roundtrip(t, conn, r, "get k1\r\n", "END"); rsp != "END\r\n" {
+		t.Fatalf("get after delay rsp err: %q", rsp)
+	}
+
+	roundtrip(t, conn, r, "set k1 1 0 2\r\nv1\r\n", "STORED")
+	roundtrip(t, conn, r, "flush_all\r\n", "OK")
+	if rsp := roundtrip(t, conn, r, "get k1\r\n", "END"); rsp != "END\r\n" {
+		t.Fatalf("get after flush_all rsp err: %q", rsp)
+	}
+	var n int
+	getstat(roundtrip(t, conn, r, "stats\r\n", "END"), "cmd_flush", &n)
+	if n != 4 {
+		t.Fatal("cmd_flush err", n)
+	}
+}
+
+func TestMemcacheServerShutdown(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewMemcacheServer(l, NewInMemoryCache(), cache.NewAllocatorPool(4096), &ServerOptions{Version: "0.0.1"})
+	go s.Serv()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if rsp := roundtrip(t, conn, r, "version\r\n", "VERSION"); rsp != "VERSION 0.0.1\r\n" {
+		t.Fatalf("version rsp err: %q", rsp)
+	}
+	if rsp := roundtrip(t, conn, r, "verbosity 1\r\n", "OK"); rsp != "OK\r\n" {
+		t.Fatalf("verbosity rsp err: %q", rsp)
+	}
+	if v := atomic.LoadInt32(&s.verbosity); v != LogInfo {
+		t.Fatal("verbosity err", v)
+	}
+	roundtrip(t, conn, r, "verbosity 0 noreply\r\nshutdown\r\n", "ERROR")
+	if v := atomic.LoadInt32(&s.verbosity); v != LogError {
+		t.Fatal("verbosity err", v)
+	}
+	if _, err := conn.Write([]byte("quit\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatal("conn should be closed by quit", err)
+	}
+
+	l, err = net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s = NewMemcacheServer(l, NewInMemoryCache(), cache.NewAllocatorPool(4096), &ServerOptions{EnableShutdown: true})
+	served := make(chan error, 1)
+	go func() { served <- s.Serv() }()
+
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r = bufio.NewReader(conn)
+	roundtrip(t, conn, r, "version\r\n", "VERSION") // make sure the conns accepted
+	if _, err := conn.Write([]byte("shutdown graceful\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatal("conn should be closed by shutdown", err)
+	}
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("idle conn should be closed by shutdown", err)
+	}
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Fatal("serv should return ErrServerClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serv not returned after shutdown")
+	}
+}
+
+func TestMemcacheServerStats(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewMemcacheServer(l, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
+	go s.Serv()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	roundtrip(t, conn, r, "set k1 0 0 1\r\n1\r\n", "STORED")
+	roundtrip(t, conn, r, "set k2 0 0 100\r\n"+strings.Repeat("v", 100)+"\r\n", "STORED")
+	roundtrip(t, conn, r, "set k3 0 0 127\r\n"+strings.Repeat("v", 127)+"\r\n", "STORED")
+
+	rsp := roundtrip(t, conn, r, "stats sizes\r\n", "END")
+	if rsp != "STAT 1 1\r\nSTAT 64 2\r\nEND\r\n" {
+		t.Fatalf("stats sizes rsp err: %q", rsp)
+	}
+	rsp = roundtrip(t, conn, r, "stats shards\r\n", "END")
+	var n int
+	if getstat(rsp, "shard:0:cmd_set", &n); n != 3 {
+		t.Fatalf("stats shards rsp err: %q", rsp)
+	}
+	if getstat(rsp, "shard:0:cas", &n); n != 3 {
+		t.Fatalf("stats shards rsp err: %q", rsp)
+	}
+	rsp = roundtrip(t, conn, r, "stats items\r\n", "END")
+	if getstat(rsp, "items:1:number", &n); n != 3 {
+		t.Fatalf("stats items rsp err: %q", rsp)
+	}
+	rsp = roundtrip(t, conn, r, "stats settings\r\n", "END")
+	var gc bool
+	if getstat(rsp, "gc_enabled", &gc); !gc {
+		t.Fatalf("stats settings rsp err: %q", rsp)
+	}
+
+	if rsp := roundtrip(t, conn, r, "stats reset\r\n", "RESET"); rsp != "RESET\r\n" {
+		t.Fatalf("stats reset rsp err: %q", rsp)
+	}
+	rsp = roundtrip(t, conn, r, "stats\r\n", "END")
+	n = -1
+	if getstat(rsp, "cmd_set", &n); n != 0 {
+		t.Fatalf("stats rsp err: %q", rsp)
+	}
+
+	if rsp := roundtrip(t, conn, r, "stats unknown\r\n", "ERROR"); rsp != "ERROR\r\n" {
+		t.Fatalf("stats unknown rsp err: %q", rsp)
+	}
+}
+
+func TestMemcacheServerMeta(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewMemcacheServer(l, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
+	go s.Serv()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	cases := []struct {
+		req string
+		rsp string
+	}{
+		{"mn\r\n", "MN\r\n"},
+		{"mg k1 v O1 k\r\n", "EN O1 kk1\r\n"},
+		{"mg k1 v q\r\nmn\r\n", "MN\r\n"},
+		{"ms k1 2 T0 F3 MS\r\nv1\r\n", "HD\r\n"},
+		{"ms k1 2 ME O2\r\nv2\r\n", "NS O2\r\n"},
+		{"ms k1 2 q\r\nv3\r\nmn\r\n", "MN\r\n"},
+		{"mg k1 v f s t\r\n", "VA 2 f0 s2 t-1\r\nv3\r\n"},
+		{"mg azE= b k v\r\n", "VA 2 b kazE=\r\nv3\r\n"},
+		{"mg k1 x\r\n", "CLIENT_ERROR invalid flag\r\n"},
+		{"ms k1 2 C1\r\nv4\r\n", "EX\r\n"},
+		{"ms k2 2 C1\r\nv4\r\n", "NF\r\n"},
+		{"md k1 I T30\r\n", "HD\r\n"},
+		{"mg k1 v\r\n", "VA 2 W X\r\nv3\r\n"},
+		{"mg k1 v\r\n", "VA 2 X Z\r\nv3\r\n"},
+		{"ms k1 2\r\nv5\r\n", "HD\r\n"},
+		{"mg k1 v\r\n", "VA 2\r\nv5\r\n"},
+		{"mg k1 s f\r\n", "HD s2 f0\r\n"},
+		{"md k1 C1\r\n", "EX\r\n"},
+		{"md k1 C1 I\r\n", "CLIENT_ERROR invalid flag\r\n"},
+		{"md k1\r\n", "HD\r\n"},
+		{"md k1\r\n", "NF\r\n"},
+		{"md k1 q\r\nmn\r\n", "MN\r\n"},
+		{"ma n1\r\n", "NF\r\n"},
+		{"ma n1 N0 J10 v\r\n", "VA 2\r\n10\r\n"},
+		{"ma n1 D5 v\r\n", "VA 2\r\n15\r\n"},
+		{"ma n1 MD D20 v t\r\n", "VA 1 t-1\r\n0\r\n"},
+		{"ma n1 q\r\nmn\r\n", "MN\r\n"},
+		{"me n2\r\n", "EN\r\n"},
+	}
+	for _, c := range cases {
+		var rsp string
+		for len(rsp) < len(c.rsp) {
+			rsp += roundtrip(t, conn, r, c.req, "")
+			c.req = ""
+		}
+		if rsp != c.rsp {
+			t.Fatalf("req %q: got %q, want %q", c.req, rsp, c.rsp)
+		}
+	}
+	rsp := roundtrip(t, conn, r, "me n1\r\n", "ME")
+	if !strings.HasPrefix(rsp, "ME n1 exp=-1 la=0 cas=") || !strings.HasSuffix(rsp, " fetch=no cls=1 size=1\r\n") {
+		t.Fatalf("me rsp err: %q", rsp)
+	}
+	rsp = roundtrip(t, conn, r, "mg n1 c\r\n", "HD")
+	if rsp = roundtrip(t, conn, r, "md n1 C"+rsp[len("HD c"):], "HD"); rsp != "HD\r\n" {
+		t.Fatalf("md with cas rsp err: %q", rsp)
+	}
+}
+
+func TestMemcacheServerStreamingSet(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c := NewInMemoryCache()
+	s := NewMemcacheServer(l, c, cache.NewAllocatorPool(4096), nil)
+	go s.Serv()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	v := strings.Repeat("0123456789", streamingSetSize/10+1)
+	roundtrip(t, conn, r, fmt.Sprintf("set k1 1 0 %d\r\n%s\r\n", len(v), v), "STORED")
+	// the values not stored are discarded without writing to the cache
+	total := c.GetMetrics().SetTotal
+	for _, tc := range []struct{ req, rsp string }{
+		{"add k1 1 0", "NOT_STORED"},
+		{"replace k2 1 0", "NOT_STORED"},
+		{"cas k1 1 0", "EXISTS"},
+		{"cas k2 1 0", "NOT_FOUND"},
+	} {
+		req := fmt.Sprintf("%s %d", tc.req, len(v))
+		if strings.HasPrefix(tc.req, "cas") {
+			req += " 12345"
+		}
+		rsp := roundtrip(t, conn, r, fmt.Sprintf("%s\r\n%s\r\n", req, v), tc.rsp)
+		if rsp != tc.rsp+"\r\n" {
+			t.Fatalf("%s rsp err: %q", tc.req, rsp)
+		}
+	}
+	if n := c.GetMetrics().SetTotal; n != total {
+		t.Fatal("values not stored should not be written", n, total)
+	}
+	rsp := roundtrip(t, conn, r, "get k1\r\n", "END")
+	if rsp != fmt.Sprintf("VALUE k1 1 %d\r\n%s\r\nEND\r\n", len(v), v) {
+		t.Fatal("get rsp err", len(rsp))
+	}
+	// large values are sent by the reader along with small ones
+	roundtrip(t, conn, r, "set k3 2 0 1\r\nx\r\n", "STORED")
+	rsp = roundtrip(t, conn, r, "gat 100 k3 k1 k3\r\n", "END")
+	if rsp != fmt.Sprintf("VALUE k3 2 1\r\nx\r\nVALUE k1 1 %d\r\n%s\r\nVALUE k3 2 1\r\nx\r\nEND\r\n", len(v), v) {
+		t.Fatal("gat rsp err", len(rsp))
+	}
+
+	// the item is not stored if the data block not ends with \r\n
+	rsp = roundtrip(t, conn, r, fmt.Sprintf("set k2 1 0 %d\r\n%sxx", len(v), v), "CLIENT_ERROR")
+	if rsp != "CLIENT_ERROR bad data chunk\r\n" {
+		t.Fatalf("set rsp err: %q", rsp)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatal("conn should be closed", err)
+	}
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r = bufio.NewReader(conn)
+	if rsp := roundtrip(t, conn, r, "get k2\r\n", "END"); rsp != "END\r\n" {
+		t.Fatalf("get rsp err: %q", rsp)
+	}
+
+	// a passed exptime removes the existing item if it can be stored
+	past := time.Now().Unix() - 10
+	for _, tc := range []struct{ req, rsp string }{
+		{"add k1 1 %d", "NOT_STORED"},
+		{"replace k2 1 %d", "NOT_STORED"},
+		{"add k2 1 %d", "STORED"},
+		{"replace k1 1 %d", "STORED"},
+		{"set k1 1 %d", "STORED"},
+	} {
+		req := fmt.Sprintf(tc.req, past)
+		if strings.HasPrefix(tc.req, "set") {
+			roundtrip(t, conn, r, fmt.Sprintf("set k1 1 0 %d\r\n%s\r\n", len(v), v), "STORED")
+		}
+		rsp := roundtrip(t, conn, r, fmt.Sprintf("%s %d\r\n%s\r\n", req, len(v), v), tc.rsp)
+		if rsp != tc.rsp+"\r\n" {
+			t.Fatalf("%s rsp err: %q", req, rsp)
+		}
+		if tc.rsp == "STORED" {
+			get := "get " + strings.Fields(req)[1] + "\r\n"
+			if rsp := roundtrip(t, conn, r, get, "END"); rsp != "END\r\n" {
+				t.Fatalf("%s should remove the item: %q", req, rsp)
+			}
+		}
+	}
+}
+
+func TestMemcacheServerSlowStreamingSet(t *testing.T) {
+	defer func(d time.Duration) { requestTimeout = d }(requestTimeout)
+	requestTimeout = 200 * time.Millisecond
+
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewMemcacheServer(l, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
+	go s.Serv()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// the data block takes longer than requestTimeout, but each chunk arrives in time
+	v := strings.Repeat("x", 2*streamingSetSize)
+	fmt.Fprintf(conn, "set k1 0 0 %d\r\n", len(v))
+	for i := 0; i < 8; i++ {
+		conn.Write([]byte(v[i*len(v)/8 : (i+1)*len(v)/8]))
+		time.Sleep(50 * time.Millisecond)
+	}
+	if rsp := roundtrip(t, conn, r, "\r\n", "STORED"); rsp != "STORED\r\n" {
+		t.Fatalf("set rsp err: %q", rsp)
+	}
+	if rsp := roundtrip(t, conn, r, "get k1\r\n", "END"); len(rsp) != len(v)+len("VALUE k1 0 2097152\r\n\r\nEND\r\n") {
+		t.Fatal("get rsp err", len(rsp))
+	}
+
+	// the conn is closed if the data block stalls
+	fmt.Fprintf(conn, "set k2 0 0 %d\r\n%s", len(v), v[:1000])
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatal("conn should be closed", err)
+	}
+}
+
+func TestMemcacheServerGetRange(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewMemcacheServer(l, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
+	go s.Serv()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	roundtrip(t, conn, r, "set k1 5 0 10\r\n0123456789\r\n", "STORED")
+	rsp := roundtrip(t, conn, r, "gets k1\r\n", "END")
+	cas := strings.Fields(rsp)[4]
+	for _, tc := range []struct {
+		req string
+		rsp string
+	}{
+		{"getrange k1 2 3\r\n", "VALUE k1 5 3 " + cas + " 10\r\n234\r\nEND\r\n"},
+		{"getrange k1 8 100\r\n", "VALUE k1 5 2 " + cas + " 10\r\n89\r\nEND\r\n"},
+		{"getrange k1 0 10\r\n", "VALUE k1 5 10 " + cas + " 10\r\n0123456789\r\nEND\r\n"},
+		{"getrange k1 10 1\r\n", "VALUE k1 5 0 " + cas + " 10\r\n\r\nEND\r\n"},
+		{"getrange k2 0 1\r\n", "END\r\n"},
+		{"getrange k1 11 1\r\n", "CLIENT_ERROR invalid range\r\n"},
+	} {
+		end := "END"
+		if strings.HasPrefix(tc.rsp, "CLIENT_ERROR") {
+			end = "CLIENT_ERROR"
+		}
+		if rsp := roundtrip(t, conn, r, tc.req, end); rsp != tc.rsp {
+			t.Fatalf("%q: %q != %q", tc.req, rsp, tc.rsp)
+		}
+	}
+}
+
+func TestMemcacheServerMultipart(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewMemcacheServer(l, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
+	go s.Serv()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	rsp := roundtrip(t, conn, r, "mpbegin k1\r\n", "UPLOAD")
+	id := strings.TrimSpace(strings.TrimPrefix(rsp, "UPLOAD "))
+	p1 := strings.Repeat("a", 100<<10)
+	p2 := strings.Repeat("b", 10)
+	for _, tc := range []struct {
+		req string
+		rsp string
+	}{
+		{fmt.Sprintf("mpput %s 2 %d\r\n%s\r\n", id, len(p2), p2), "STORED\r\n"},
+		{fmt.Sprintf("mpput %s 0 1\r\nx\r\n", id), "CLIENT_ERROR invalid part number\r\n"},
+		{"mpput nosuchid 1 1\r\nx\r\n", "NOT_FOUND\r\n"},
+		{fmt.Sprintf("mpcommit %s 2 3 0\r\n", id), "CLIENT_ERROR part missing\r\n"},
+		{fmt.Sprintf("mpput %s 1 %d\r\n%s\r\n", id, len(p1), p1), "STORED\r\n"},
+		{"get k1\r\n", "END\r\n"},
+		{fmt.Sprintf("mpcommit %s 2 3 0\r\n", id), "STORED\r\n"},
+		{fmt.Sprintf("mpcommit %s 2 3 0\r\n", id), "NOT_FOUND\r\n"},
+		{"get k1\r\n", fmt.Sprintf("VALUE k1 3 %d\r\n%s%s\r\nEND\r\n", len(p1)+len(p2), p1, p2)},
+		{fmt.Sprintf("mpabort %s\r\n", id), "NOT_FOUND\r\n"},
+	} {
+		end := tc.rsp[:strings.IndexAny(tc.rsp, " \r")]
+		if end == "VALUE" {
+			end = "END"
+		}
+		if rsp := roundtrip(t, conn, r, tc.req, end); rsp != tc.rsp {
+			t.Fatalf("%.40q: %.40q != %.40q", tc.req, rsp, tc.rsp)
+		}
+	}
+
+	rsp = roundtrip(t, conn, r, "mpbegin k2\r\n", "UPLOAD")
+	id = strings.TrimSpace(strings.TrimPrefix(rsp, "UPLOAD "))
+	if rsp := roundtrip(t, conn, r, "mpabort "+id+"\r\n", "DELETED"); rsp != "DELETED\r\n" {
+		t.Fatalf("abort rsp err: %q", rsp)
+	}
+}
+
+func TestMemcacheServerLongKey(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c := NewInMemoryCache()
+	c.options.HashKeyLen = 250
+	s := NewMemcacheServer(l, c, cache.NewAllocatorPool(4096), nil)
+	go s.Serv()
+	l2, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	go NewMemcacheServer(l2, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil).Serv()
+
+	key := strings.Repeat("k", 5000)
+	keys := strings.Repeat(key+" ", 8)
+	for _, tc := range []struct {
+		addr string
+		req  string
+		rsp  string
+	}{
+		{l.Addr().String(), "set " + key + " 0 0 2\r\nv1\r\n", "STORED\r\n"},
+		{l.Addr().String(), "get " + key + "\r\n", "VALUE " + key + " 0 2\r\nv1\r\nEND\r\n"},
+		{l.Addr().String(), "get " + key + "x\r\n", "END\r\n"},
+		{l.Addr().String(), "get " + keys + "\r\n", strings.Repeat("VALUE "+key+" 0 2\r\nv1\r\n", 8) + "END\r\n"},
+		{l.Addr().String(), "get " + strings.Repeat("k", maxLongKeyLen+1) + "\r\n", "CLIENT_ERROR invalid key\r\n"},
+		{l.Addr().String(), "get " + key + "x " + key + "\r\n", "VALUE " + key + " 0 2\r\nv1\r\nEND\r\n"},
+		{l2.Addr().String(), "set " + key[:1000] + " 0 0 2\r\nv1\r\n", "CLIENT_ERROR invalid key\r\n"},
+		{l2.Addr().String(), "get " + strings.Repeat("k1 ", 2000) + "\r\n", "END\r\n"},
+	} {
+		conn, err := net.Dial("tcp", tc.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		end := tc.rsp[:strings.IndexAny(tc.rsp, " \r")]
+		if end == "VALUE" {
+			end = "END"
+		}
+		if rsp := roundtrip(t, conn, bufio.NewReader(conn), tc.req, end); rsp != tc.rsp {
+			t.Fatalf("%.40q: %.40q != %.40q", tc.req, rsp, tc.rsp)
+		}
+		conn.Close()
+	}
+
+	r := bufio.NewReaderSize(strings.NewReader("get "+strings.Repeat(key+" ", maxLineLen/len(key)+1)+"\r\n"), longKeyReadSize)
+	if _, err := readMemcacheLine(r); err != errLineTooLong {
+		t.Fatal("should fail", err)
+	}
+}
+
+// countingWriter counts the calls of Write
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestBufferedWriter(t *testing.T) {
+	cw := &countingWriter{}
+	w := NewBufferedWriter(cw)
+	w.Write([]byte("VALUE k1 0 1\r\n"))
+	w.Write([]byte("x"))
+	if cw.writes != 0 || w.Buffered() != 15 {
+		t.Fatal("small writes should be pending", cw.writes, w.Buffered())
+	}
+	big := bytes.Repeat([]byte("y"), bufferedWriterSize)
+	if n, err := w.Write(big); err != nil || n != len(big) {
+		t.Fatal("write err", n, err)
+	}
+	if w.Buffered() != 0 || cw.String() != "VALUE k1 0 1\r\nx"+string(big) {
+		t.Fatal("large write should be sent with the pending data", w.Buffered())
+	}
+	w.Write([]byte("END\r\n"))
+	if err := w.Flush(); err != nil || cw.writes != 3 || !strings.HasSuffix(cw.String(), "yEND\r\n") {
+		t.Fatal("flush err", err, cw.writes)
+	}
+	if w.N != int64(cw.Len()) {
+		t.Fatal("bytes written err", w.N, cw.Len())
+	}
+}
+
+// writesCountingListener counts the calls of Write of the accepted conns
+type writesCountingListener struct {
+	net.Listener
+	writes int64
+}
+
+func (l *writesCountingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &writesCountingConn{conn, &l.writes}, nil
+}
+
+type writesCountingConn struct {
+	net.Conn
+	writes *int64
+}
+
+func (c *writesCountingConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(c.writes, 1)
+	return c.Conn.Write(p)
+}
+
+func TestMemcacheServerPipeline(t *testing.T) {
+	tl, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &writesCountingListener{Listener: tl}
+	defer l.Close()
+
+	s := NewMemcacheServer(nil, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
+	go s.ServListener(l)
+	defer s.Shutdown()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	var req, keys, expect string
+	for i := 0; i < 100; i++ {
+		req += fmt.Sprintf("set k%d 0 0 2 noreply\r\n%02d\r\n", i, i)
+		keys += fmt.Sprintf(" k%d", i)
+		expect += fmt.Sprintf("VALUE k%d 0 2\r\n%02d\r\n", i, i)
+	}
+	req += "get" + keys + "\r\nget k1\r\n"
+	expect += "END\r\nVALUE k1 0 2\r\n01\r\nEND\r\n"
+	rsp := roundtrip(t, conn, r, req, "END")
+	rsp += roundtrip(t, conn, r, "", "END")
+	if rsp != expect {
+		t.Fatalf("rsp err: %q", rsp)
+	}
+	if n := atomic.LoadInt64(&l.writes); n != 1 {
+		t.Fatal("rsps of pipelined requests should be written at once", n)
+	}
+
+	// rsps are not held by a data block which has not arrived
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if rsp := roundtrip(t, conn, r, "get k1\r\nset k2 0 0 2\r\n", "END"); rsp != "VALUE k1 0 2\r\n01\r\nEND\r\n" {
+		t.Fatalf("rsp err: %q", rsp)
+	}
+	if rsp := roundtrip(t, conn, r, "v2\r\n", "STORED"); rsp != "STORED\r\n" {
+		t.Fatalf("rsp err: %q", rsp)
+	}
+}
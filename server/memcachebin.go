@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/xiaost/blobcached/cache"
+	"github.com/xiaost/blobcached/protocol/memcachebin"
+)
+
+// HandleBinary processes a binary protocol request, r must start with the request magic
+func (s *MemcacheServer) HandleBinary(w io.Writer, r *bufio.Reader) error {
+	b, err := r.Peek(memcachebin.HeaderLen)
+	if err != nil {
+		return err
+	}
+	h, err := memcachebin.ParseHeader(b)
+	if err != nil {
+		return err
+	}
+	r.Discard(memcachebin.HeaderLen)
+	if int(h.KeyLen) > s.maxKeyLen() {
+		// skip the bad request, the conn is kept like other invalid arguments
+		if _, err := r.Discard(int(h.BodyLen)); err != nil {
+			return err
+		}
+		return writeBinaryErr(w, h, memcachebin.StatusInvalidArgs)
+	}
+
+	data := make([]byte, int(h.ExtrasLen)+int(h.KeyLen))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	req, err := memcachebin.ParseRequest(h, data)
+	if err != nil {
+		// skip the value of the bad request
+		if _, err := r.Discard(int(h.BodyLen) - len(data)); err != nil {
+			return err
+		}
+		if err == memcachebin.ErrUnknownCommand {
+			return writeBinaryErr(w, h, memcachebin.StatusUnknownCommand)
+		}
+		return writeBinaryErr(w, h, memcachebin.StatusInvalidArgs)
+	}
+
+	switch req.Opcode {
+	case memcachebin.OpGet, memcachebin.OpGetQ, memcachebin.OpGetK, memcachebin.OpGetKQ,
+		memcachebin.OpGAT, memcachebin.OpGATQ, memcachebin.OpGATK, memcachebin.OpGATKQ:
+		return s.HandleBinaryGet(w, req)
+	case memcachebin.OpSet, memcachebin.OpSetQ, memcachebin.OpAdd, memcachebin.OpAddQ,
+		memcachebin.OpReplace, memcachebin.OpReplaceQ:
+		return s.HandleBinarySet(w, r, req)
+	case memcachebin.OpDelete, memcachebin.OpDeleteQ:
+		return s.HandleBinaryDel(w, req)
+	case memcachebin.OpTouch:
+		return s.HandleBinaryTouch(w, req)
+	case memcachebin.OpFlush, memcachebin.OpFlushQ:
+		return s.HandleBinaryFlush(w, req)
+	case memcachebin.OpStat:
+		return s.HandleBinaryStats(w, req)
+	case memcachebin.OpVersion:
+		return writeBinaryRsp(w, h, memcachebin.StatusOK, 0, nil, nil, []byte(s.options.Version))
+	case memcachebin.OpQuit, memcachebin.OpQuitQ:
+		if !req.Opcode.Quiet() {
+			writeBinaryRsp(w, h, memcachebin.StatusOK, 0, nil, nil, nil)
+		}
+		return errQuit
+	default: // noop
+		return writeBinaryRsp(w, h, memcachebin.StatusOK, 0, nil, nil, nil)
+	}
+}
+
+// writeBinaryRsp writes the response of req, value is written without copying
+func writeBinaryRsp(w io.Writer, req *memcachebin.Header, status memcachebin.Status, cas uint64, extras, key, value []byte) error {
+	h := memcachebin.MakeResponseHeader(req, status, cas, len(extras), len(key), len(value))
+	b := make([]byte, 0, memcachebin.HeaderLen+len(extras)+len(key))
+	b = h.Append(b)
+	b = append(b, extras...)
+	b = append(b, key...)
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	if len(value) == 0 {
+		return nil
+	}
+	_, err := w.Write(value)
+	return err
+}
+
+// writeBinaryErr writes the error response of req with the status message as value
+func writeBinaryErr(w io.Writer, req *memcachebin.Header, status memcachebin.Status) error {
+	return writeBinaryRsp(w, req, status, 0, nil, nil, []byte(status.String()))
+}
+
+func (s *MemcacheServer) HandleBinaryGet(w io.Writer, req *memcachebin.Request) error {
+	var item *cache.Item
+	var err error
+	switch req.Opcode {
+	case memcachebin.OpGAT, memcachebin.OpGATQ, memcachebin.OpGATK, memcachebin.OpGATKQ:
+		item, err = s.getAndTouch(req.Key, req.Exptime)
+	default:
+		item, err = s.cache.Get(req.Key)
+	}
+	if err != nil && err != cache.ErrNotFound {
+		log.Printf("get key %s err: %s", req.Key, err)
+	}
+	var key []byte
+	if req.Opcode.WithKey() {
+		key = []byte(req.Key)
+	}
+	if err != nil {
+		if req.Opcode.Quiet() {
+			return nil
+		}
+		status := memcachebin.StatusKeyNotFound
+		return writeBinaryRsp(w, &req.Header, status, 0, nil, key, []byte(status.String()))
+	}
+	defer item.Free()
+	var extras [4]byte
+	binary.BigEndian.PutUint32(extras[:], item.Flags)
+	return writeBinaryRsp(w, &req.Header, memcachebin.StatusOK, item.Cas, extras[:], key, item.Value)
+}
+
+func (s *MemcacheServer) HandleBinarySet(w io.Writer, r *bufio.Reader, req *memcachebin.Request) error {
+	if req.ValueLen > cache.MaxValueSize-4096 {
+		if _, err := r.Discard(int(req.ValueLen)); err != nil {
+			return err
+		}
+		return writeBinaryErr(w, &req.Header, memcachebin.StatusValueTooLarge)
+	}
+	item := s.allocator.Alloc(int(req.ValueLen))
+	defer item.Free()
+	if _, err := io.ReadFull(r, item.Value); err != nil {
+		return err
+	}
+	item.Key = req.Key
+	item.Flags = req.Flags
+
+	var expired bool
+	var err error
+	item.TTL, expired = exptimeToTTL(req.Exptime)
+	if !expired {
+		switch req.Opcode {
+		case memcachebin.OpAdd, memcachebin.OpAddQ:
+			err = s.cache.Add(item)
+		case memcachebin.OpReplace, memcachebin.OpReplaceQ:
+			if req.Cas == 0 {
+				err = s.cache.Replace(item)
+				break
+			}
+			fallthrough
+		default:
+			if req.Cas == 0 {
+				err = s.cache.Set(item)
+				break
+			}
+			item.Cas = req.Cas
+			err = s.cache.CompareAndSwap(item)
+		}
+	}
+
+	var status memcachebin.Status
+	switch err {
+	case nil:
+		if req.Opcode.Quiet() {
+			return nil
+		}
+		return writeBinaryRsp(w, &req.Header, memcachebin.StatusOK, item.Cas, nil, nil, nil)
+	case cache.ErrNotStored: // add an existing key or replace a missing key
+		status = memcachebin.StatusKeyExists
+		if req.Opcode == memcachebin.OpReplace || req.Opcode == memcachebin.OpReplaceQ {
+			status = memcachebin.StatusKeyNotFound
+		}
+	case cache.ErrCasConflict:
+		status = memcachebin.StatusKeyExists
+	case cache.ErrNotFound:
+		status = memcachebin.StatusKeyNotFound
+	case cache.ErrInvalidKey:
+		status = memcachebin.StatusInvalidArgs
+	default:
+		writeBinaryErr(w, &req.Header, memcachebin.StatusInternalError)
+		return err
+	}
+	return writeBinaryErr(w, &req.Header, status)
+}
+
+func (s *MemcacheServer) HandleBinaryDel(w io.Writer, req *memcachebin.Request) error {
+	var err error
+	if req.Cas != 0 {
+		err = s.cache.DelIfCas(req.Key, req.Cas)
+	} else {
+		err = s.cache.Del(req.Key)
+	}
+	switch err {
+	case nil:
+		if req.Opcode.Quiet() {
+			return nil
+		}
+		return writeBinaryRsp(w, &req.Header, memcachebin.StatusOK, 0, nil, nil, nil)
+	case cache.ErrCasConflict:
+		return writeBinaryErr(w, &req.Header, memcachebin.StatusKeyExists)
+	case cache.ErrNotFound:
+		return writeBinaryErr(w, &req.Header, memcachebin.StatusKeyNotFound)
+	}
+	writeBinaryErr(w, &req.Header, memcachebin.StatusInternalError)
+	return err
+}
+
+func (s *MemcacheServer) HandleBinaryTouch(w io.Writer, req *memcachebin.Request) error {
+	err := s.touch(req.Key, req.Exptime)
+	switch err {
+	case nil:
+		return writeBinaryRsp(w, &req.Header, memcachebin.StatusOK, 0, nil, nil, nil)
+	case cache.ErrNotFound:
+		return writeBinaryErr(w, &req.Header, memcachebin.StatusKeyNotFound)
+	}
+	writeBinaryErr(w, &req.Header, memcachebin.StatusInternalError)
+	return err
+}
+
+func (s *MemcacheServer) HandleBinaryFlush(w io.Writer, req *memcachebin.Request) error {
+	if err := s.flushAll(req.Exptime); err != nil {
+		writeBinaryErr(w, &req.Header, memcachebin.StatusInternalError)
+		return err
+	}
+	if req.Opcode.Quiet() {
+		return nil
+	}
+	return writeBinaryRsp(w, &req.Header, memcachebin.StatusOK, 0, nil, nil, nil)
+}
+
+// HandleBinaryStats writes a response for each statistic and ends with an empty response,
+// the key is the stats subcommand like `settings`
+func (s *MemcacheServer) HandleBinaryStats(w io.Writer, req *memcachebin.Request) error {
+	if req.Key == "reset" {
+		s.resetStats()
+		return writeBinaryRsp(w, &req.Header, memcachebin.StatusOK, 0, nil, nil, nil)
+	}
+	var buf bytes.Buffer
+	ok := s.collectStats(req.Key, func(name string, v interface{}) {
+		writeBinaryRsp(&buf, &req.Header, memcachebin.StatusOK, 0, nil, []byte(name), []byte(fmt.Sprint(v)))
+	})
+	if !ok {
+		return writeBinaryErr(w, &req.Header, memcachebin.StatusKeyNotFound)
+	}
+	writeBinaryRsp(&buf, &req.Header, memcachebin.StatusOK, 0, nil, nil, nil)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/xiaost/blobcached/cache"
+	"github.com/xiaost/blobcached/protocol/memcache"
+	"github.com/xiaost/blobcached/protocol/memcachebin"
+)
+
+type binRsp struct {
+	memcachebin.Header
+	Extras, Key, Value []byte
+}
+
+func writeBinReq(t *testing.T, conn net.Conn, op memcachebin.Opcode, opaque uint32, cas uint64, extras []byte, key, value string) {
+	h := memcachebin.Header{
+		Magic:     memcachebin.MagicRequest,
+		Opcode:    op,
+		KeyLen:    uint16(len(key)),
+		ExtrasLen: uint8(len(extras)),
+		BodyLen:   uint32(len(extras) + len(key) + len(value)),
+		Opaque:    opaque,
+		Cas:       cas,
+	}
+	b := h.Append(nil)
+	b = append(b, extras...)
+	b = append(b, key...)
+	b = append(b, value...)
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readBinRsp(t *testing.T, r *bufio.Reader) *binRsp {
+	b := make([]byte, memcachebin.HeaderLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != memcachebin.MagicResponse {
+		t.Fatal("magic err", b[0])
+	}
+	rsp := &binRsp{}
+	rsp.Opcode = memcachebin.Opcode(b[1])
+	rsp.KeyLen = binary.BigEndian.Uint16(b[2:])
+	rsp.ExtrasLen = b[4]
+	rsp.Status = memcachebin.Status(binary.BigEndian.Uint16(b[6:]))
+	rsp.BodyLen = binary.BigEndian.Uint32(b[8:])
+	rsp.Opaque = binary.BigEndian.Uint32(b[12:])
+	rsp.Cas = binary.BigEndian.Uint64(b[16:])
+	body := make([]byte, rsp.BodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatal(err)
+	}
+	rsp.Extras = body[:rsp.ExtrasLen]
+	rsp.Key = body[rsp.ExtrasLen : int(rsp.ExtrasLen)+int(rsp.KeyLen)]
+	rsp.Value = body[int(rsp.ExtrasLen)+int(rsp.KeyLen):]
+	return rsp
+}
+
+func TestMemcacheServerBinary(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewMemcacheServer(l, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
+	go s.Serv()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	setExtras := []byte{0, 0, 0, 7, 0, 0, 0, 0} // flags 7, exptime 0
+
+	writeBinReq(t, conn, memcachebin.OpSet, 1, 0, setExtras, "k1", "v1")
+	rsp := readBinRsp(t, r)
+	if rsp.Status != memcachebin.StatusOK || rsp.Opcode != memcachebin.OpSet || rsp.Opaque != 1 || rsp.Cas == 0 {
+		t.Fatal("set rsp err", rsp.Header)
+	}
+	cas := rsp.Cas
+
+	writeBinReq(t, conn, memcachebin.OpAdd, 2, 0, setExtras, "k1", "v1")
+	if rsp := readBinRsp(t, r); rsp.Status != memcachebin.StatusKeyExists {
+		t.Fatal("add existing key should exists", rsp.Status)
+	}
+	writeBinReq(t, conn, memcachebin.OpReplace, 3, 0, setExtras, "k2", "v2")
+	if rsp := readBinRsp(t, r); rsp.Status != memcachebin.StatusKeyNotFound {
+		t.Fatal("replace missing key should not found", rsp.Status)
+	}
+	writeBinReq(t, conn, memcachebin.OpSet, 4, cas+100, setExtras, "k1", "v1")
+	if rsp := readBinRsp(t, r); rsp.Status != memcachebin.StatusKeyExists {
+		t.Fatal("set with bad cas should exists", rsp.Status)
+	}
+
+	writeBinReq(t, conn, memcachebin.OpGetK, 5, 0, nil, "k1", "")
+	rsp = readBinRsp(t, r)
+	if rsp.Status != memcachebin.StatusOK || rsp.Opaque != 5 || rsp.Cas != cas ||
+		string(rsp.Extras) != "\x00\x00\x00\x07" || string(rsp.Key) != "k1" || string(rsp.Value) != "v1" {
+		t.Fatal("getk rsp err", rsp)
+	}
+
+	// quiet commands: the miss of getq and the success of setq are not responded
+	writeBinReq(t, conn, memcachebin.OpGetQ, 6, 0, nil, "k2", "")
+	writeBinReq(t, conn, memcachebin.OpSetQ, 7, 0, setExtras, "k2", "v2")
+	writeBinReq(t, conn, memcachebin.OpGetKQ, 8, 0, nil, "k2", "")
+	writeBinReq(t, conn, memcachebin.OpNoop, 9, 0, nil, "", "")
+	rsp = readBinRsp(t, r)
+	if rsp.Opaque != 8 || string(rsp.Key) != "k2" || string(rsp.Value) != "v2" {
+		t.Fatal("getkq rsp err", rsp)
+	}
+	if rsp = readBinRsp(t, r); rsp.Opcode != memcachebin.OpNoop || rsp.Opaque != 9 {
+		t.Fatal("noop rsp err", rsp.Header)
+	}
+
+	writeBinReq(t, conn, memcachebin.OpTouch, 10, 0, []byte{0, 0, 0, 100}, "k2", "")
+	if rsp := readBinRsp(t, r); rsp.Status != memcachebin.StatusOK {
+		t.Fatal("touch rsp err", rsp.Status)
+	}
+	writeBinReq(t, conn, memcachebin.OpGAT, 11, 0, []byte{0, 0, 0, 100}, "k3", "")
+	if rsp := readBinRsp(t, r); rsp.Status != memcachebin.StatusKeyNotFound || string(rsp.Value) != "Not found" {
+		t.Fatal("gat missing key rsp err", rsp)
+	}
+	writeBinReq(t, conn, memcachebin.OpGAT, 12, 0, []byte{0, 0, 0, 100}, "k2", "")
+	if rsp := readBinRsp(t, r); rsp.Status != memcachebin.StatusOK || string(rsp.Value) != "v2" {
+		t.Fatal("gat rsp err", rsp)
+	}
+
+	writeBinReq(t, conn, memcachebin.OpDelete, 13, 1<<40, nil, "k2", "")
+	if rsp := readBinRsp(t, r); rsp.Status != memcachebin.StatusKeyExists {
+		t.Fatal("delete with bad cas should exists", rsp.Status)
+	}
+	writeBinReq(t, conn, memcachebin.OpDelete, 13, 0, nil, "k2", "")
+	if rsp := readBinRsp(t, r); rsp.Status != memcachebin.StatusOK {
+		t.Fatal("delete rsp err", rsp.Status)
+	}
+	writeBinReq(t, conn, memcachebin.OpDelete, 14, 0, nil, "k2", "")
+	if rsp := readBinRsp(t, r); rsp.Status != memcachebin.StatusKeyNotFound {
+		t.Fatal("delete missing key should not found", rsp.Status)
+	}
+
+	writeBinReq(t, conn, memcachebin.OpVersion, 15, 0, nil, "", "")
+	if rsp := readBinRsp(t, r); string(rsp.Value) != DefaultServerOptions.Version {
+		t.Fatal("version rsp err", string(rsp.Value))
+	}
+
+	writeBinReq(t, conn, memcachebin.OpStat, 16, 0, nil, "", "")
+	stats := make(map[string]string)
+	for {
+		rsp := readBinRsp(t, r)
+		if rsp.Opaque != 16 {
+			t.Fatal("stat rsp err", rsp.Header)
+		}
+		if len(rsp.Key) == 0 {
+			break
+		}
+		stats[string(rsp.Key)] = string(rsp.Value)
+	}
+	if stats["curr_items"] != "1" {
+		t.Fatal("stats err", stats)
+	}
+
+	// the conn is kept after the invalid key
+	writeBinReq(t, conn, memcachebin.OpSet, 16, 0, setExtras, strings.Repeat("k", memcache.MaxKeyLen+1), "v1")
+	if rsp := readBinRsp(t, r); rsp.Status != memcachebin.StatusInvalidArgs || rsp.Opaque != 16 {
+		t.Fatal("set long key rsp err", rsp.Header)
+	}
+
+	writeBinReq(t, conn, 0x20, 17, 0, nil, "", "") // sasl list mechs
+	if rsp := readBinRsp(t, r); rsp.Status != memcachebin.StatusUnknownCommand {
+		t.Fatal("unknown command rsp err", rsp.Status)
+	}
+
+	// text protocol on the same connection
+	if rsp := roundtrip(t, conn, r, "get k1\r\n", "END"); rsp != "VALUE k1 7 2\r\nv1\r\nEND\r\n" {
+		t.Fatal("get rsp err", rsp)
+	}
+
+	writeBinReq(t, conn, memcachebin.OpFlush, 18, 0, nil, "", "")
+	if rsp := readBinRsp(t, r); rsp.Status != memcachebin.StatusOK || rsp.Opaque != 18 {
+		t.Fatal("flush rsp err", rsp.Header)
+	}
+	writeBinReq(t, conn, memcachebin.OpGet, 19, 0, nil, "k1", "")
+	if rsp := readBinRsp(t, r); rsp.Status != memcachebin.StatusKeyNotFound {
+		t.Fatal("get after flush should not found", rsp.Status)
+	}
+}
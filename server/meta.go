@@ -0,0 +1,470 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xiaost/blobcached/cache"
+	"github.com/xiaost/blobcached/protocol/memcache"
+)
+
+// meta commands: https://github.com/memcached/memcached/blob/master/doc/protocol.txt
+
+var (
+	errMetaFlag  = errors.New("invalid flag")
+	errMetaToken = errors.New("bad token in command line format")
+	errMetaMode  = errors.New("invalid mode for ms")
+)
+
+// supported flags of meta commands
+var metaFlags = map[string]string{
+	"mg": "bcfklOqstTv",
+	"ms": "bcCFIkMOqT",
+	"md": "bCIkOqT",
+	"ma": "bcDJkMNOqtTv",
+	"me": "b",
+}
+
+func checkMetaFlags(cmdinfo *memcache.CommandInfo) error {
+	supported := metaFlags[cmdinfo.Cmd]
+	for _, f := range cmdinfo.MetaFlags {
+		if strings.IndexByte(supported, f.Flag) < 0 {
+			return errMetaFlag
+		}
+	}
+	return nil
+}
+
+// metaUint parses the token of flag f, def is returned if the flag not exists
+func metaUint(cmdinfo *memcache.CommandInfo, f byte, def uint64, bitSize int) (uint64, error) {
+	token, ok := cmdinfo.MetaFlag(f)
+	if !ok {
+		return def, nil
+	}
+	v, err := strconv.ParseUint(token, 10, bitSize)
+	if err != nil {
+		return 0, errMetaToken
+	}
+	return v, nil
+}
+
+// metaKey returns the key for responses, it's encoded if the command uses base64 key
+func metaKey(cmdinfo *memcache.CommandInfo) string {
+	if cmdinfo.HasMetaFlag('b') {
+		return base64.StdEncoding.EncodeToString([]byte(cmdinfo.Key))
+	}
+	return cmdinfo.Key
+}
+
+// appendMetaFlags appends the return flags in the order of the requested flags.
+// item is used for item related flags, it can be nil. size is the length of the value which may not be in item.
+func appendMetaFlags(b []byte, cmdinfo *memcache.CommandInfo, item *cache.Item, size int64) []byte {
+	now := time.Now().Unix()
+	for _, f := range cmdinfo.MetaFlags {
+		switch f.Flag {
+		case 'O':
+			b = append(b, " O"...)
+			b = append(b, f.Token...)
+		case 'k':
+			b = append(b, " k"...)
+			b = append(b, metaKey(cmdinfo)...)
+		case 'b':
+			if cmdinfo.HasMetaFlag('k') {
+				b = append(b, " b"...)
+			}
+		}
+		if item == nil {
+			continue
+		}
+		switch f.Flag {
+		case 'c':
+			b = append(b, " c"...)
+			b = strconv.AppendUint(b, item.Cas, 10)
+		case 'f':
+			b = append(b, " f"...)
+			b = strconv.AppendUint(b, uint64(item.Flags), 10)
+		case 's':
+			b = append(b, " s"...)
+			b = strconv.AppendInt(b, size, 10)
+		case 't':
+			b = append(b, " t"...)
+			b = strconv.AppendInt(b, remainingTTL(item, now), 10)
+		case 'l':
+			// the time of last access is not tracked, it's the time since the item stored or touched
+			b = append(b, " l"...)
+			b = strconv.AppendInt(b, now-item.Timestamp, 10)
+		}
+	}
+	return b
+}
+
+// remainingTTL returns the seconds before the item expires, -1 for never
+func remainingTTL(item *cache.Item, now int64) int64 {
+	if item.TTL == 0 {
+		return -1
+	}
+	ttl := int64(item.TTL) - (now - item.Timestamp)
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl
+}
+
+func writeMetaRsp(w io.Writer, code string, cmdinfo *memcache.CommandInfo, item *cache.Item) error {
+	var size int64
+	if item != nil {
+		size = int64(len(item.Value))
+	}
+	b := appendMetaFlags([]byte(code), cmdinfo, item, size)
+	b = append(b, memcache.EOL...)
+	_, err := w.Write(b)
+	return err
+}
+
+// mg <key> <flags>*
+func (s *MemcacheServer) HandleMetaGet(w io.Writer, cmdinfo *memcache.CommandInfo) error {
+	if err := checkMetaFlags(cmdinfo); err != nil {
+		_, err = w.Write(memcache.MakeRspClientErr(err))
+		return err
+	}
+	exptime, err := metaUint(cmdinfo, 'T', 0, 32)
+	if err != nil {
+		_, err = w.Write(memcache.MakeRspClientErr(err))
+		return err
+	}
+
+	// the value is read only if requested
+	var item *cache.Item
+	var rd cache.ValueReader
+	var size int64
+	if cmdinfo.HasMetaFlag('v') {
+		item, rd, err = s.cache.GetReader(cmdinfo.Key, sendfileSize, !s.options.SkipSendfileCrc)
+	} else {
+		item, size, err = s.cache.GetRange(cmdinfo.Key, 0, 0)
+	}
+	if err == cache.ErrNotFound {
+		if cmdinfo.HasMetaFlag('q') {
+			return nil
+		}
+		return writeMetaRsp(w, "EN", cmdinfo, nil)
+	}
+	if err != nil {
+		_, err = w.Write(memcache.MakeRspServerErr(err))
+		return err
+	}
+	defer item.Free()
+	if rd != nil {
+		defer rd.Close()
+		size = rd.Size()
+	} else if cmdinfo.HasMetaFlag('v') {
+		size = int64(len(item.Value))
+	}
+
+	if cmdinfo.HasMetaFlag('T') {
+		if err := s.touch(cmdinfo.Key, uint32(exptime)); err != nil && err != cache.ErrNotFound {
+			_, err = w.Write(memcache.MakeRspServerErr(err))
+			return err
+		}
+		item.TTL, _ = exptimeToTTL(uint32(exptime))
+		item.Timestamp = time.Now().Unix()
+	}
+
+	var b []byte
+	if cmdinfo.HasMetaFlag('v') {
+		b = append(b, "VA "...)
+		b = strconv.AppendInt(b, size, 10)
+	} else {
+		b = append(b, "HD"...)
+	}
+	b = appendMetaFlags(b, cmdinfo, item, size)
+	if item.Stale {
+		// the first client gets the W flag to recache the stale item, others get Z
+		won, err := s.cache.ClaimToken(cmdinfo.Key, item.Cas)
+		if err != nil && err != cache.ErrNotFound {
+			_, err = w.Write(memcache.MakeRspServerErr(err))
+			return err
+		}
+		if won {
+			b = append(b, " W X"...)
+		} else {
+			b = append(b, " X Z"...)
+		}
+	}
+	b = append(b, memcache.EOL...)
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	if !cmdinfo.HasMetaFlag('v') {
+		return nil
+	}
+	if rd != nil {
+		err = writeValue(w, rd)
+	} else {
+		_, err = w.Write(item.Value)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(memcache.EOL)
+	return err
+}
+
+// ms <key> <datalen> <flags>*\r\n<data>\r\n
+func (s *MemcacheServer) HandleMetaSet(w io.Writer, r *bufio.Reader, cmdinfo *memcache.CommandInfo) error {
+	item, err := s.readItem(w, r, cmdinfo.PayloadLen)
+	if err != nil {
+		return err
+	}
+	defer item.Free()
+	item.Key = cmdinfo.Key
+
+	if err := checkMetaFlags(cmdinfo); err != nil {
+		_, err = w.Write(memcache.MakeRspClientErr(err))
+		return err
+	}
+	flags, err1 := metaUint(cmdinfo, 'F', 0, 32)
+	exptime, err2 := metaUint(cmdinfo, 'T', 0, 32)
+	cas, err3 := metaUint(cmdinfo, 'C', 0, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		_, err = w.Write(memcache.MakeRspClientErr(errMetaToken))
+		return err
+	}
+	mode, ok := cmdinfo.MetaFlag('M')
+	if !ok {
+		mode = "S"
+	}
+	mode = strings.ToUpper(mode)
+	if cmdinfo.HasMetaFlag('C') && mode != "S" {
+		_, err = w.Write(memcache.MakeRspClientErr(errMetaMode))
+		return err
+	}
+
+	item.Flags = uint32(flags)
+	var expired bool
+	item.TTL, expired = exptimeToTTL(uint32(exptime))
+	if expired && mode != "A" && mode != "P" { // same as HandleSet
+		var err error
+		switch {
+		case cmdinfo.HasMetaFlag('C'):
+			err = s.storeExpired(item.Key, cas, cache.StoreCAS)
+		case mode == "S":
+			err = s.storeExpired(item.Key, 0, cache.StoreSet)
+		case mode == "E":
+			err = s.storeExpired(item.Key, 0, cache.StoreAdd)
+		case mode == "R":
+			err = s.storeExpired(item.Key, 0, cache.StoreReplace)
+		default:
+			_, err = w.Write(memcache.MakeRspClientErr(errMetaMode))
+			return err
+		}
+		return writeMetaStoreRsp(w, cmdinfo, nil, err)
+	}
+
+	switch {
+	case cmdinfo.HasMetaFlag('C'):
+		item.Cas = cas
+		item.Stale = cmdinfo.HasMetaFlag('I')
+		err = s.cache.CompareAndSwap(item)
+	case mode == "S":
+		err = s.cache.Set(item)
+	case mode == "E":
+		err = s.cache.Add(item)
+	case mode == "R":
+		err = s.cache.Replace(item)
+	case mode == "A":
+		err = s.cache.Append(item)
+	case mode == "P":
+		err = s.cache.Prepend(item)
+	default:
+		_, err = w.Write(memcache.MakeRspClientErr(errMetaMode))
+		return err
+	}
+	return writeMetaStoreRsp(w, cmdinfo, item, err)
+}
+
+// writeMetaStoreRsp writes the rsp of ms by the err of storing item
+func writeMetaStoreRsp(w io.Writer, cmdinfo *memcache.CommandInfo, item *cache.Item, err error) error {
+	switch err {
+	case nil:
+		if cmdinfo.HasMetaFlag('q') {
+			return nil
+		}
+		return writeMetaRsp(w, "HD", cmdinfo, item)
+	case cache.ErrNotStored:
+		return writeMetaRsp(w, "NS", cmdinfo, nil)
+	case cache.ErrCasConflict:
+		return writeMetaRsp(w, "EX", cmdinfo, nil)
+	case cache.ErrNotFound:
+		return writeMetaRsp(w, "NF", cmdinfo, nil)
+	}
+	_, err = w.Write(memcache.MakeRspServerErr(err))
+	return err
+}
+
+// md <key> <flags>*
+func (s *MemcacheServer) HandleMetaDelete(w io.Writer, cmdinfo *memcache.CommandInfo) error {
+	if err := checkMetaFlags(cmdinfo); err != nil {
+		_, err = w.Write(memcache.MakeRspClientErr(err))
+		return err
+	}
+	exptime, err := metaUint(cmdinfo, 'T', 0, 32)
+	if err != nil {
+		_, err = w.Write(memcache.MakeRspClientErr(err))
+		return err
+	}
+	cas, err := metaUint(cmdinfo, 'C', 0, 64)
+	if err != nil {
+		_, err = w.Write(memcache.MakeRspClientErr(err))
+		return err
+	}
+	switch {
+	case cmdinfo.HasMetaFlag('C') && cmdinfo.HasMetaFlag('I'):
+		// the item can't be invalidated atomically with the cas unique
+		_, err = w.Write(memcache.MakeRspClientErr(errMetaFlag))
+		return err
+	case cmdinfo.HasMetaFlag('C'):
+		err = s.cache.DelIfCas(cmdinfo.Key, cas)
+	case cmdinfo.HasMetaFlag('I'):
+		// mark the item as stale instead of removing it, T updates the ttl of the stale item
+		err = s.cache.Invalidate(cmdinfo.Key)
+		if err == nil && cmdinfo.HasMetaFlag('T') {
+			err = s.touch(cmdinfo.Key, uint32(exptime))
+		}
+	default:
+		err = s.cache.Del(cmdinfo.Key)
+	}
+	switch err {
+	case nil:
+		if cmdinfo.HasMetaFlag('q') {
+			return nil
+		}
+		return writeMetaRsp(w, "HD", cmdinfo, nil)
+	case cache.ErrNotFound:
+		if cmdinfo.HasMetaFlag('q') {
+			return nil
+		}
+		return writeMetaRsp(w, "NF", cmdinfo, nil)
+	case cache.ErrCasConflict:
+		return writeMetaRsp(w, "EX", cmdinfo, nil)
+	}
+	_, err = w.Write(memcache.MakeRspServerErr(err))
+	return err
+}
+
+// ma <key> <flags>*
+func (s *MemcacheServer) HandleMetaArithmetic(w io.Writer, cmdinfo *memcache.CommandInfo) error {
+	if err := checkMetaFlags(cmdinfo); err != nil {
+		_, err = w.Write(memcache.MakeRspClientErr(err))
+		return err
+	}
+	delta, err1 := metaUint(cmdinfo, 'D', 1, 64)
+	initial, err2 := metaUint(cmdinfo, 'J', 0, 64)
+	vivify, err3 := metaUint(cmdinfo, 'N', 0, 32)
+	exptime, err4 := metaUint(cmdinfo, 'T', 0, 32)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		_, err := w.Write(memcache.MakeRspClientErr(errMetaToken))
+		return err
+	}
+	incr := s.cache.Incr
+	if mode, ok := cmdinfo.MetaFlag('M'); ok {
+		switch mode {
+		case "I", "i", "+":
+		case "D", "d", "-":
+			incr = s.cache.Decr
+		default:
+			_, err := w.Write(memcache.MakeRspClientErr(errMetaToken))
+			return err
+		}
+	}
+
+	v, err := incr(cmdinfo.Key, delta)
+	if err == cache.ErrNotFound && cmdinfo.HasMetaFlag('N') {
+		// auto create the item with the initial value
+		ttl, _ := exptimeToTTL(uint32(vivify))
+		item := &cache.Item{Key: cmdinfo.Key, TTL: ttl}
+		item.Value = strconv.AppendUint(nil, initial, 10)
+		err = s.cache.Add(item)
+		if err == nil {
+			v = initial
+		} else if err == cache.ErrNotStored { // created by others
+			v, err = incr(cmdinfo.Key, delta)
+		}
+	}
+	if err == nil && cmdinfo.HasMetaFlag('T') {
+		err = s.touch(cmdinfo.Key, uint32(exptime))
+	}
+	switch err {
+	case nil:
+	case cache.ErrNotFound:
+		if cmdinfo.HasMetaFlag('q') {
+			return nil
+		}
+		return writeMetaRsp(w, "NF", cmdinfo, nil)
+	case cache.ErrNotStored:
+		return writeMetaRsp(w, "NS", cmdinfo, nil)
+	case cache.ErrNotNumber:
+		_, err = w.Write(memcache.MakeRspClientErr(err))
+		return err
+	default:
+		_, err = w.Write(memcache.MakeRspServerErr(err))
+		return err
+	}
+
+	var item *cache.Item
+	if cmdinfo.HasMetaFlag('c') || cmdinfo.HasMetaFlag('t') {
+		item, err = s.cache.Get(cmdinfo.Key)
+		if err == nil {
+			defer item.Free()
+		}
+	}
+	num := strconv.AppendUint(nil, v, 10)
+	if !cmdinfo.HasMetaFlag('v') {
+		if cmdinfo.HasMetaFlag('q') {
+			return nil
+		}
+		return writeMetaRsp(w, "HD", cmdinfo, item)
+	}
+	b := append([]byte("VA "), strconv.Itoa(len(num))...)
+	b = appendMetaFlags(b, cmdinfo, item, int64(len(num)))
+	b = append(b, memcache.EOL...)
+	b = append(b, num...)
+	b = append(b, memcache.EOL...)
+	_, err = w.Write(b)
+	return err
+}
+
+// me <key> [b]
+func (s *MemcacheServer) HandleMetaDebug(w io.Writer, cmdinfo *memcache.CommandInfo) error {
+	if err := checkMetaFlags(cmdinfo); err != nil {
+		_, err = w.Write(memcache.MakeRspClientErr(err))
+		return err
+	}
+	item, size, err := s.cache.GetRange(cmdinfo.Key, 0, 0) // metadata only
+	if err == cache.ErrNotFound {
+		_, err = w.Write(memcache.RspMetaEN)
+		return err
+	}
+	if err != nil {
+		_, err = w.Write(memcache.MakeRspServerErr(err))
+		return err
+	}
+	defer item.Free()
+	now := time.Now().Unix()
+	b := append([]byte("ME "), metaKey(cmdinfo)...)
+	b = append(b, " exp="...)
+	b = strconv.AppendInt(b, remainingTTL(item, now), 10)
+	b = append(b, " la="...)
+	b = strconv.AppendInt(b, now-item.Timestamp, 10)
+	b = append(b, " cas="...)
+	b = strconv.AppendUint(b, item.Cas, 10)
+	b = append(b, " fetch=no cls=1 size="...)
+	b = strconv.AppendInt(b, size, 10)
+	b = append(b, memcache.EOL...)
+	_, err = w.Write(b)
+	return err
+}
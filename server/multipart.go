@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/xiaost/blobcached/cache"
+	"github.com/xiaost/blobcached/protocol/memcache"
+)
+
+// HandleMultipartBegin starts a multipart upload of the key, the rsp is `UPLOAD <upload id>\r\n`
+func (s *MemcacheServer) HandleMultipartBegin(w io.Writer, cmdinfo *memcache.CommandInfo) error {
+	id, err := s.cache.BeginUpload(cmdinfo.Key)
+	if err != nil {
+		w.Write(memcache.MakeRspServerErr(err))
+		return err
+	}
+	_, err = w.Write([]byte("UPLOAD " + id + "\r\n"))
+	return err
+}
+
+// HandleMultipartPut stores the data block as a part of the upload, it replaces the part uploaded before
+func (s *MemcacheServer) HandleMultipartPut(w io.Writer, r *bufio.Reader, cmdinfo *memcache.CommandInfo) error {
+	n := cmdinfo.PayloadLen
+	if n > cache.MaxValueSize-4096 {
+		w.Write(memcache.MakeRspClientErr(cache.ErrValueSize))
+		return cache.ErrValueSize
+	}
+	vw, err := s.cache.NewPartWriter(cmdinfo.Key, cmdinfo.Part, n)
+	if err == cache.ErrNotFound || err == cache.ErrInvalidPart {
+		if _, err := r.Discard(int(n) + 2); err != nil {
+			return err
+		}
+		if err == cache.ErrNotFound {
+			_, err = w.Write(memcache.RspNotFound)
+			return err
+		}
+		_, err = w.Write(memcache.MakeRspClientErr(err))
+		return err
+	}
+	if err != nil {
+		w.Write(memcache.MakeRspServerErr(err))
+		return err
+	}
+	if err := readValueTo(w, r, vw, n); err != nil {
+		return err
+	}
+	return writeStoreRsp(w, vw.Commit(cache.StoreSet))
+}
+
+// HandleMultipartCommit stores the parts as the value of the key at once,
+// the upload is removed like storing an expired item if the exptime is in the past.
+func (s *MemcacheServer) HandleMultipartCommit(w io.Writer, cmdinfo *memcache.CommandInfo) error {
+	ttl, expired := exptimeToTTL(cmdinfo.Exptime)
+	var err error
+	if expired {
+		err = s.cache.AbortUpload(cmdinfo.Key)
+	} else {
+		err = s.cache.CommitUpload(cmdinfo.Key, cmdinfo.Part, &cache.Item{Flags: cmdinfo.Flags, TTL: ttl})
+	}
+	if err == cache.ErrMissingPart || err == cache.ErrInvalidPart {
+		_, err = w.Write(memcache.MakeRspClientErr(err))
+		return err
+	}
+	return writeStoreRsp(w, err)
+}
+
+// HandleMultipartAbort removes the upload and its parts
+func (s *MemcacheServer) HandleMultipartAbort(w io.Writer, cmdinfo *memcache.CommandInfo) error {
+	err := s.cache.AbortUpload(cmdinfo.Key)
+	switch err {
+	case nil:
+		_, err = w.Write(memcache.RspDeleted)
+		return err
+	case cache.ErrNotFound:
+		_, err = w.Write(memcache.RspNotFound)
+		return err
+	}
+	w.Write(memcache.MakeRspServerErr(err))
+	return err
+}
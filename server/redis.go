@@ -0,0 +1,813 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xiaost/blobcached/cache"
+	"github.com/xiaost/blobcached/protocol/resp"
+)
+
+// max length of arguments of redis commands except the value of SET
+const maxRedisArgLen = 64 << 10
+
+// the buffer of arguments larger than it is not reused by the next command
+const maxRedisBufSize = 1 << 20
+
+// error replies of redis commands
+const (
+	redisErrSyntax     = "ERR syntax error"
+	redisErrNotInteger = "ERR value is not an integer or out of range"
+	redisErrValueSize  = "ERR string exceeds maximum allowed size"
+)
+
+// redisArity is the number of arguments of redis commands including the command name,
+// it's the minimum number if negative.
+var redisArity = map[string]int{
+	"get":      2,
+	"set":      -3,
+	"mget":     -2,
+	"del":      -2,
+	"exists":   -2,
+	"expire":   -3,
+	"ttl":      2,
+	"getrange": 4,
+	"strlen":   2,
+	"ping":     -1,
+	"info":     -1,
+	"flushdb":  -1,
+	"flushall": -1,
+	"hello":    -1,
+	"select":   2,
+	"quit":     -1,
+}
+
+// redisError is replied to the client before closing the connection
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisConn is the state of a RESP connection
+type redisConn struct {
+	w     io.Writer
+	proto int      // RESP version, switched by HELLO
+	out   []byte   // the pending reply
+	buf   []byte   // the arguments of the current command except the value of SET
+	args  [][]byte // reused by readRedisCommand
+}
+
+func (c *redisConn) appendNull() {
+	if c.proto == 3 {
+		c.out = append(c.out, resp.RspNull...)
+	} else {
+		c.out = append(c.out, resp.RspNilBulk...)
+	}
+}
+
+func (c *redisConn) appendError(s string) {
+	c.out = resp.AppendError(c.out, s)
+}
+
+// appendBulk appends v as a bulk string, large v is written directly without copying
+func (c *redisConn) appendBulk(v []byte) error {
+	if len(v) < 4096 {
+		c.out = resp.AppendBulk(c.out, v)
+		return nil
+	}
+	c.out = resp.AppendBulkHeader(c.out, len(v))
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(v); err != nil {
+		return err
+	}
+	c.out = append(c.out, resp.EOL...)
+	return nil
+}
+
+// appendBulkFrom writes the value of rd as a bulk string
+func (c *redisConn) appendBulkFrom(rd cache.ValueReader) error {
+	c.out = resp.AppendBulkHeader(c.out, int(rd.Size()))
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(c.w, rd); err != nil {
+		return err
+	}
+	c.out = append(c.out, resp.EOL...)
+	return nil
+}
+
+func (c *redisConn) flush() error {
+	if len(c.out) == 0 {
+		return nil
+	}
+	_, err := c.w.Write(c.out)
+	c.out = c.out[:0]
+	return err
+}
+
+// ServRedis serves the redis protocol (RESP2 and RESP3) on l with the same cache,
+// the string commands are mapped to the cache, see HandleRedis.
+func (s *MemcacheServer) ServRedis(l net.Listener) error {
+	return s.servListener(l, "redis", s.HandleRedis)
+}
+
+// HandleRedis processes redis commands of conn,
+// supports GET, SET, MGET, DEL, EXISTS, EXPIRE, TTL, GETRANGE, STRLEN, PING, INFO, FLUSHDB, FLUSHALL, HELLO, SELECT and QUIT.
+func (s *MemcacheServer) HandleRedis(conn net.Conn) {
+	const maxReadPerRequest = 2 * cache.MaxValueSize
+	dr := &deadlineReader{conn: conn}
+	r := &io.LimitedReader{R: dr, N: maxReadPerRequest}
+	w := &WriterCounter{conn, 0}
+	rbuf := bufio.NewReader(r)
+	c := &redisConn{w: w, proto: 2}
+	for {
+		atomic.AddUint64(&s.metrics.BytesRead, uint64(maxReadPerRequest-r.N))
+		atomic.AddUint64(&s.metrics.BytesWritten, uint64(w.N))
+
+		r.N = maxReadPerRequest
+		w.N = 0
+
+		if cap(c.buf) > maxRedisBufSize {
+			c.buf = nil
+		}
+		dr.timeout = 0
+		conn.SetDeadline(time.Now().Add(48 * time.Hour))
+
+		// wait for the next request
+		if !s.setConnIdle(conn, true) {
+			return
+		}
+		_, err := rbuf.Peek(1)
+		s.setConnIdle(conn, false)
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				log.Printf("read %s err: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		// avoid blocking on reading args or writing rsp, the deadline is extended on every read of args
+		conn.SetDeadline(time.Now().Add(requestTimeout))
+		dr.timeout = requestTimeout
+
+		args, item, err := s.readRedisCommand(c, rbuf)
+		if err != nil {
+			if e, ok := err.(redisError); ok {
+				log.Printf("parse %s command err: %s", conn.RemoteAddr(), e)
+				c.appendError(string(e))
+				c.flush()
+			} else if err != io.EOF {
+				log.Printf("read %s err: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) == 0 { // empty line of inline commands
+			continue
+		}
+		cmd := strings.ToLower(string(args[0]))
+		s.logf(LogDebug, "client %s redis command: %s, args: %d", conn.RemoteAddr(), cmd, len(args)-1)
+
+		err = s.processRedisCommand(c, cmd, args, item)
+		if item != nil {
+			item.Free()
+		}
+		if err == nil {
+			err = c.flush()
+		}
+		if err == errQuit {
+			c.flush()
+			return
+		}
+		if err != nil {
+			log.Printf("client %s process err: %s", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// readRedisLine reads a line of request, the line is only valid until the next read
+func readRedisLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		b := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull && len(b) <= resp.MaxInlineLen {
+			line, err = r.ReadSlice('\n')
+			b = append(b, line...)
+		}
+		if len(b) > resp.MaxInlineLen {
+			return nil, redisError("ERR Protocol error: too big request")
+		}
+		line = b
+	}
+	return line, err
+}
+
+// readRedisCommand reads a multibulk or inline command, the args are read into the buffer of c
+// and only valid until the next command. the value of SET is read into the returned item which should be freed by the caller.
+func (s *MemcacheServer) readRedisCommand(c *redisConn, r *bufio.Reader) (args [][]byte, item *cache.Item, err error) {
+	c.buf = c.buf[:0]
+	args = c.args[:0]
+	defer func() { c.args = args[:0] }()
+
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if line[0] != '*' {
+		inline, err := resp.ParseInline(line)
+		if err != nil {
+			return nil, nil, redisError("ERR Protocol error: " + err.Error())
+		}
+		for _, arg := range inline { // the line will be overwritten
+			off := len(c.buf)
+			c.buf = append(c.buf, arg...)
+			args = append(args, c.buf[off:len(c.buf):len(c.buf)])
+		}
+		if len(args) >= 3 && bytes.EqualFold(args[0], []byte("set")) {
+			item = s.allocator.Alloc(len(args[2]))
+			copy(item.Value, args[2])
+			args[2] = item.Value
+		}
+		return args, item, nil
+	}
+
+	n, err := resp.ParseLength(line, '*')
+	if err != nil {
+		return nil, nil, redisError("ERR Protocol error: " + err.Error())
+	}
+	var isSet bool
+	for i := int64(0); i < n; i++ {
+		if line, err = readRedisLine(r); err != nil {
+			break
+		}
+		var m int64
+		if m, err = resp.ParseLength(line, '$'); err != nil {
+			err = redisError("ERR Protocol error: " + err.Error())
+			break
+		}
+		if i == 2 && isSet {
+			if m > cache.MaxValueSize-4096 {
+				err = redisError(redisErrValueSize)
+				break
+			}
+			item = s.allocator.Alloc(int(m) + 2) // including \r\n
+			if _, err = io.ReadFull(r, item.Value); err != nil {
+				break
+			}
+			item.Value = item.Value[:m] // remove \r\n
+			args = append(args, item.Value)
+			continue
+		}
+		if m > maxRedisArgLen {
+			err = redisError("ERR Protocol error: " + resp.ErrInvalidBulkLen.Error())
+			break
+		}
+		// the args read before are kept in the old array if c.buf grows
+		off := len(c.buf)
+		c.buf = append(c.buf, make([]byte, m+2)...)
+		if _, err = io.ReadFull(r, c.buf[off:]); err != nil {
+			break
+		}
+		arg := c.buf[off : off+int(m) : off+int(m)]
+		args = append(args, arg)
+		if i == 0 {
+			isSet = bytes.EqualFold(arg, []byte("set"))
+		}
+	}
+	if err != nil {
+		if item != nil {
+			item.Free()
+		}
+		return nil, nil, err
+	}
+	return args, item, nil
+}
+
+func (s *MemcacheServer) processRedisCommand(c *redisConn, cmd string, args [][]byte, item *cache.Item) error {
+	arity, ok := redisArity[cmd]
+	if !ok {
+		msg := fmt.Sprintf("ERR unknown command '%s', with args beginning with: ", args[0])
+		for _, arg := range args[1:] {
+			msg += fmt.Sprintf("'%s' ", arg)
+		}
+		c.appendError(msg)
+		return nil
+	}
+	if (arity > 0 && len(args) != arity) || (arity < 0 && len(args) < -arity) {
+		c.appendError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd))
+		return nil
+	}
+	switch cmd {
+	case "get":
+		return s.redisGet(c, args)
+	case "set":
+		s.redisSet(c, args, item)
+	case "mget":
+		return s.redisMGet(c, args)
+	case "del":
+		s.redisDel(c, args)
+	case "exists":
+		s.redisExists(c, args)
+	case "expire":
+		s.redisExpire(c, args)
+	case "ttl":
+		s.redisTTL(c, args)
+	case "getrange":
+		return s.redisGetRange(c, args)
+	case "strlen":
+		s.redisStrlen(c, args)
+	case "ping":
+		redisPing(c, args)
+	case "info":
+		s.redisInfo(c, args)
+	case "flushdb", "flushall":
+		s.redisFlush(c, args)
+	case "hello":
+		s.redisHello(c, args)
+	case "select":
+		redisSelect(c, args)
+	case "quit":
+		c.out = append(c.out, resp.RspOK...)
+		return errQuit
+	}
+	return nil
+}
+
+// appendCacheError appends the err of cache as an error reply
+func (s *MemcacheServer) appendCacheError(c *redisConn, key []byte, err error) {
+	log.Printf("redis key %s err: %s", key, err)
+	c.appendError("ERR " + err.Error())
+}
+
+func (s *MemcacheServer) redisGet(c *redisConn, args [][]byte) error {
+	item, rd, err := s.cache.GetReader(string(args[1]), sendfileSize, !s.options.SkipSendfileCrc)
+	if err == cache.ErrNotFound {
+		c.appendNull()
+		return nil
+	}
+	if err != nil {
+		s.appendCacheError(c, args[1], err)
+		return nil
+	}
+	defer item.Free()
+	if rd == nil {
+		return c.appendBulk(item.Value)
+	}
+	defer rd.Close()
+	return c.appendBulkFrom(rd)
+}
+
+// redisSet processes SET key value [EX seconds|PX milliseconds] [NX|XX]
+func (s *MemcacheServer) redisSet(c *redisConn, args [][]byte, item *cache.Item) {
+	var ttl int64
+	var nx, xx bool
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if ttl > 0 || i+1 == len(args) {
+				c.appendError(redisErrSyntax)
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				c.appendError(redisErrNotInteger)
+				return
+			}
+			if opt == "PX" && n > 0 {
+				n = (n + 999) / 1000 // the ttl of items is in seconds
+			}
+			if n <= 0 || n > math.MaxUint32 {
+				c.appendError("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = n
+		default:
+			c.appendError(redisErrSyntax)
+			return
+		}
+	}
+	if nx && xx {
+		c.appendError(redisErrSyntax)
+		return
+	}
+
+	item.Key = string(args[1])
+	item.TTL = uint32(ttl)
+	var err error
+	switch {
+	case nx:
+		err = s.cache.Add(item)
+	case xx:
+		err = s.cache.Replace(item)
+	default:
+		err = s.cache.Set(item)
+	}
+	if err == cache.ErrNotStored {
+		c.appendNull()
+		return
+	}
+	if err != nil {
+		s.appendCacheError(c, args[1], err)
+		return
+	}
+	c.out = append(c.out, resp.RspOK...)
+}
+
+func (s *MemcacheServer) redisMGet(c *redisConn, args [][]byte) error {
+	keys := make([]string, len(args)-1)
+	for i, k := range args[1:] {
+		keys[i] = string(k)
+	}
+	// the large values are read one by one when replying, not all in memory at once
+	items, errs := s.cache.GetMulti(keys, sendfileSize-1)
+	defer func() {
+		for _, item := range items {
+			if item != nil {
+				item.Free()
+			}
+		}
+	}()
+	c.out = resp.AppendArrayHeader(c.out, len(keys))
+	for i, k := range keys {
+		if errs[i] == cache.ErrValueSize {
+			items[i], errs[i] = s.cache.Get(k)
+		}
+		if err := errs[i]; err != nil {
+			if err != cache.ErrNotFound {
+				log.Printf("redis key %s err: %s", k, err)
+			}
+			c.appendNull()
+			continue
+		}
+		err := c.appendBulk(items[i].Value)
+		items[i].Free()
+		items[i] = nil
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemcacheServer) redisDel(c *redisConn, args [][]byte) {
+	keys := make([]string, len(args)-1)
+	for i, k := range args[1:] {
+		keys[i] = string(k)
+	}
+	var n int64
+	for i, err := range s.cache.DelMulti(keys) {
+		if err == nil {
+			n++
+		} else if err != cache.ErrNotFound {
+			s.appendCacheError(c, args[i+1], err)
+			return
+		}
+	}
+	c.out = resp.AppendInt(c.out, n)
+}
+
+// redisLookup returns the item of key without value, it's nil if not found.
+// ok is false if the error is appended to c.
+func (s *MemcacheServer) redisLookup(c *redisConn, key []byte) (item *cache.Item, size int64, ok bool) {
+	item, size, err := s.cache.GetRange(string(key), 0, 0)
+	if err == cache.ErrNotFound {
+		return nil, 0, true
+	}
+	if err != nil {
+		s.appendCacheError(c, key, err)
+		return nil, 0, false
+	}
+	return item, size, true
+}
+
+func (s *MemcacheServer) redisExists(c *redisConn, args [][]byte) {
+	var n int64
+	for _, k := range args[1:] {
+		item, _, ok := s.redisLookup(c, k)
+		if !ok {
+			return
+		}
+		if item != nil {
+			item.Free()
+			n++
+		}
+	}
+	c.out = resp.AppendInt(c.out, n)
+}
+
+// itemTTL returns the remaining seconds of item, -1 if the item never expires
+func (s *MemcacheServer) itemTTL(item *cache.Item) int64 {
+	age := time.Now().Unix() - item.Timestamp
+	ttl := int64(math.MaxInt64)
+	if item.TTL > 0 {
+		ttl = int64(item.TTL) - age
+	}
+	if g := s.cache.GetOptions().TTL; g > 0 && g-age < ttl {
+		ttl = g - age
+	}
+	if ttl == math.MaxInt64 {
+		return -1
+	}
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// redisExpire processes EXPIRE key seconds [NX|XX|GT|LT]
+func (s *MemcacheServer) redisExpire(c *redisConn, args [][]byte) {
+	seconds, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		c.appendError(redisErrNotInteger)
+		return
+	}
+	var nx, xx, gt, lt bool
+	for _, arg := range args[3:] {
+		switch strings.ToUpper(string(arg)) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			c.appendError("ERR Unsupported option " + string(arg))
+			return
+		}
+	}
+	if nx && (xx || gt || lt) {
+		c.appendError("ERR NX and XX, GT or LT options at the same time are not compatible")
+		return
+	}
+	if gt && lt {
+		c.appendError("ERR GT and LT options at the same time are not compatible")
+		return
+	}
+	if seconds > math.MaxUint32 {
+		c.appendError("ERR invalid expire time in 'expire' command")
+		return
+	}
+
+	key := string(args[1])
+	if nx || xx || gt || lt {
+		item, _, ok := s.redisLookup(c, args[1])
+		if !ok {
+			return
+		}
+		if item == nil {
+			c.out = resp.AppendInt(c.out, 0)
+			return
+		}
+		cur := s.itemTTL(item)
+		item.Free()
+		if (nx && cur >= 0) || (xx && cur < 0) ||
+			(gt && (cur < 0 || seconds <= cur)) || (lt && cur >= 0 && seconds >= cur) {
+			c.out = resp.AppendInt(c.out, 0)
+			return
+		}
+	}
+	if seconds <= 0 {
+		err = s.cache.Del(key)
+	} else {
+		err = s.cache.Touch(key, uint32(seconds))
+	}
+	if err == cache.ErrNotFound {
+		c.out = resp.AppendInt(c.out, 0)
+		return
+	}
+	if err != nil {
+		s.appendCacheError(c, args[1], err)
+		return
+	}
+	c.out = resp.AppendInt(c.out, 1)
+}
+
+func (s *MemcacheServer) redisTTL(c *redisConn, args [][]byte) {
+	item, _, ok := s.redisLookup(c, args[1])
+	if !ok {
+		return
+	}
+	if item == nil {
+		c.out = resp.AppendInt(c.out, -2)
+		return
+	}
+	c.out = resp.AppendInt(c.out, s.itemTTL(item))
+	item.Free()
+}
+
+// redisGetRange processes GETRANGE key start end, the end is inclusive and negative offsets are relative to the end
+func (s *MemcacheServer) redisGetRange(c *redisConn, args [][]byte) error {
+	start, err1 := strconv.ParseInt(string(args[2]), 10, 64)
+	end, err2 := strconv.ParseInt(string(args[3]), 10, 64)
+	if err1 != nil || err2 != nil {
+		c.appendError(redisErrNotInteger)
+		return nil
+	}
+	if start < 0 || end < 0 {
+		item, size, ok := s.redisLookup(c, args[1])
+		if !ok {
+			return nil
+		}
+		if item == nil {
+			return c.appendBulk(nil)
+		}
+		item.Free()
+		if start < 0 {
+			start += size
+		}
+		if end < 0 {
+			end += size
+		}
+		if start < 0 {
+			start = 0
+		}
+		if end < 0 {
+			end = 0
+		}
+	}
+	if start > end {
+		return c.appendBulk(nil)
+	}
+	if end-start >= cache.MaxValueSize {
+		// like redis, the end is clamped, and GetRange truncates it at the end of value
+		end = start + cache.MaxValueSize - 1
+	}
+	item, _, err := s.cache.GetRange(string(args[1]), start, end-start+1)
+	if err == cache.ErrNotFound || err == cache.ErrInvalidRange {
+		return c.appendBulk(nil)
+	}
+	if err != nil {
+		s.appendCacheError(c, args[1], err)
+		return nil
+	}
+	defer item.Free()
+	return c.appendBulk(item.Value)
+}
+
+func (s *MemcacheServer) redisStrlen(c *redisConn, args [][]byte) {
+	item, size, ok := s.redisLookup(c, args[1])
+	if !ok {
+		return
+	}
+	if item != nil {
+		item.Free()
+	}
+	c.out = resp.AppendInt(c.out, size)
+}
+
+func redisPing(c *redisConn, args [][]byte) {
+	switch len(args) {
+	case 1:
+		c.out = append(c.out, resp.RspPong...)
+	case 2:
+		c.out = resp.AppendBulk(c.out, args[1])
+	default:
+		c.appendError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+// redisInfo processes INFO [section [section ...]], the sections are server, clients, stats and keyspace
+func (s *MemcacheServer) redisInfo(c *redisConn, args [][]byte) {
+	sections := map[string]bool{}
+	for _, arg := range args[1:] {
+		sections[strings.ToLower(string(arg))] = true
+	}
+	all := len(sections) == 0 || sections["all"] || sections["default"] || sections["everything"]
+
+	var b strings.Builder
+	writeStat := func(name string, v interface{}) {
+		fmt.Fprintf(&b, "%s:%v\r\n", name, v)
+	}
+	writeSection := func(name string, collect func()) {
+		if !all && !sections[strings.ToLower(name)] {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + name + "\r\n")
+		collect()
+	}
+	writeSection("Server", func() {
+		writeStat("blobcached_version", s.options.Version)
+		writeStat("redis_mode", "standalone")
+		writeStat("process_id", os.Getpid())
+		writeStat("uptime_in_seconds", int64(time.Since(s.startTime).Seconds()))
+	})
+	writeSection("Clients", func() {
+		writeStat("connected_clients", atomic.LoadInt64(&s.metrics.CurrConnections))
+	})
+	writeSection("Stats", func() {
+		s.collectGeneralStats(writeStat)
+	})
+	writeSection("Keyspace", func() {
+		writeStat("db0", fmt.Sprintf("keys=%d", s.cache.GetStats().Keys))
+	})
+
+	if c.proto == 3 {
+		c.out = resp.AppendVerbatim(c.out, "txt", b.String())
+	} else {
+		c.out = resp.AppendBulkString(c.out, b.String())
+	}
+}
+
+// redisFlush processes FLUSHDB [ASYNC|SYNC], the cache is flushed at once in both modes
+func (s *MemcacheServer) redisFlush(c *redisConn, args [][]byte) {
+	if len(args) > 2 {
+		c.appendError(redisErrSyntax)
+		return
+	}
+	if len(args) == 2 {
+		if opt := strings.ToUpper(string(args[1])); opt != "ASYNC" && opt != "SYNC" {
+			c.appendError(redisErrSyntax)
+			return
+		}
+	}
+	if err := s.flushAll(0); err != nil {
+		log.Printf("redis flush err: %s", err)
+		c.appendError("ERR " + err.Error())
+		return
+	}
+	c.out = append(c.out, resp.RspOK...)
+}
+
+// redisHello processes HELLO [protover [AUTH username password] [SETNAME clientname]],
+// AUTH is accepted without checking since there is no password, and the name is ignored.
+func (s *MemcacheServer) redisHello(c *redisConn, args [][]byte) {
+	proto := c.proto
+	if len(args) > 1 {
+		n, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			c.appendError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if n != 2 && n != 3 {
+			c.appendError("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = n
+	}
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "AUTH" && i+2 < len(args):
+			i += 2
+		case opt == "SETNAME" && i+1 < len(args):
+			i++
+		default:
+			c.appendError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))
+			return
+		}
+	}
+	c.proto = proto
+
+	if proto == 3 {
+		c.out = resp.AppendMapHeader(c.out, 6)
+	} else {
+		c.out = resp.AppendArrayHeader(c.out, 12)
+	}
+	c.out = resp.AppendBulkString(c.out, "server")
+	c.out = resp.AppendBulkString(c.out, "blobcached")
+	c.out = resp.AppendBulkString(c.out, "version")
+	c.out = resp.AppendBulkString(c.out, s.options.Version)
+	c.out = resp.AppendBulkString(c.out, "proto")
+	c.out = resp.AppendInt(c.out, int64(proto))
+	c.out = resp.AppendBulkString(c.out, "mode")
+	c.out = resp.AppendBulkString(c.out, "standalone")
+	c.out = resp.AppendBulkString(c.out, "role")
+	c.out = resp.AppendBulkString(c.out, "master")
+	c.out = resp.AppendBulkString(c.out, "modules")
+	c.out = resp.AppendArrayHeader(c.out, 0)
+}
+
+// redisSelect processes SELECT index, only the db 0 exists
+func redisSelect(c *redisConn, args [][]byte) {
+	n, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		c.appendError(redisErrNotInteger)
+		return
+	}
+	if n != 0 {
+		c.appendError("ERR DB index is out of range")
+		return
+	}
+	c.out = append(c.out, resp.RspOK...)
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xiaost/blobcached/cache"
+)
+
+// readRedisReply reads a reply and formats it like `+OK`, `:1`, `$v`, `(nil)`, `[$a (nil)]` or `{$k:$v}`
+func readRedisReply(t *testing.T, r *bufio.Reader) string {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', '-', ':':
+		return line
+	case '_':
+		return "(nil)"
+	case '$', '=':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatal(err)
+		}
+		return "$" + string(b[:n])
+	case '*', '%':
+		n, _ := strconv.Atoi(line[1:])
+		var ss []string
+		for i := 0; i < n; i++ {
+			if line[0] == '%' {
+				ss = append(ss, readRedisReply(t, r)+":"+readRedisReply(t, r))
+			} else {
+				ss = append(ss, readRedisReply(t, r))
+			}
+		}
+		if line[0] == '%' {
+			return "{" + strings.Join(ss, " ") + "}"
+		}
+		return "[" + strings.Join(ss, " ") + "]"
+	}
+	t.Fatal("unknown reply", line)
+	return ""
+}
+
+func TestRedisServer(t *testing.T) {
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewMemcacheServer(nil, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
+	go s.ServRedis(l)
+	defer s.Shutdown()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	do := func(args ...string) string {
+		req := fmt.Sprintf("*%d\r\n", len(args))
+		for _, arg := range args {
+			req += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+		}
+		if _, err := conn.Write([]byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		return readRedisReply(t, r)
+	}
+
+	big := strings.Repeat("x", 10000)
+	huge := strings.Repeat("y", sendfileSize) // read by the reader
+	// `~:n` matches the ttl n or n-1 in case of crossing seconds
+	for _, tc := range []struct {
+		args []string
+		rsp  string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"ping", "hi"}, "$hi"},
+		{[]string{"GET", "k1"}, "(nil)"},
+		{[]string{"SET", "k1", "0123456789"}, "+OK"},
+		{[]string{"GET", "k1"}, "$0123456789"},
+		{[]string{"SET", "k1", "v", "NX"}, "(nil)"},
+		{[]string{"SET", "k2", "v", "XX"}, "(nil)"},
+		{[]string{"SET", "k2", big, "NX", "EX", "100"}, "+OK"},
+		{[]string{"GET", "k2"}, "$" + big},
+		{[]string{"SET", "k4", huge}, "+OK"},
+		{[]string{"GET", "k4"}, "$" + huge},
+		{[]string{"SET", "k2", "v", "EX", "0"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"SET", "k2", "v", "NX", "XX"}, "-ERR syntax error"},
+		{[]string{"SET", "k2", "v", "EX"}, "-ERR syntax error"},
+		{[]string{"SET", "k2", "v", "EX", "x"}, "-ERR value is not an integer or out of range"},
+		{[]string{"MGET", "k1", "k3", "k2"}, "[$0123456789 (nil) $" + big + "]"},
+		{[]string{"EXISTS", "k1", "k2", "k3", "k1"}, ":3"},
+		{[]string{"STRLEN", "k2"}, ":10000"},
+		{[]string{"STRLEN", "k3"}, ":0"},
+		{[]string{"GETRANGE", "k1", "2", "4"}, "$234"},
+		{[]string{"GETRANGE", "k1", "-3", "-1"}, "$789"},
+		{[]string{"GETRANGE", "k1", "8", "100"}, "$89"},
+		{[]string{"GETRANGE", "k1", "0", "200000000"}, "$0123456789"},
+		{[]string{"GETRANGE", "k1", "3", "9223372036854775807"}, "$3456789"},
+		{[]string{"GETRANGE", "k1", "0", "-100"}, "$0"},
+		{[]string{"GETRANGE", "k1", "5", "2"}, "$"},
+		{[]string{"GETRANGE", "k1", "20", "30"}, "$"},
+		{[]string{"GETRANGE", "k3", "0", "1"}, "$"},
+		{[]string{"TTL", "k1"}, ":-1"},
+		{[]string{"TTL", "k2"}, "~:100"},
+		{[]string{"TTL", "k3"}, ":-2"},
+		{[]string{"EXPIRE", "k1", "50", "XX"}, ":0"},
+		{[]string{"EXPIRE", "k1", "50"}, ":1"},
+		{[]string{"TTL", "k1"}, "~:50"},
+		{[]string{"EXPIRE", "k1", "10", "GT"}, ":0"},
+		{[]string{"EXPIRE", "k1", "10", "LT"}, ":1"},
+		{[]string{"EXPIRE", "k1", "10", "NX", "GT"}, "-ERR NX and XX, GT or LT options at the same time are not compatible"},
+		{[]string{"EXPIRE", "k3", "10"}, ":0"},
+		{[]string{"EXPIRE", "k1", "0"}, ":1"},
+		{[]string{"DEL", "k1", "k2", "k3"}, ":1"},
+		{[]string{"GET", "k2"}, "(nil)"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"LPUSH", "k", "v"}, "-ERR unknown command 'LPUSH', with args beginning with: 'k' 'v' "},
+		{[]string{"SELECT", "0"}, "+OK"},
+		{[]string{"SELECT", "1"}, "-ERR DB index is out of range"},
+		{[]string{"SET", "k1", "v1"}, "+OK"},
+		{[]string{"FLUSHDB"}, "+OK"},
+		{[]string{"GET", "k1"}, "(nil)"},
+		{[]string{"HELLO", "4"}, "-NOPROTO unsupported protocol version"},
+		{[]string{"HELLO", "3", "SETNAME", "x"}, "{$server:$blobcached $version:$1.0 $proto::3 $mode:$standalone $role:$master $modules:[]}"},
+		{[]string{"GET", "k1"}, "(nil)"},
+		{[]string{"MGET", "k1"}, "[(nil)]"},
+		{[]string{"HELLO", "2"}, "[$server $blobcached $version $1.0 $proto :2 $mode $standalone $role $master $modules []]"},
+	} {
+		rsp := do(tc.args...)
+		if strings.HasPrefix(tc.rsp, "~:") {
+			n, _ := strconv.Atoi(tc.rsp[2:])
+			if rsp == ":"+strconv.Itoa(n-1) {
+				continue
+			}
+			tc.rsp = tc.rsp[1:]
+		}
+		if rsp != tc.rsp {
+			t.Fatalf("%v: %q != %q", tc.args, rsp, tc.rsp)
+		}
+	}
+	if rsp := do("INFO", "keyspace"); rsp != "$# Keyspace\r\ndb0:keys=0\r\n" {
+		t.Fatalf("info err: %q", rsp)
+	}
+	if rsp := do("INFO"); !strings.Contains(rsp, "# Server\r\nblobcached_version:1.0\r\n") || !strings.Contains(rsp, "# Stats\r\n") {
+		t.Fatalf("info err: %q", rsp)
+	}
+
+	// inline and pipelined commands
+	if _, err := conn.Write([]byte("SET k1 \"hello world\"\r\nGET k1\r\n\r\nPING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"+OK", "$hello world", "+PONG"} {
+		if rsp := readRedisReply(t, r); rsp != expect {
+			t.Fatalf("%q != %q", rsp, expect)
+		}
+	}
+
+	if rsp := do("QUIT"); rsp != "+OK" {
+		t.Fatal("quit err", rsp)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatal("conn should be closed", err)
+	}
+
+	// protocol error closes the conn
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r = bufio.NewReader(conn)
+	if rsp := do("SET", "k1", strings.Repeat("x", 100)); rsp != "+OK" {
+		t.Fatal("set err", rsp)
+	}
+	conn.Write([]byte("*2\r\n$3\r\nGET\r\n+k1\r\n"))
+	if rsp := readRedisReply(t, r); rsp != "-ERR Protocol error: expected '$', got '+'" {
+		t.Fatal("should be protocol err", rsp)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatal("conn should be closed", err)
+	}
+}
+
+func TestRedisServerSlowCommand(t *testing.T) {
+	defer func(d time.Duration) { requestTimeout = d }(requestTimeout)
+	requestTimeout = 200 * time.Millisecond
+
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewMemcacheServer(nil, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
+	go s.ServRedis(l)
+	defer s.Shutdown()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// the command takes longer than requestTimeout, but each part arrives in time
+	v := strings.Repeat("x", 1<<20)
+	req := fmt.Sprintf("*3\r\n$3\r\nSET\r\n$2\r\nk1\r\n$%d\r\n%s\r\n", len(v), v)
+	for i := 0; i < 8; i++ {
+		conn.Write([]byte(req[i*len(req)/8 : (i+1)*len(req)/8]))
+		time.Sleep(50 * time.Millisecond)
+	}
+	if rsp := readRedisReply(t, r); rsp != "+OK" {
+		t.Fatal("set rsp err", rsp)
+	}
+
+	// the buffer of args is reused by the pipelined commands
+	for _, k := range []string{"k1", "k2"} {
+		fmt.Fprintf(conn, "*2\r\n$6\r\nSTRLEN\r\n$2\r\n%s\r\n", k)
+	}
+	if rsp := readRedisReply(t, r); rsp != ":1048576" {
+		t.Fatal("strlen rsp err", rsp)
+	}
+	if rsp := readRedisReply(t, r); rsp != ":0" {
+		t.Fatal("strlen rsp err", rsp)
+	}
+
+	// the conn is closed if the command stalls
+	fmt.Fprintf(conn, "*2\r\n$3\r\nGET\r\n$2\r\nk")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatal("conn should be closed", err)
+	}
+}
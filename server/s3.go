@@ -0,0 +1,561 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xiaost/blobcached/cache"
+)
+
+const (
+	s3MaxKeys = 1000
+
+	s3HeaderFlags = "X-Amz-Meta-Flags" // flags of the item
+	s3HeaderTTL   = "X-Amz-Meta-Ttl"   // ttl of the item in seconds
+
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "2006-01-02T15:04:05.000Z"
+)
+
+type S3Options struct {
+	Region    string // region of the credential scope, us-east-1 if empty
+	AccessKey string // requests must be signed with SigV4 if AccessKey is not empty
+	SecretKey string
+}
+
+// S3Server serves the cache with a subset of S3 API in path-style:
+// PutObject, GetObject, HeadObject, DeleteObject and ListObjectsV2.
+// the object key is stored as `<bucket>/<key>` in the cache.
+type S3Server struct {
+	l         net.Listener
+	cache     Cache
+	allocator cache.Allocator
+	options   S3Options
+	srv       http.Server
+}
+
+func NewS3Server(l net.Listener, cache Cache, allocator cache.Allocator, options *S3Options) *S3Server {
+	s := &S3Server{l: l, cache: cache, allocator: allocator}
+	if options != nil {
+		s.options = *options
+	}
+	if s.options.Region == "" {
+		s.options.Region = "us-east-1"
+	}
+	s.srv.Handler = s
+	s.srv.ReadHeaderTimeout = 60 * time.Second
+	s.srv.IdleTimeout = 48 * time.Hour
+	return s
+}
+
+// Serv serves the listener until Shutdown, it returns http.ErrServerClosed after Shutdown
+func (s *S3Server) Serv() error {
+	log.Printf("s3 server listening on %s", s.l.Addr())
+	return s.srv.Serve(s.l)
+}
+
+// Shutdown stops the server gracefully
+func (s *S3Server) Shutdown() error {
+	return s.srv.Shutdown(context.Background())
+}
+
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+var (
+	s3ErrNoSuchKey             = &s3Error{404, "NoSuchKey", "The specified key does not exist."}
+	s3ErrInvalidRange          = &s3Error{416, "InvalidRange", "The requested range is not satisfiable."}
+	s3ErrInvalidArgument       = &s3Error{400, "InvalidArgument", "Invalid Argument."}
+	s3ErrMissingContentLength  = &s3Error{411, "MissingContentLength", "You must provide the Content-Length HTTP header."}
+	s3ErrEntityTooLarge        = &s3Error{400, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size."}
+	s3ErrIncompleteBody        = &s3Error{400, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header."}
+	s3ErrBadDigest             = &s3Error{400, "BadDigest", "The Content-MD5 you specified did not match what we received."}
+	s3ErrSHA256Mismatch        = &s3Error{400, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+	s3ErrMissingSecurityHeader = &s3Error{400, "MissingSecurityHeader", "Your request is missing a required header."}
+	s3ErrAccessDenied          = &s3Error{403, "AccessDenied", "Access Denied."}
+	s3ErrInvalidAccessKeyId    = &s3Error{403, "InvalidAccessKeyId", "The AWS access key Id you provided does not exist in our records."}
+	s3ErrSignatureDoesNotMatch = &s3Error{403, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	s3ErrRequestTimeTooSkewed  = &s3Error{403, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	s3ErrMethodNotAllowed      = &s3Error{405, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	s3ErrInternalError         = &s3Error{500, "InternalError", "We encountered an internal error. Please try again."}
+	s3ErrNotImplemented        = &s3Error{501, "NotImplemented", "A header or request you provided implies functionality that is not implemented."}
+)
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, e *s3Error) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.Status)
+	if r.Method == "HEAD" {
+		return
+	}
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+}
+
+func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.options.AccessKey != "" {
+		if e := s.verifySigV4(r, time.Now()); e != nil {
+			writeS3Error(w, r, e)
+			return
+		}
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, object := path, ""
+	if idx := strings.IndexByte(path, '/'); idx >= 0 {
+		bucket, object = path[:idx], path[idx+1:]
+	}
+	if bucket == "" { // ListBuckets
+		writeS3Error(w, r, s3ErrNotImplemented)
+		return
+	}
+	if object == "" {
+		switch {
+		case r.Method == "GET" && r.URL.Query().Get("list-type") == "2":
+			s.ListObjectsV2(w, r, bucket)
+		case r.Method == "HEAD": // HeadBucket, buckets always exist
+			w.WriteHeader(http.StatusOK)
+		default:
+			writeS3Error(w, r, s3ErrNotImplemented)
+		}
+		return
+	}
+	key := bucket + "/" + object
+	switch r.Method {
+	case "GET", "HEAD":
+		s.GetObject(w, r, key)
+	case "PUT":
+		s.PutObject(w, r, key)
+	case "DELETE":
+		s.DeleteObject(w, r, key)
+	default:
+		writeS3Error(w, r, s3ErrMethodNotAllowed)
+	}
+}
+
+// s3ETag returns the md5 of the value stored by PutObject like S3, or the cas unique for other items
+func s3ETag(cas uint64, sum []byte) string {
+	if len(sum) == md5.Size {
+		return `"` + hex.EncodeToString(sum) + `"`
+	}
+	return `"` + strconv.FormatUint(cas, 10) + `"`
+}
+
+// GetObject writes the object for GetObject and HeadObject
+func (s *S3Server) GetObject(w http.ResponseWriter, r *http.Request, key string) {
+	item, rd, rg, err := getItemForRequest(s.cache, r, key)
+	switch err {
+	case nil:
+	case cache.ErrNotFound:
+		writeS3Error(w, r, s3ErrNoSuchKey)
+		return
+	case cache.ErrInvalidRange:
+		w.Header().Set("Content-Range", rg.ContentRange())
+		writeS3Error(w, r, s3ErrInvalidRange)
+		return
+	default:
+		log.Printf("s3 get key %s err: %s", key, err)
+		writeS3Error(w, r, s3ErrInternalError)
+		return
+	}
+	defer item.Free()
+	if rd != nil {
+		defer rd.Close()
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("ETag", s3ETag(item.Cas, item.MD5))
+	h.Set("Last-Modified", time.Unix(item.Timestamp, 0).UTC().Format(http.TimeFormat))
+	h.Set(s3HeaderFlags, strconv.FormatUint(uint64(item.Flags), 10))
+	h.Set(s3HeaderTTL, strconv.FormatUint(uint64(item.TTL), 10))
+	writeItemValue(w, r, item, rd, rg)
+}
+
+// PutObject stores the body as the object, the flags and ttl are set by x-amz-meta-flags and x-amz-meta-ttl
+func (s *S3Server) PutObject(w http.ResponseWriter, r *http.Request, key string) {
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if r.Header.Get("X-Amz-Copy-Source") != "" || strings.HasPrefix(payloadHash, "STREAMING-") {
+		writeS3Error(w, r, s3ErrNotImplemented)
+		return
+	}
+	if r.ContentLength < 0 {
+		writeS3Error(w, r, s3ErrMissingContentLength)
+		return
+	}
+	if r.ContentLength > cache.MaxChunkedValueSize {
+		writeS3Error(w, r, s3ErrEntityTooLarge)
+		return
+	}
+	var flags, ttl uint64
+	var err error
+	if v := r.Header.Get(s3HeaderFlags); v != "" {
+		if flags, err = strconv.ParseUint(v, 10, 32); err != nil {
+			writeS3Error(w, r, s3ErrInvalidArgument)
+			return
+		}
+	}
+	if v := r.Header.Get(s3HeaderTTL); v != "" {
+		if ttl, err = strconv.ParseUint(v, 10, 32); err != nil {
+			writeS3Error(w, r, s3ErrInvalidArgument)
+			return
+		}
+	}
+
+	// the digests are checked before the value is stored, a writer is not committed if mismatched
+	md5h := md5.New()
+	var sha256h hash.Hash
+	body := io.TeeReader(r.Body, md5h)
+	if payloadHash != "" && payloadHash != s3UnsignedPayload {
+		sha256h = sha256.New()
+		body = io.TeeReader(r.Body, io.MultiWriter(md5h, sha256h))
+	}
+	var item *cache.Item
+	var vw cache.ValueWriter
+	if r.ContentLength > streamingSetSize {
+		item = &cache.Item{Key: key, Flags: uint32(flags), TTL: uint32(ttl)}
+		if vw, err = s.cache.NewWriter(item, r.ContentLength); err != nil {
+			log.Printf("s3 set key %s err: %s", key, err)
+			writeS3Error(w, r, s3ErrInternalError)
+			return
+		}
+		err = readBodyTo(vw, body, r.ContentLength)
+	} else {
+		item = s.allocator.Alloc(int(r.ContentLength))
+		defer item.Free()
+		item.Key = key
+		item.Flags = uint32(flags)
+		item.TTL = uint32(ttl)
+		_, err = io.ReadFull(body, item.Value)
+	}
+	if err != nil {
+		writeS3Error(w, r, s3ErrIncompleteBody)
+		return
+	}
+	sum := md5h.Sum(nil)
+	if v := r.Header.Get("Content-Md5"); v != "" {
+		if v != base64.StdEncoding.EncodeToString(sum) {
+			writeS3Error(w, r, s3ErrBadDigest)
+			return
+		}
+	}
+	if sha256h != nil && payloadHash != hex.EncodeToString(sha256h.Sum(nil)) {
+		writeS3Error(w, r, s3ErrSHA256Mismatch)
+		return
+	}
+	item.MD5 = sum
+	if vw != nil {
+		err = vw.Commit(cache.StoreSet)
+	} else {
+		err = s.cache.Set(item)
+	}
+	if err != nil {
+		log.Printf("s3 set key %s err: %s", key, err)
+		writeS3Error(w, r, s3ErrInternalError)
+		return
+	}
+	w.Header().Set("ETag", s3ETag(item.Cas, item.MD5))
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteObject removes the object, it succeeds even if the object not exists
+func (s *S3Server) DeleteObject(w http.ResponseWriter, r *http.Request, key string) {
+	if err := s.cache.Del(key); err != nil && err != cache.ErrNotFound {
+		log.Printf("s3 del key %s err: %s", key, err)
+		writeS3Error(w, r, s3ErrInternalError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	EncodingType          string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+// prefixEnd returns the smallest key greater than all keys with prefix p, "" if not exists
+func prefixEnd(p string) string {
+	b := []byte(p)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// ListObjectsV2 lists the objects of bucket in pages,
+// the continuation token is the encoded key where the next page starts.
+func (s *S3Server) ListObjectsV2(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	res := s3ListBucketResult{
+		Name:              bucket,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		MaxKeys:           s3MaxKeys,
+		EncodingType:      q.Get("encoding-type"),
+		ContinuationToken: q.Get("continuation-token"),
+		StartAfter:        q.Get("start-after"),
+	}
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeS3Error(w, r, s3ErrInvalidArgument)
+			return
+		}
+		if n < res.MaxKeys {
+			res.MaxKeys = n
+		}
+	}
+	if res.EncodingType != "" && res.EncodingType != "url" {
+		writeS3Error(w, r, s3ErrInvalidArgument)
+		return
+	}
+
+	var start string // relative to the bucket
+	if res.ContinuationToken != "" {
+		b, err := base64.RawURLEncoding.DecodeString(res.ContinuationToken)
+		if err != nil {
+			writeS3Error(w, r, s3ErrInvalidArgument)
+			return
+		}
+		start = string(b)
+	} else if res.StartAfter != "" {
+		start = res.StartAfter + "\x00"
+	}
+
+	bucketPrefix := bucket + "/"
+	more := true
+	for more && !res.IsTruncated {
+		n := res.KeyCount
+		infos, err := s.cache.Scan(bucketPrefix+res.Prefix, bucketPrefix+start, res.MaxKeys-n+1)
+		if err != nil {
+			log.Printf("s3 list bucket %s err: %s", bucket, err)
+			writeS3Error(w, r, s3ErrInternalError)
+			return
+		}
+		more = false
+		for _, info := range infos {
+			if res.KeyCount == res.MaxKeys {
+				res.IsTruncated = true
+				break
+			}
+			key := info.Key[len(bucketPrefix):]
+			res.KeyCount++
+			if idx := strings.Index(key[len(res.Prefix):], res.Delimiter); res.Delimiter != "" && idx >= 0 {
+				prefix := key[:len(res.Prefix)+idx+len(res.Delimiter)]
+				res.CommonPrefixes = append(res.CommonPrefixes, s3CommonPrefix{Prefix: prefix})
+				// skip the keys of the common prefix and scan again
+				start = prefixEnd(prefix)
+				more = start != ""
+				break
+			}
+			res.Contents = append(res.Contents, s3Object{
+				Key:          key,
+				LastModified: time.Unix(info.Timestamp, 0).UTC().Format(s3TimeFormat),
+				ETag:         s3ETag(info.Cas, info.MD5),
+				Size:         info.Size,
+				StorageClass: "STANDARD",
+			})
+			start = key + "\x00"
+		}
+	}
+	if res.IsTruncated {
+		res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(start))
+	}
+	if res.EncodingType == "url" { // spaces are encoded as %20 like paths instead of +
+		res.Prefix = awsURIEncode(res.Prefix, false)
+		res.Delimiter = awsURIEncode(res.Delimiter, false)
+		res.StartAfter = awsURIEncode(res.StartAfter, false)
+		for i := range res.Contents {
+			res.Contents[i].Key = awsURIEncode(res.Contents[i].Key, false)
+		}
+		for i := range res.CommonPrefixes {
+			res.CommonPrefixes[i].Prefix = awsURIEncode(res.CommonPrefixes[i].Prefix, false)
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(res)
+}
+
+// verifySigV4 verifies the AWS Signature Version 4 in the Authorization header,
+// see https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3Server) verifySigV4(r *http.Request, now time.Time) *s3Error {
+	const algorithm = "AWS4-HMAC-SHA256"
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, algorithm+" ") {
+		return s3ErrAccessDenied // presigned urls are not supported
+	}
+	var credential, signedHeaders, signature string
+	for _, f := range strings.Split(auth[len(algorithm)+1:], ",") {
+		f = strings.TrimSpace(f)
+		switch {
+		case strings.HasPrefix(f, "Credential="):
+			credential = f[len("Credential="):]
+		case strings.HasPrefix(f, "SignedHeaders="):
+			signedHeaders = f[len("SignedHeaders="):]
+		case strings.HasPrefix(f, "Signature="):
+			signature = f[len("Signature="):]
+		}
+	}
+	// <access key>/<date>/<region>/s3/aws4_request
+	cred := strings.SplitN(credential, "/", 2)
+	if len(cred) != 2 || signedHeaders == "" || signature == "" {
+		return s3ErrAccessDenied
+	}
+	if cred[0] != s.options.AccessKey {
+		return s3ErrInvalidAccessKeyId
+	}
+	// the host and the date must be signed to avoid replaying to other hosts or at other times
+	headers := strings.Split(signedHeaders, ";")
+	if !containsString(headers, "host") || !containsString(headers, "x-amz-date") {
+		return s3ErrAccessDenied
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") == "" {
+		return s3ErrMissingSecurityHeader
+	}
+	scope := cred[1]
+	amzDate := r.Header.Get("X-Amz-Date")
+	t, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || scope != amzDate[:8]+"/"+s.options.Region+"/s3/aws4_request" {
+		return s3ErrSignatureDoesNotMatch
+	}
+	if d := now.Sub(t); d > 15*time.Minute || d < -15*time.Minute {
+		return s3ErrRequestTimeTooSkewed
+	}
+	expected := sigV4Signature(r, s.options.SecretKey, amzDate, scope, headers)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return s3ErrSignatureDoesNotMatch
+	}
+	return nil
+}
+
+// sigV4Signature returns the hex encoded signature of r
+func sigV4Signature(r *http.Request, secretKey, amzDate, scope string, signedHeaders []string) string {
+	var b strings.Builder
+	b.WriteString(r.Method + "\n")
+	b.WriteString(awsURIEncode(r.URL.Path, false) + "\n")
+
+	// canonical query string
+	q := r.URL.Query()
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		vv := append([]string(nil), q[k]...)
+		sort.Strings(vv)
+		for _, v := range vv {
+			params = append(params, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	b.WriteString(strings.Join(params, "&") + "\n")
+
+	// canonical headers
+	for _, name := range signedHeaders {
+		var v string
+		switch name {
+		case "host":
+			v = r.Host
+		case "content-length":
+			v = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			var vv []string
+			for _, s := range r.Header[http.CanonicalHeaderKey(name)] {
+				vv = append(vv, strings.Join(strings.Fields(s), " "))
+			}
+			v = strings.Join(vv, ",")
+		}
+		b.WriteString(name + ":" + v + "\n")
+	}
+	b.WriteString("\n" + strings.Join(signedHeaders, ";") + "\n")
+	b.WriteString(r.Header.Get("X-Amz-Content-Sha256"))
+
+	hash := sha256.Sum256([]byte(b.String()))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, s := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, s)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// awsURIEncode encodes s except the unreserved characters, and '/' is kept if it's not encodeSlash
+func awsURIEncode(s string, encodeSlash bool) string {
+	const hexChars = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexChars[c>>4])
+		b.WriteByte(hexChars[c&15])
+	}
+	return b.String()
+}
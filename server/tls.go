@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+)
+
+var (
+	errNoCACert      = errors.New("no certificate found in the CA file")
+	errCAFileMissing = errors.New("the CA file is required to verify client certificates")
+)
+
+type TLSOptions struct {
+	CertFile     string // the certificate of server in PEM
+	KeyFile      string // the private key of CertFile in PEM
+	CAFile       string // the CA certificates in PEM, client certificates are verified by them if given
+	VerifyClient bool   // require client certificates signed by CAFile
+}
+
+// TLSConfig is the TLS config of listeners, which can be reloaded from the files of TLSOptions.
+// only the handshakes after reloading use the new certificates, existing connections are not affected.
+type TLSConfig struct {
+	options TLSOptions
+	config  atomic.Value // *tls.Config
+}
+
+func NewTLSConfig(options *TLSOptions) (*TLSConfig, error) {
+	c := &TLSConfig{options: *options}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the files of TLSOptions again, the config is unchanged if any of them fails
+func (c *TLSConfig) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.options.CertFile, c.options.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.options.CAFile != "" {
+		b, err := ioutil.ReadFile(c.options.CAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return errNoCACert
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.options.VerifyClient {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if c.options.VerifyClient {
+		return errCAFileMissing
+	}
+	c.config.Store(config)
+	return nil
+}
+
+// NewListener returns a TLS listener of l, the handshakes use the latest config
+func (c *TLSConfig) NewListener(l net.Listener) net.Listener {
+	return tls.NewListener(l, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.config.Load().(*tls.Config), nil
+		},
+	})
+}
+
+// ClientCertSubject returns the subject of the verified client certificate of conn,
+// ok is false if conn is not a TLS connection or the client has no certificate.
+// the conns passed to handlers have completed the handshake.
+func ClientCertSubject(conn net.Conn) (subject pkix.Name, ok bool) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return pkix.Name{}, false
+	}
+	chains := tc.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return pkix.Name{}, false
+	}
+	return chains[0][0].Subject, true
+}
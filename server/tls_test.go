@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xiaost/blobcached/cache"
+)
+
+// testCert is a certificate signed by the parent, or self-signed if the parent is nil
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"blobcached"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	writeCert := func(c *testCert) {
+		ioutil.WriteFile(filepath.Join(dir, "cert.pem"), c.certPEM, 0600)
+		ioutil.WriteFile(filepath.Join(dir, "key.pem"), c.keyPEM, 0600)
+	}
+	writeCert(newTestCert(t, "server1", ca))
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), ca.certPEM, 0600)
+	options := &TLSOptions{
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		CAFile:       filepath.Join(dir, "ca.pem"),
+		VerifyClient: true,
+	}
+	if _, err := NewTLSConfig(&TLSOptions{CertFile: options.CertFile, KeyFile: options.KeyFile, VerifyClient: true}); err != errCAFileMissing {
+		t.Fatal("should require the CA file", err)
+	}
+	if _, err := NewTLSConfig(&TLSOptions{CertFile: options.CertFile, KeyFile: options.KeyFile, CAFile: options.KeyFile}); err != errNoCACert {
+		t.Fatal("should fail without CA certs", err)
+	}
+	config, err := NewTLSConfig(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMemcacheServer(nil, NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
+	go s.servListener(config.NewListener(l), "test", func(conn net.Conn) {
+		subject, _ := ClientCertSubject(conn)
+		conn.Write([]byte(subject.CommonName + "\n"))
+		bufio.NewReader(conn).ReadString('\n')
+	})
+	defer s.Shutdown()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := newTestCert(t, "client1", ca)
+	dial := func(certs ...tls.Certificate) (*tls.Conn, string, error) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certs})
+		if err != nil {
+			return nil, "", err
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+		return conn, line, nil
+	}
+
+	conn, subject, err := dial(client.tlsCert())
+	if err != nil || subject != "client1\n" {
+		t.Fatal("dial err", subject, err)
+	}
+	if cn := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "server1" {
+		t.Fatal("server cert err", cn)
+	}
+	if _, _, err := dial(); err == nil {
+		t.Fatal("should fail without client cert")
+	}
+	if _, _, err := dial(newTestCert(t, "client2", nil).tlsCert()); err == nil {
+		t.Fatal("should fail with client cert of another CA")
+	}
+
+	// new conns use the new cert after reloading, and the existing conn is not affected
+	writeCert(newTestCert(t, "server2", ca))
+	if err := config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	conn2, subject, err := dial(client.tlsCert())
+	if err != nil || subject != "client1\n" {
+		t.Fatal("dial err", subject, err)
+	}
+	if cn := conn2.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "server2" {
+		t.Fatal("server cert not reloaded", cn)
+	}
+	conn2.Close()
+	if _, err := conn.Write([]byte("quit\n")); err != nil {
+		t.Fatal("existing conn err", err)
+	}
+	conn.Close()
+
+	// the config is unchanged if reloading fails
+	ioutil.WriteFile(options.KeyFile, nil, 0600)
+	if err := config.Reload(); err == nil {
+		t.Fatal("reload should fail")
+	}
+	if _, _, err := dial(client.tlsCert()); err != nil {
+		t.Fatal("dial err", err)
+	}
+}
+
+func TestMemcacheServerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	srvCert := newTestCert(t, "server", ca)
+	ioutil.WriteFile(filepath.Join(dir, "cert.pem"), srvCert.certPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "key.pem"), srvCert.keyPEM, 0600)
+	config, err := NewTLSConfig(&TLSOptions{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMemcacheServer(config.NewListener(l), NewInMemoryCache(), cache.NewAllocatorPool(4096), nil)
+	done := make(chan error)
+	go func() { done <- s.Serv() }()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	value := string(make([]byte, sendfileSize)) // sent by the writer of the conn instead of sendfile
+	for _, tc := range []struct {
+		req string
+		rsp string
+	}{
+		{"set k1 0 0 2\r\nv1\r\n", "STORED\r\n"},
+		{"get k1\r\n", "VALUE k1 0 2\r\nv1\r\nEND\r\n"},
+		{"set k2 0 0 65536\r\n" + value + "\r\n", "STORED\r\n"},
+		{"get k2\r\n", "VALUE k2 0 65536\r\n" + value + "\r\nEND\r\n"},
+	} {
+		end := "END"
+		if tc.rsp == "STORED\r\n" {
+			end = "STORED"
+		}
+		if rsp := roundtrip(t, conn, r, tc.req, end); rsp != tc.rsp {
+			t.Fatalf("%.40q: %.40q != %.40q", tc.req, rsp, tc.rsp)
+		}
+	}
+
+	// idle conns and pending handshakes are closed by Shutdown
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	time.Sleep(10 * time.Millisecond)
+	s.Shutdown()
+	select {
+	case err := <-done:
+		if err != ErrServerClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown timeout")
+	}
+}
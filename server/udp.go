@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/xiaost/blobcached/cache"
+	"github.com/xiaost/blobcached/protocol/memcache"
+)
+
+const (
+	// the max size of datagrams including the frame header like memcached, rsps are split into datagrams of it
+	maxUDPDatagramSize = 1400
+
+	// rsps larger than maxUDPRspSize are not sent over udp,
+	// the source addrs of datagrams can be spoofed and a small request must not get a large rsp like memcached.
+	maxUDPRspDatagrams = 4
+	maxUDPRspSize      = maxUDPRspDatagrams * (maxUDPDatagramSize - memcache.UDPHeaderLen)
+	maxUDPValueSize    = maxUDPRspSize
+)
+
+var errUDPTooLarge = errors.New("object too large for udp")
+
+// ServUDP serves get and gets of the memcached udp protocol on pc until Shutdown,
+// datagrams are processed by GOMAXPROCS goroutines concurrently.
+func (s *MemcacheServer) ServUDP(pc net.PacketConn) error {
+	if !s.addListener(pc) {
+		pc.Close()
+		return ErrServerClosed
+	}
+	log.Printf("memcache udp server listening on %s", pc.LocalAddr())
+	n := runtime.GOMAXPROCS(0)
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() { errc <- s.servUDP(pc) }()
+	}
+	err := <-errc
+	pc.Close() // stops other goroutines
+	for i := 1; i < n; i++ {
+		<-errc
+	}
+	if s.isClosed() {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// servUDP reads and processes the requests of pc one by one until pc closed
+func (s *MemcacheServer) servUDP(pc net.PacketConn) error {
+	parser := memcache.Parser{MaxKeyLen: s.maxKeyLen()}
+	buf := make([]byte, 64<<10)
+	dgram := make([]byte, 0, maxUDPDatagramSize)
+	rsp := &bytes.Buffer{}
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&s.metrics.BytesRead, uint64(n))
+		h, err := memcache.ParseUDPHeader(buf[:n])
+		if err != nil {
+			s.logf(LogDebug, "udp client %s err: %s", addr, err)
+			continue
+		}
+		if h.Total != 1 { // like memcached, requests in multiple datagrams are not supported
+			s.logf(LogDebug, "udp client %s err: request in %d datagrams", addr, h.Total)
+			continue
+		}
+		rsp.Reset()
+		s.HandleUDP(rsp, &parser, buf[memcache.UDPHeaderLen:n])
+		err = s.sendUDP(pc, addr, dgram, h.RequestID, rsp.Bytes())
+		if err == errUDPTooLarge { // the rsps of several commands
+			err = s.sendUDP(pc, addr, dgram, h.RequestID, memcache.MakeRspServerErr(errUDPTooLarge))
+		}
+		if err != nil {
+			s.logf(LogError, "write udp %s err: %s", addr, err)
+		}
+	}
+}
+
+// HandleUDP processes the commands in the payload of a datagram, and writes the rsps to w.
+// commands other than get and gets are not supported.
+func (s *MemcacheServer) HandleUDP(w *bytes.Buffer, parser *memcache.Parser, data []byte) {
+	for len(data) > 0 {
+		advance, cmdinfo, err := parser.Parse(data)
+		if err == memcache.ErrNeedMoreData {
+			w.Write(memcache.RspErr)
+			return
+		}
+		if err != nil {
+			w.Write(memcache.MakeRspClientErr(err))
+			return
+		}
+		data = data[advance:]
+		s.logf(LogDebug, "udp command: %s %v", cmdinfo.Cmd, cmdinfo.Keys)
+		switch cmdinfo.Cmd {
+		case "get", "gets":
+			s.handleUDPGet(w, cmdinfo)
+		default:
+			w.Write(memcache.MakeRspServerErr(errNotSupportedCommand))
+			return
+		}
+	}
+}
+
+// handleUDPGet writes the rsp of get and gets to w,
+// SERVER_ERROR is written instead if any value or the whole rsp is too large for udp.
+func (s *MemcacheServer) handleUDPGet(w *bytes.Buffer, cmdinfo *memcache.CommandInfo) {
+	items, errs := s.cache.GetMulti(cmdinfo.Keys, maxUDPValueSize)
+	defer func() {
+		for _, item := range items {
+			if item != nil {
+				item.Free()
+			}
+		}
+	}()
+	start := w.Len()
+	for i, k := range cmdinfo.Keys {
+		item, err := items[i], errs[i]
+		if err == cache.ErrNotFound {
+			continue
+		}
+		if err != nil && err != cache.ErrValueSize {
+			log.Printf("get key %s err: %s", k, err)
+			continue
+		}
+		if err == nil {
+			// VALUE <key> <flags> <bytes> [<cas unique>]\r\n
+			// <data block>\r\n
+			if cmdinfo.Cmd == "gets" {
+				fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", k, item.Flags, len(item.Value), item.Cas)
+			} else {
+				fmt.Fprintf(w, "VALUE %s %d %d\r\n", k, item.Flags, len(item.Value))
+			}
+		}
+		// the whole encoded rsp including the rsps of previous commands and END
+		if err == cache.ErrValueSize || w.Len()+len(item.Value)+len(memcache.EOL)+len(memcache.RspEnd) > maxUDPRspSize {
+			w.Truncate(start)
+			w.Write(memcache.MakeRspServerErr(errUDPTooLarge))
+			return
+		}
+		w.Write(item.Value)
+		w.Write(memcache.EOL)
+	}
+	w.Write(memcache.RspEnd)
+}
+
+// sendUDP sends rsp to addr in datagrams with the frame headers of the request, b is the buffer of datagrams.
+// it returns errUDPTooLarge without sending if rsp needs more than maxUDPRspDatagrams.
+func (s *MemcacheServer) sendUDP(pc net.PacketConn, addr net.Addr, b []byte, id uint16, rsp []byte) error {
+	const payload = maxUDPDatagramSize - memcache.UDPHeaderLen
+	total := (len(rsp) + payload - 1) / payload
+	if total > maxUDPRspDatagrams {
+		return errUDPTooLarge
+	}
+	for seq := 0; seq < total; seq++ {
+		h := memcache.UDPHeader{RequestID: id, Seq: uint16(seq), Total: uint16(total)}
+		n := len(rsp)
+		if n > payload {
+			n = payload
+		}
+		b = append(h.Append(b[:0]), rsp[:n]...)
+		if _, err := pc.WriteTo(b, addr); err != nil {
+			return err
+		}
+		atomic.AddUint64(&s.metrics.BytesWritten, uint64(len(b)))
+		rsp = rsp[n:]
+	}
+	return nil
+}
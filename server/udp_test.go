@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xiaost/blobcached/cache"
+	"github.com/xiaost/blobcached/protocol/memcache"
+)
+
+// udpRoundtrip sends req in a datagram with the request id, and reassembles the rsp by sequence numbers
+func udpRoundtrip(t *testing.T, conn net.Conn, id uint16, req string) (string, int) {
+	h := memcache.UDPHeader{RequestID: id, Total: 1}
+	if _, err := conn.Write(append(h.Append(nil), req...)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var parts [][]byte
+	buf := make([]byte, 64<<10)
+	for received := 0; parts == nil || received < len(parts); received++ {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > maxUDPDatagramSize {
+			t.Fatal("datagram too large", n)
+		}
+		h, err := memcache.ParseUDPHeader(buf[:n])
+		if err != nil || h.RequestID != id {
+			t.Fatal("bad frame header", h, err)
+		}
+		if parts == nil {
+			parts = make([][]byte, h.Total)
+		}
+		if int(h.Total) != len(parts) || parts[h.Seq] != nil {
+			t.Fatal("bad frame header", h)
+		}
+		parts[h.Seq] = append([]byte(nil), buf[memcache.UDPHeaderLen:n]...)
+	}
+	return string(bytes.Join(parts, nil)), len(parts)
+}
+
+func TestMemcacheServerUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewInMemoryCache()
+	s := NewMemcacheServer(nil, c, cache.NewAllocatorPool(4096), nil)
+	done := make(chan error)
+	go func() { done <- s.ServUDP(pc) }()
+
+	large := strings.Repeat("x", 3000)
+	c.Set(&cache.Item{Key: "k1", Value: []byte("v1"), Flags: 1})
+	c.Set(&cache.Item{Key: "k2", Value: []byte(large)})
+	c.Set(&cache.Item{Key: "k3", Value: make([]byte, maxUDPValueSize+1)})
+	// the whole rsp of k4 is maxUDPRspSize: "VALUE k4 0 5544\r\n" + value + "\r\nEND\r\n"
+	full := strings.Repeat("y", maxUDPRspSize-24)
+	c.Set(&cache.Item{Key: "k4", Value: []byte(full)})
+	c.Set(&cache.Item{Key: "k5", Value: []byte(full + "y")})
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	item, _ := c.Get("k1")
+	for _, tc := range []struct {
+		req   string
+		rsp   string
+		total int
+	}{
+		{"get k1 nosuchkey\r\n", "VALUE k1 1 2\r\nv1\r\nEND\r\n", 1},
+		{"gets k1\r\n", fmt.Sprintf("VALUE k1 1 2 %d\r\nv1\r\nEND\r\n", item.Cas), 1},
+		{"get k1\r\nget k1\r\n", "VALUE k1 1 2\r\nv1\r\nEND\r\nVALUE k1 1 2\r\nv1\r\nEND\r\n", 1},
+		{"get k2 k1\r\n", "VALUE k2 0 3000\r\n" + large + "\r\nVALUE k1 1 2\r\nv1\r\nEND\r\n", 3},
+		{"get k2 k2\r\n", "SERVER_ERROR object too large for udp\r\n", 1},
+		{"get k1 k3\r\n", "SERVER_ERROR object too large for udp\r\n", 1},
+		{"get k4\r\n", "VALUE k4 0 5544\r\n" + full + "\r\nEND\r\n", maxUDPRspDatagrams},
+		{"get k5\r\n", "SERVER_ERROR object too large for udp\r\n", 1},
+		{"get k4\r\nget nosuchkey\r\n", "SERVER_ERROR object too large for udp\r\n", 1},
+		{"set k1 0 0 1\r\nx\r\n", "SERVER_ERROR not supported command\r\n", 1},
+		{"get k1", "ERROR\r\n", 1},
+	} {
+		rsp, total := udpRoundtrip(t, conn, 7, tc.req)
+		if rsp != tc.rsp || total != tc.total {
+			t.Fatalf("%.40q: %.40q != %.40q, %d datagrams", tc.req, rsp, tc.rsp, total)
+		}
+	}
+	item.Free()
+
+	s.Shutdown()
+	if err := <-done; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}